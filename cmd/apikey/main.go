@@ -0,0 +1,110 @@
+// Command apikey issues, lists and revokes the API keys in the file a
+// server reads with -api-keys. A running server picks changes up on the next
+// request, so this also works as an emergency revocation tool.
+//
+//	apikey issue -file keys.json -tenant acme -name till-1 -scopes devices:read,devices:sign
+//	apikey list -file keys.json [-tenant acme]
+//	apikey revoke -file keys.json -tenant acme <key id>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/oxygenesis/signature/internal/auth"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// test-stubbables
+var osExit = os.Exit
+
+func main() {
+	osExit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+const usage = "usage: apikey issue|list|revoke -file <keys.json> [flags]"
+
+// run returns 0 on success, 1 when the key store rejects the command and 2
+// for usage errors.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("apikey "+cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		path   string
+		tenant string
+		name   string
+		scopes string
+	)
+	fs.StringVar(&path, "file", "", "API key file")
+	fs.StringVar(&tenant, "tenant", "", "tenant the key belongs to (list: filter, empty = all)")
+	if cmd == "issue" {
+		fs.StringVar(&name, "name", "", "free-form note, e.g. the client the key is for")
+		fs.StringVar(&scopes, "scopes", "", "comma-separated: devices:read, devices:create, devices:sign, devices:manage, admin")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if path == "" {
+		fmt.Fprintln(stderr, "error: -file is required")
+		return 2
+	}
+	ks, err := auth.OpenKeyStore(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	switch {
+	case cmd == "issue" && fs.NArg() == 0:
+		var ss []service.Scope
+		for _, s := range strings.Split(scopes, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				ss = append(ss, service.Scope(s))
+			}
+		}
+		k, secret, err := ks.Issue(tenant, name, ss)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "id:     %s\ntenant: %s\nscopes: %s\nkey:    %s\n", k.ID, k.Tenant, joinScopes(k.Scopes), secret)
+		fmt.Fprintln(stderr, "store the key now; it cannot be shown again")
+	case cmd == "list" && fs.NArg() == 0:
+		keys, err := ks.List(tenant)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		enc := json.NewEncoder(stdout)
+		for _, k := range keys {
+			_ = enc.Encode(k)
+		}
+	case cmd == "revoke" && fs.NArg() == 1:
+		if err := ks.Revoke(tenant, fs.Arg(0)); err != nil {
+			fmt.Fprintf(stderr, "error: %s in tenant %q: %v\n", fs.Arg(0), tenant, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "revoked %s\n", fs.Arg(0))
+	default:
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	return 0
+}
+
+func joinScopes(ss []service.Scope) string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = string(s)
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/auth"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+func TestRun_IssueListRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	var out, errOut bytes.Buffer
+	if code := run([]string{"issue", "-file", path, "-tenant", "acme", "-name", "till", "-scopes", "devices:read, devices:sign"}, &out, &errOut); code != 0 {
+		t.Fatalf("issue code=%d err=%q", code, errOut.String())
+	}
+	var id, secret string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			switch k {
+			case "id":
+				id = strings.TrimSpace(v)
+			case "key":
+				secret = strings.TrimSpace(v)
+			}
+		}
+	}
+
+	// the server side sees the key the CLI wrote
+	ks, err := auth.OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ks.Authenticate(secret)
+	if err != nil || c.Tenant != "acme" || !c.Can(service.ScopeSign) || c.Can(service.ScopeCreate) {
+		t.Fatalf("caller=%+v err=%v", c, err)
+	}
+
+	out.Reset()
+	if code := run([]string{"list", "-file", path}, &out, &errOut); code != 0 || !strings.Contains(out.String(), `"id":"`+id+`"`) || strings.Contains(out.String(), "hash") {
+		t.Fatalf("list code=%d out=%q", code, out.String())
+	}
+	if code := run([]string{"revoke", "-file", path, "-tenant", "other", id}, &out, &errOut); code != 1 {
+		t.Fatalf("revoke in other tenant code=%d", code)
+	}
+	if code := run([]string{"revoke", "-file", path, "-tenant", "acme", id}, &out, &errOut); code != 0 {
+		t.Fatalf("revoke code=%d err=%q", code, errOut.String())
+	}
+	if ks, _ = auth.OpenKeyStore(path); ks == nil {
+		t.Fatal("reopen failed")
+	}
+	if _, err := ks.Authenticate(secret); err == nil {
+		t.Fatal("revoked key still authenticates")
+	}
+}
+
+func TestRun_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	for _, tc := range []struct {
+		args []string
+		code int
+	}{
+		{nil, 2},
+		{[]string{"rotate", "-file", path}, 2},
+		{[]string{"list"}, 2},
+		{[]string{"list", "-bogus"}, 2},
+		{[]string{"revoke", "-file", path}, 2},
+		{[]string{"issue", "-file", path, "-tenant", "acme"}, 1},
+		{[]string{"issue", "-file", path, "-tenant", "acme", "-scopes", "root"}, 1},
+		{[]string{"issue", "-file", path, "-tenant", "bad tenant", "-scopes", "admin"}, 1},
+		{[]string{"list", "-file", t.TempDir()}, 1},
+	} {
+		var out, errOut bytes.Buffer
+		if code := run(tc.args, &out, &errOut); code != tc.code {
+			t.Fatalf("%v: code=%d want %d (%s)", tc.args, code, tc.code, errOut.String())
+		}
+	}
+}
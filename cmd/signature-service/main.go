@@ -2,23 +2,29 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	httpApp "github.com/oxygenesis/signature/internal/app/http"
+	"github.com/oxygenesis/signature/internal/auth"
 	"github.com/oxygenesis/signature/internal/crypto"
 	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/service"
 	"github.com/oxygenesis/signature/internal/storage"
 	"github.com/oxygenesis/signature/pkg/id"
-)
-
-type factory struct{}
 
-func (factory) NewRSA(bits int) (domain.Signer, error) { return crypto.NewRSASigner(bits) }
-func (factory) NewECDSA() (domain.Signer, error)       { return crypto.NewECDSASigner() }
+	_ "modernc.org/sqlite"
+)
 
 // test-stubbables
 var httpStart = httpApp.Start
@@ -26,29 +32,176 @@ var osExit = os.Exit
 
 func main() {
 	var (
-		mode string
-		addr string
-		test bool
+		mode      string
+		addr      string
+		test      bool
+		store     storeConfig
+		rsaBits   string
+		eccCurves string
+		idemTTL   time.Duration
+		idFormat  string
+		apiKeys   string
+		jwt       auth.JWTConfig
+		tlsFiles  httpApp.TLSFiles
+		drain     time.Duration
 	)
 	flag.StringVar(&mode, "mode", "http", "service mode: http")
 	flag.StringVar(&addr, "addr", ":8080", "listen address")
 	flag.BoolVar(&test, "t", false, "test mode: build server only")
+	flag.StringVar(&store.kind, "store", "memory", "repository backend: memory | file | sqlite")
+	flag.StringVar(&store.dataDir, "data-dir", "data", "directory for the file store (wal + snapshots)")
+	flag.IntVar(&store.snapshotEvery, "snapshot-every", 1000, "file store: snapshot after this many log records (0 = only on close)")
+	flag.StringVar(&store.dsn, "dsn", "file:signature.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", "sqlite store: data source name")
+	flag.StringVar(&rsaBits, "rsa-bits", "", "allowed RSA key sizes, first is the default (e.g. 3072,4096); empty = built-in list")
+	flag.StringVar(&eccCurves, "ecc-curves", "", "allowed ECDSA curves, first is the default (e.g. P-384,P-521); empty = built-in list")
+	flag.DurationVar(&idemTTL, "idempotency-window", service.DefaultIdempotencyWindow, "how long a sign request's Idempotency-Key returns the original signature")
+	flag.StringVar(&idFormat, "id-format", "uuidv7", "generator for device IDs the client leaves out: uuidv4 | uuidv7 | ulid")
+	flag.StringVar(&apiKeys, "api-keys", "", "API key file (see cmd/apikey); when set every device route accepts its keys")
+	flag.StringVar(&jwt.JWKS, "jwks", "", "JWKS file or URL; when set every device route accepts RS256/ES256 bearer tokens signed by its keys")
+	flag.StringVar(&jwt.Issuer, "jwt-issuer", "", "required iss claim (empty = not checked)")
+	flag.StringVar(&jwt.Audience, "jwt-audience", "", "required aud claim (empty = not checked)")
+	flag.StringVar(&jwt.TenantClaim, "jwt-tenant-claim", "tenant", "claim holding the caller's tenant")
+	flag.StringVar(&jwt.ScopeClaim, "jwt-scope-claim", "scope", "claim holding the caller's scopes (space-separated string or array)")
+	flag.StringVar(&tlsFiles.CertFile, "tls-cert", "", "PEM certificate (chain) to serve HTTPS with; reloaded when the file changes")
+	flag.StringVar(&tlsFiles.KeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&tlsFiles.ClientCAFile, "tls-client-ca", "", "PEM CA bundle; when set, verified client certificates authenticate requests (mutual TLS)")
+	flag.DurationVar(&drain, "shutdown-timeout", httpApp.DefaultShutdownTimeout, "on SIGINT/SIGTERM, how long in-flight requests may take to finish before connections are closed")
 	flag.Parse()
 
-	ctx := context.Background()
-	repo := storage.NewMemory()
-	svc := service.New(repo, factory{}, id.UUIDv4{})
+	// SIGINT/SIGTERM start a graceful shutdown; a second signal kills the
+	// process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	algs := crypto.Default()
+	if err := restrictKeys(algs, rsaBits, eccCurves); err != nil {
+		log.Printf("fatal: %v", err)
+		osExit(1)
+		return
+	}
+	ids, err := id.ByName(idFormat)
+	if err != nil {
+		log.Printf("fatal: -id-format: %v", err)
+		osExit(1)
+		return
+	}
+	opts := httpApp.Options{ShutdownTimeout: drain}
+	if apiKeys != "" {
+		if opts.Keys, err = auth.OpenKeyStore(apiKeys); err != nil {
+			log.Printf("fatal: -api-keys: %v", err)
+			osExit(1)
+			return
+		}
+	}
+	if jwt.JWKS != "" {
+		if opts.JWT, err = auth.NewJWTVerifier(jwt); err != nil {
+			log.Printf("fatal: -jwks: %v", err)
+			osExit(1)
+			return
+		}
+		if jwt.Issuer == "" && jwt.Audience == "" {
+			log.Printf("warning: -jwks without -jwt-issuer or -jwt-audience accepts tokens the key set's owner minted for any service")
+		}
+	}
+	if tlsFiles != (httpApp.TLSFiles{}) {
+		if tlsFiles.CertFile == "" || tlsFiles.KeyFile == "" {
+			log.Printf("fatal: -tls-cert and -tls-key must be set together (and -tls-client-ca needs both)")
+			osExit(1)
+			return
+		}
+		opts.TLS = &tlsFiles
+	}
+	if opts.Keys == nil && opts.JWT == nil && tlsFiles.ClientCAFile == "" {
+		log.Printf("warning: none of -api-keys, -jwks or -tls-client-ca, requests are not authenticated")
+	}
+	repo, err := openRepository(store)
+	if err != nil {
+		log.Printf("fatal: %v", err)
+		osExit(1)
+		return
+	}
+	svc := service.New(repo, algs, ids)
+	svc.SetIdempotencyWindow(idemTTL)
 
-	var err error
 	switch mode {
 	case "http":
-		err = httpStart(ctx, addr, svc, test)
+		err = httpStart(ctx, addr, svc, opts, test)
 	default:
 		err = errors.New("unsupported mode")
 	}
 
+	// the server has drained, so nothing writes any more: flush and close
+	if c, ok := repo.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && ctx.Err() != nil {
+		log.Printf("stopped")
+	}
+
 	if err != nil {
 		log.Printf("fatal: %v", err)
 		osExit(1)
 	}
 }
+
+type storeConfig struct {
+	kind          string
+	dataDir       string
+	snapshotEvery int
+	dsn           string
+}
+
+// openRepository selects the storage backend named by cfg.kind.
+func openRepository(cfg storeConfig) (storage.Repository, error) {
+	switch cfg.kind {
+	case "memory":
+		return storage.NewMemory(), nil
+	case "file":
+		return storage.OpenFile(cfg.dataDir, crypto.PEMCodec{}, cfg.snapshotEvery)
+	case "sqlite":
+		db, err := sql.Open("sqlite", cfg.dsn)
+		if err != nil {
+			return nil, err
+		}
+		repo, err := storage.NewSQL(db, storage.SQLite, crypto.PEMCodec{})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return repo, nil
+	default:
+		return nil, fmt.Errorf("unsupported store %q", cfg.kind)
+	}
+}
+
+// restrictKeys applies the -rsa-bits / -ecc-curves allow-lists to algs.
+func restrictKeys(algs *crypto.Registry, rsaBits, eccCurves string) error {
+	if rsaBits != "" {
+		var allowed []domain.KeyParams
+		for _, v := range strings.Split(rsaBits, ",") {
+			bits, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("-rsa-bits: %w", err)
+			}
+			allowed = append(allowed, domain.KeyParams{Bits: bits})
+		}
+		if err := algs.Restrict(domain.AlgRSA, allowed); err != nil {
+			return err
+		}
+	}
+	if eccCurves != "" {
+		var allowed []domain.KeyParams
+		for _, v := range strings.Split(eccCurves, ",") {
+			allowed = append(allowed, domain.KeyParams{Curve: strings.TrimSpace(v)})
+		}
+		if err := algs.Restrict(domain.AlgECC, allowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,14 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	httpApp "github.com/oxygenesis/signature/internal/app/http"
+	"github.com/oxygenesis/signature/internal/crypto"
+	"github.com/oxygenesis/signature/internal/domain"
 	svc "github.com/oxygenesis/signature/internal/service"
 )
 
+// dflt is the caller the tests act for.
+var dflt = svc.Caller{Tenant: domain.DefaultTenant, Scopes: []svc.Scope{svc.ScopeAdmin}}
+
 // OK path: Start returns nil, main must not call osExit.
 func TestMain_HTTP_OK(t *testing.T) {
 	origStart, origExit := httpStart, osExit
@@ -25,7 +37,7 @@ func TestMain_HTTP_OK(t *testing.T) {
 	os.Args = []string{"app", "-mode=http", "-addr=:0"}
 
 	called := false
-	httpStart = func(ctx context.Context, addr string, s *svc.DeviceService, test bool) error {
+	httpStart = func(ctx context.Context, addr string, s *svc.DeviceService, _ httpApp.Options, test bool) error {
 		if s == nil {
 			t.Fatal("nil *service.Service passed to httpStart")
 		}
@@ -53,7 +65,7 @@ func TestMain_HTTP_Error_Exits(t *testing.T) {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	os.Args = []string{"app", "-mode=http", "-addr=:0"}
 
-	httpStart = func(context.Context, string, *svc.DeviceService, bool) error {
+	httpStart = func(context.Context, string, *svc.DeviceService, httpApp.Options, bool) error {
 		return errors.New("boom")
 	}
 	exited := false
@@ -75,7 +87,7 @@ func TestMain_UnsupportedMode_Exits(t *testing.T) {
 	}()
 
 	// ensure httpStart is NOT called on unsupported mode
-	httpStart = func(context.Context, string, *svc.DeviceService, bool) error {
+	httpStart = func(context.Context, string, *svc.DeviceService, httpApp.Options, bool) error {
 		t.Fatal("httpStart must not be called for unsupported mode")
 		return nil
 	}
@@ -91,12 +103,305 @@ func TestMain_UnsupportedMode_Exits(t *testing.T) {
 	}
 }
 
-func TestFactory_Methods_Covered(t *testing.T) {
-	f := factory{}
-	if s, err := f.NewRSA(1024); err != nil || s.AlgorithmName() != "RSA" {
-		t.Fatalf("NewRSA failed: %v", err)
+func TestMain_PersistentStores_SurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"-store=file", "-data-dir=" + dir},
+		{"-store=sqlite", "-dsn=file:" + filepath.Join(dir, "sig.db")},
+	} {
+		t.Run(args[0], func(t *testing.T) { testPersistsAcrossRuns(t, args) })
+	}
+}
+
+func testPersistsAcrossRuns(t *testing.T, args []string) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	osExit = func(int) { t.Fatal("should not exit on OK path") }
+
+	run := func(fn func(s *svc.DeviceService)) {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		os.Args = append([]string{"app"}, args...)
+		httpStart = func(_ context.Context, _ string, s *svc.DeviceService, _ httpApp.Options, _ bool) error {
+			fn(s)
+			return nil
+		}
+		main()
+	}
+
+	run(func(s *svc.DeviceService) {
+		if _, err := s.CreateDevice(dflt, svc.CreateDeviceRequest{ID: "dev", Algorithm: "ECC", KeyParams: domain.KeyParams{Curve: "P-384"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Sign(dflt, "dev", "hello"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	run(func(s *svc.DeviceService) {
+		d, err := s.GetDevice(dflt, "dev")
+		if err != nil || d.SignatureCounter != 1 || d.KeyParams.Curve != "P-384" {
+			t.Fatalf("device not restored: %+v %v", d, err)
+		}
+	})
+}
+
+func TestMain_UnsupportedStore_Exits(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+
+	httpStart = func(context.Context, string, *svc.DeviceService, httpApp.Options, bool) error {
+		t.Fatal("httpStart must not be called without a repository")
+		return nil
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-store=tape"}
+
+	exited := false
+	osExit = func(int) { exited = true }
+	main()
+	if !exited {
+		t.Fatal("expected osExit to be called for unsupported store")
+	}
+}
+
+func TestMain_KeyAllowList(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	osExit = func(int) { t.Fatal("should not exit on OK path") }
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-ecc-curves=P-384, P-521", "-rsa-bits=4096"}
+
+	httpStart = func(_ context.Context, _ string, s *svc.DeviceService, _ httpApp.Options, _ bool) error {
+		dev, err := s.CreateDevice(dflt, svc.CreateDeviceRequest{ID: "a", Algorithm: domain.AlgECC})
+		if err != nil || dev.KeyParams.Curve != "P-384" {
+			t.Fatalf("default curve not applied: %+v %v", dev, err)
+		}
+		if _, err := s.CreateDevice(dflt, svc.CreateDeviceRequest{ID: "b", Algorithm: domain.AlgECC, KeyParams: domain.KeyParams{Curve: "P-256"}}); !errors.Is(err, domain.ErrInvalidKeyParams) {
+			t.Fatalf("P-256 must be rejected, got %v", err)
+		}
+		return nil
+	}
+	main()
+}
+
+func TestRestrictKeys_Errors(t *testing.T) {
+	for _, c := range []struct{ rsa, ecc string }{
+		{rsa: "big"},
+		{rsa: "1024"},
+		{ecc: "P-192"},
+	} {
+		if err := restrictKeys(crypto.Default(), c.rsa, c.ecc); err == nil {
+			t.Fatalf("%+v: want error", c)
+		}
+	}
+}
+
+func TestMain_InvalidAllowList_Exits(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	httpStart = func(context.Context, string, *svc.DeviceService, httpApp.Options, bool) error {
+		t.Fatal("httpStart must not be called with an invalid allow-list")
+		return nil
+	}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-rsa-bits=512"}
+	exited := false
+	osExit = func(int) { exited = true }
+	main()
+	if !exited {
+		t.Fatal("expected osExit")
+	}
+}
+
+func TestMain_IDFormat(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	osExit = func(int) { t.Fatal("should not exit on OK path") }
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-id-format=ulid"}
+
+	httpStart = func(_ context.Context, _ string, s *svc.DeviceService, _ httpApp.Options, _ bool) error {
+		dev, err := s.CreateDevice(dflt, svc.CreateDeviceRequest{Algorithm: domain.AlgEd25519})
+		if err != nil || len(dev.ID) != 26 {
+			t.Fatalf("want a generated ULID, got %+v %v", dev, err)
+		}
+		return nil
+	}
+	main()
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-id-format=snowflake"}
+	exited := false
+	osExit = func(int) { exited = true }
+	main()
+	if !exited {
+		t.Fatal("expected osExit for an unknown id format")
+	}
+}
+
+func TestMain_APIKeys(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	osExit = func(int) { t.Fatal("should not exit on OK path") }
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	keys := filepath.Join(t.TempDir(), "keys.json")
+	os.Args = []string{"app", "-api-keys=" + keys}
+
+	httpStart = func(_ context.Context, _ string, _ *svc.DeviceService, opts httpApp.Options, _ bool) error {
+		if opts.Keys == nil {
+			t.Fatal("key store not passed to the server")
+		}
+		return nil
+	}
+	main()
+
+	_ = os.WriteFile(keys, []byte("not json"), 0o600)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	exited := false
+	osExit = func(int) { exited = true }
+	main()
+	if !exited {
+		t.Fatal("expected osExit for a corrupt key file")
+	}
+}
+
+func TestMain_JWKS(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	_ = os.WriteFile(jwks, []byte(`{"keys":[{"kty":"EC","crv":"P-256","kid":"k",`+
+		`"x":"`+base64.RawURLEncoding.EncodeToString(ec.X.FillBytes(make([]byte, 32)))+`",`+
+		`"y":"`+base64.RawURLEncoding.EncodeToString(ec.Y.FillBytes(make([]byte, 32)))+`"}]}`), 0o600)
+
+	osExit = func(int) { t.Fatal("should not exit on OK path") }
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-jwks=" + jwks, "-jwt-issuer=https://idp"}
+	httpStart = func(_ context.Context, _ string, _ *svc.DeviceService, opts httpApp.Options, _ bool) error {
+		if opts.JWT == nil || opts.Keys != nil {
+			t.Fatalf("options=%+v", opts)
+		}
+		return nil
 	}
-	if s, err := f.NewECDSA(); err != nil || s.AlgorithmName() != "ECC" {
-		t.Fatalf("NewECDSA failed: %v", err)
+	main()
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-jwks=" + filepath.Join(t.TempDir(), "missing.json")}
+	exited := false
+	osExit = func(int) { exited = true }
+	main()
+	if !exited {
+		t.Fatal("expected osExit for an unreadable JWKS")
+	}
+}
+
+func TestMain_TLSFlags(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	var got httpApp.Options
+	httpStart = func(_ context.Context, _ string, _ *svc.DeviceService, opts httpApp.Options, _ bool) error {
+		got = opts
+		return nil
+	}
+
+	osExit = func(int) { t.Fatal("should not exit on OK path") }
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	os.Args = []string{"app", "-tls-cert=s.crt", "-tls-key=s.key", "-tls-client-ca=ca.pem"}
+	main()
+	if got.TLS == nil || *got.TLS != (httpApp.TLSFiles{CertFile: "s.crt", KeyFile: "s.key", ClientCAFile: "ca.pem"}) {
+		t.Fatalf("options=%+v", got)
+	}
+
+	for _, args := range [][]string{
+		{"-tls-cert=s.crt"},
+		{"-tls-key=s.key"},
+		{"-tls-client-ca=ca.pem"},
+	} {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		os.Args = append([]string{"app"}, args...)
+		exited := false
+		osExit = func(int) { exited = true }
+		main()
+		if !exited {
+			t.Fatalf("%v: expected osExit", args)
+		}
+	}
+}
+
+func TestMain_SignalShutsDownAndFlushes(t *testing.T) {
+	origStart, origExit := httpStart, osExit
+	origArgs, origCmd := os.Args, flag.CommandLine
+	defer func() {
+		httpStart, osExit = origStart, origExit
+		os.Args = origArgs
+		flag.CommandLine = origCmd
+	}()
+	osExit = func(int) { t.Fatal("a graceful shutdown must not exit non-zero") }
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	dir := t.TempDir()
+	os.Args = []string{"app", "-store=file", "-data-dir=" + dir, "-snapshot-every=0", "-shutdown-timeout=5s"}
+
+	httpStart = func(ctx context.Context, _ string, s *svc.DeviceService, opts httpApp.Options, _ bool) error {
+		if opts.ShutdownTimeout != 5*time.Second {
+			t.Fatalf("shutdown timeout=%v", opts.ShutdownTimeout)
+		}
+		if _, err := s.CreateDevice(dflt, svc.CreateDeviceRequest{ID: "dev", Algorithm: domain.AlgEd25519}); err != nil {
+			t.Fatal(err)
+		}
+		self, _ := os.FindProcess(os.Getpid())
+		if err := self.Signal(os.Interrupt); err != nil {
+			t.Skipf("cannot signal self: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("SIGINT did not cancel the server context")
+		}
+		return nil
+	}
+	main()
+
+	// the repository was closed after the server returned: its final snapshot is on disk
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Fatalf("no snapshot after shutdown: %v", err)
 	}
 }
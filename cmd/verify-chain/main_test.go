@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/crypto"
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+	"github.com/oxygenesis/signature/internal/storage"
+)
+
+// dflt is the caller the tests act for.
+var dflt = service.Caller{Tenant: domain.DefaultTenant, Scopes: []service.Scope{service.ScopeAdmin}}
+
+type fixedID struct{}
+
+func (fixedID) New() string { return "id" }
+
+// export writes a device and its signature log the way the HTTP API returns them.
+func export(t *testing.T) (dir string, dev *domain.SignatureDevice, recs []domain.SignatureRecord) {
+	t.Helper()
+	svc := service.New(storage.NewMemory(), crypto.Default(), fixedID{})
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "d", Algorithm: domain.AlgECC, PayloadFormat: domain.PayloadV1})
+	_, _ = svc.SignBatch(dflt, "d", []string{"a", "b", "c"})
+	dev, _ = svc.GetDevice(dflt, "d")
+	recs, _ = svc.ListSignatures(dflt, "d", storage.AllSignatures)
+
+	dir = t.TempDir()
+	write := func(name string, v any) {
+		raw, _ := json.Marshal(v)
+		if err := os.WriteFile(filepath.Join(dir, name), raw, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("device.json", dev)
+	write("log.json", map[string]any{"signatures": recs})
+	return dir, dev, recs
+}
+
+func TestRun_IntactChain(t *testing.T) {
+	dir, _, _ := export(t)
+	var out, errOut bytes.Buffer
+	code := run([]string{"-device", filepath.Join(dir, "device.json"), "-log", filepath.Join(dir, "log.json")}, &out, &errOut)
+	if code != 0 || out.String() != "OK: 3 signatures, counters 0..2\n" {
+		t.Fatalf("code=%d out=%q err=%q", code, out.String(), errOut.String())
+	}
+}
+
+func TestRun_BareKeyFromStdin(t *testing.T) {
+	dir, dev, recs := export(t)
+	_ = os.WriteFile(filepath.Join(dir, "pub.pem"), []byte(dev.PublicKeyPEM), 0o600)
+	recs[1].Counter = 7
+	var lines bytes.Buffer
+	for _, r := range recs {
+		raw, _ := json.Marshal(r)
+		lines.Write(append(raw, '\n'))
+	}
+	orig := stdin
+	defer func() { stdin = orig }()
+	stdin = &lines
+
+	var out bytes.Buffer
+	code := run([]string{"-id", "d", "-scheme", string(dev.Scheme), "-format", "v1", "-key", filepath.Join(dir, "pub.pem")}, &out, &bytes.Buffer{})
+	if code != 1 || !strings.HasPrefix(out.String(), "BREAK at counter 7 (record #1): counter does not follow 0\n") || !strings.Contains(out.String(), "first at counter 7") {
+		t.Fatalf("code=%d out=%q", code, out.String())
+	}
+}
+
+func TestRun_BadInputs(t *testing.T) {
+	dir, _, _ := export(t)
+	for name, args := range map[string][]string{
+		"no key":       {"-id", "d", "-scheme", "Ed25519"},
+		"bad format":   {"-device", filepath.Join(dir, "device.json"), "-format", "v9"},
+		"no device":    {"-device", filepath.Join(dir, "missing.json")},
+		"missing log":  {"-device", filepath.Join(dir, "device.json"), "-log", filepath.Join(dir, "missing.json")},
+		"unknown flag": {"-nope"},
+	} {
+		if code := run(args, &bytes.Buffer{}, &bytes.Buffer{}); code != 2 {
+			t.Fatalf("%s: code=%d", name, code)
+		}
+	}
+}
+
+func TestMain_Exits(t *testing.T) {
+	origExit, origArgs := osExit, os.Args
+	defer func() { osExit, os.Args = origExit, origArgs }()
+	os.Args = []string{"verify-chain", "-id", "d"}
+	got := -1
+	osExit = func(c int) { got = c }
+	main()
+	if got != 2 {
+		t.Fatalf("exit code %d", got)
+	}
+}
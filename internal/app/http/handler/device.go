@@ -1,14 +1,16 @@
 package handler
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/service"
+	"github.com/oxygenesis/signature/internal/storage"
 )
 
 type Device struct{ svc *service.DeviceService }
@@ -23,6 +25,15 @@ func (h *Device) Health(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// Algorithms lists the signing algorithms the running server supports.
+func (h *Device) Algorithms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.svc.ListAlgorithms())
+}
+
 // Devices handles /v1/devices
 // - GET  -> List
 // - POST -> Create
@@ -37,56 +48,138 @@ func (h *Device) Devices(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// DeviceOps handles /v1/devices/{id} and /v1/devices/{id}/sign
+// DeviceOps handles /v1/devices/{id} and its sub-resources:
+// - POST /v1/devices/import
+// - GET  /v1/devices/{id}
+// - PATCH /v1/devices/{id}
+// - POST /v1/devices/{id}/sign
+// - POST /v1/devices/{id}/sign/batch
+// - POST /v1/devices/{id}/rotate
+// - POST /v1/devices/{id}/suspend | activate | decommission
+// - POST /v1/devices/{id}/verify
+// - POST /v1/devices/{id}/verify/batch
+// - GET  /v1/devices/{id}/signatures
 func (h *Device) DeviceOps(w http.ResponseWriter, r *http.Request) {
 	rest := strings.TrimPrefix(r.URL.Path, "/v1/devices/")
-	if rest == "" {
+	id, action, _ := strings.Cut(rest, "/")
+	if id == "" {
 		http.NotFound(w, r)
 		return
 	}
 
-	if strings.HasSuffix(rest, "/sign") && r.Method == http.MethodPost {
-		id := strings.TrimSuffix(rest, "/sign")
-		if id == "" || strings.Contains(id, "/") {
-			http.NotFound(w, r)
-			return
-		}
+	switch {
+	case id == "import" && action == "" && r.Method == http.MethodPost:
+		h.Import(w, r)
+	case action == "" && r.Method == http.MethodGet:
+		h.Get(w, r, id)
+	case action == "" && r.Method == http.MethodPatch:
+		h.Patch(w, r, id)
+	case action == "sign" && r.Method == http.MethodPost:
 		h.Sign(w, r, id)
+	case action == "sign/batch" && r.Method == http.MethodPost:
+		h.SignBatch(w, r, id)
+	case action == "rotate" && r.Method == http.MethodPost:
+		h.Rotate(w, r, id)
+	case action == "suspend" && r.Method == http.MethodPost:
+		h.SetStatus(w, r, id, domain.StatusSuspended)
+	case action == "activate" && r.Method == http.MethodPost:
+		h.SetStatus(w, r, id, domain.StatusActive)
+	case action == "decommission" && r.Method == http.MethodPost:
+		h.SetStatus(w, r, id, domain.StatusDecommissioned)
+	case action == "verify" && r.Method == http.MethodPost:
+		h.Verify(w, r, id)
+	case action == "verify/batch" && r.Method == http.MethodPost:
+		h.VerifyBatch(w, r, id)
+	case action == "signatures" && r.Method == http.MethodGet:
+		h.Signatures(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Device) Create(w http.ResponseWriter, r *http.Request) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	var req struct {
+		ID            string                        `json:"id"`
+		Algorithm     string                        `json:"algorithm"`
+		Label         string                        `json:"label"`
+		KeyParams     domain.KeyParams              `json:"key_params"`
+		Scheme        string                        `json:"scheme"`
+		PayloadFormat string                        `json:"payload_format"`
+		Tags          map[string]string             `json:"tags"`
+		ACL           map[string]domain.DeviceRight `json:"acl"`
+	}
+	if !decodeJSON(w, r, maxBodyBytes, &req) {
 		return
 	}
 
-	// GET /v1/devices/{id}
-	if r.Method == http.MethodGet && !strings.Contains(rest, "/") {
-		h.Get(w, r, rest)
+	dev, err := h.svc.CreateDevice(c, service.CreateDeviceRequest{
+		ID: req.ID, Algorithm: domain.Algorithm(req.Algorithm), Label: req.Label, KeyParams: req.KeyParams,
+		Scheme: domain.Scheme(req.Scheme), PayloadFormat: domain.PayloadFormat(req.PayloadFormat),
+		Tags: req.Tags, ACL: req.ACL,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrAlreadyExists):
+			writeErr(w, http.StatusConflict, err.Error())
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, domain.ErrInvalidInput), errors.Is(err, domain.ErrInvalidAlgorithm),
+			errors.Is(err, domain.ErrInvalidKeyParams), errors.Is(err, domain.ErrInvalidScheme),
+			errors.Is(err, domain.ErrInvalidPayloadFormat):
+			writeErr(w, http.StatusBadRequest, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
-	http.NotFound(w, r)
+	writeJSON(w, http.StatusCreated, dev)
 }
 
-func (h *Device) Create(w http.ResponseWriter, r *http.Request) {
+// Import creates a device around an existing private key, optionally
+// continuing a signature chain started elsewhere.
+func (h *Device) Import(w http.ResponseWriter, r *http.Request) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
 	defer r.Body.Close()
 	var req struct {
-		ID        string `json:"id"`
-		Algorithm string `json:"algorithm"`
-		Label     string `json:"label"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid JSON")
-		return
+		ID               string                        `json:"id"`
+		Algorithm        string                        `json:"algorithm"`
+		Label            string                        `json:"label"`
+		Scheme           string                        `json:"scheme"`
+		PayloadFormat    string                        `json:"payload_format"`
+		PrivateKeyPEM    string                        `json:"private_key_pem"`
+		SignatureCounter uint64                        `json:"signature_counter"`
+		LastSignatureB64 string                        `json:"last_signature_base64"`
+		ACL              map[string]domain.DeviceRight `json:"acl"`
 	}
-
-	if req.ID == "" {
-		writeErr(w, http.StatusBadRequest, "id is required")
+	if !decodeJSON(w, r, maxBodyBytes, &req) {
 		return
 	}
 
-	dev, err := h.svc.CreateDevice(req.ID, domain.Algorithm(req.Algorithm), req.Label)
+	dev, err := h.svc.ImportDevice(c, service.ImportDeviceRequest{
+		ID: req.ID, Algorithm: domain.Algorithm(req.Algorithm), Label: req.Label,
+		Scheme: domain.Scheme(req.Scheme), PayloadFormat: domain.PayloadFormat(req.PayloadFormat),
+		PrivateKeyPEM:    req.PrivateKeyPEM,
+		SignatureCounter: req.SignatureCounter, LastSignatureB64: req.LastSignatureB64,
+		ACL: req.ACL,
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, domain.ErrAlreadyExists):
 			writeErr(w, http.StatusConflict, err.Error())
-		case errors.Is(err, domain.ErrInvalidAlgorithm):
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, domain.ErrInvalidInput), errors.Is(err, domain.ErrInvalidAlgorithm),
+			errors.Is(err, domain.ErrInvalidKey), errors.Is(err, domain.ErrInvalidKeyParams),
+			errors.Is(err, domain.ErrInvalidScheme), errors.Is(err, domain.ErrInvalidPayloadFormat):
 			writeErr(w, http.StatusBadRequest, err.Error())
 		default:
 			writeErr(w, http.StatusInternalServerError, err.Error())
@@ -98,63 +191,450 @@ func (h *Device) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Device) Get(w http.ResponseWriter, r *http.Request, id string) {
-	dev, err := h.svc.GetDevice(id)
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	dev, err := h.svc.GetDevice(c, id)
 	if err != nil {
-		if errors.Is(err, domain.ErrNotFound) {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
 			http.NotFound(w, r)
-			return
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
 		}
-		writeErr(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	writeJSON(w, http.StatusOK, dev)
 }
 
-func (h *Device) List(w http.ResponseWriter, _ *http.Request) {
-	devs, err := h.svc.ListDevices()
+// Patch updates a device's label, tags and ACL:
+// {"label": "...", "tags": {"k": "v", "gone": null}, "acl": {"key:<id>": "sign", "jwt:gone": null}}.
+// Omitted fields, tags and principals are left as they are; null removes one.
+func (h *Device) Patch(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	var req struct {
+		Label *string                        `json:"label"`
+		Tags  map[string]*string             `json:"tags"`
+		ACL   map[string]*domain.DeviceRight `json:"acl"`
+	}
+	if !decodeJSON(w, r, maxBodyBytes, &req) {
+		return
+	}
+
+	dev, err := h.svc.UpdateDevice(c, id, service.DevicePatch{Label: req.Label, Tags: req.Tags, ACL: req.ACL})
 	if err != nil {
-		writeErr(w, http.StatusInternalServerError, err.Error())
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			http.NotFound(w, r)
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, domain.ErrInvalidInput):
+			writeErr(w, http.StatusBadRequest, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dev)
+}
+
+// List returns the devices matching the optional filters
+// ?algorithm=<alg>&label_prefix=<prefix>&tag=<key>:<value> (tag may repeat;
+// every tag must match), ordered by ID and paged with &limit=<n>&cursor=<next_cursor>.
+// next_cursor is set when more devices may follow.
+func (h *Device) List(w http.ResponseWriter, r *http.Request) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	f := storage.DeviceFilter{
+		Algorithm: domain.Algorithm(q.Get("algorithm")), LabelPrefix: q.Get("label_prefix"),
+		Limit: defaultPageLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 || f.Limit > maxPageLimit {
+			writeErr(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		after, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(after) == 0 {
+			writeErr(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		f.After = string(after)
+	}
+	for _, t := range q["tag"] {
+		k, v, ok := strings.Cut(t, ":")
+		if !ok || !domain.ValidTagKey(k) {
+			writeErr(w, http.StatusBadRequest, "invalid tag filter "+strconv.Quote(t)+", want key:value")
+			return
+		}
+		if f.Tags == nil {
+			f.Tags = make(map[string]string)
+		}
+		f.Tags[k] = v
+	}
+
+	devs, err := h.svc.ListDevices(c, f)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
-	writeJSON(w, http.StatusOK, devs)
+	out := map[string]any{"devices": devs}
+	if n := len(devs); n == f.Limit {
+		out["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(devs[n-1].ID))
+	}
+	writeJSON(w, http.StatusOK, out)
 }
 
 func (h *Device) Sign(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
 	defer r.Body.Close()
-	raw, _ := io.ReadAll(r.Body)
-
 	var req struct {
-		Data string `json:"data"`
+		Data            string  `json:"data"`
+		ExpectedCounter *uint64 `json:"expected_counter"`
 	}
-	if err := json.Unmarshal(raw, &req); err != nil {
-		writeErr(w, http.StatusBadRequest, "invalid JSON")
+	if !decodeJSON(w, r, maxBodyBytes, &req) {
 		return
 	}
 
 	// Let service validate empty data -> ErrInvalidInput => 400 (coverable)
-	res, err := h.svc.Sign(id, req.Data)
+	res, err := h.svc.SignWith(c, id, service.SignRequest{
+		Data: req.Data, IdempotencyKey: r.Header.Get("Idempotency-Key"), ExpectedCounter: req.ExpectedCounter,
+	})
 	if err != nil {
+		var mismatch *domain.CounterMismatchError
 		switch {
+		case errors.As(err, &mismatch):
+			writeJSON(w, http.StatusConflict, map[string]any{"error": err.Error(), "signature_counter": mismatch.Current})
 		case errors.Is(err, domain.ErrNotFound):
 			http.NotFound(w, r)
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
 		case errors.Is(err, domain.ErrInvalidInput):
 			writeErr(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, domain.ErrIdempotencyConflict), errors.Is(err, domain.ErrDeviceInactive):
+			writeErr(w, http.StatusConflict, err.Error())
 		default:
 			writeErr(w, http.StatusInternalServerError, err.Error())
 		}
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]any{
+	writeJSON(w, http.StatusOK, signatureJSON(*res))
+}
+
+func signatureJSON(res domain.SignatureResult) map[string]any {
+	return map[string]any{
 		"signature":   res.SignatureB64,
 		"signed_data": res.SignedData,
-	})
+		"scheme":      res.Scheme,
+		"key_id":      res.KeyID,
+	}
+}
+
+// SignBatch signs {"items": ["<data>", ...]} in order under consecutive
+// counters. Either every item is signed or, on any error, none is.
+func (h *Device) SignBatch(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	var req struct {
+		Items []string `json:"items"`
+	}
+	if !decodeJSON(w, r, maxBatchBodyBytes, &req) {
+		return
+	}
+	if len(req.Items) > maxBatchItems {
+		writeErr(w, http.StatusBadRequest, "items must hold 1.."+strconv.Itoa(maxBatchItems)+" entries")
+		return
+	}
+
+	results, err := h.svc.SignBatch(c, id, req.Items)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			http.NotFound(w, r)
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, domain.ErrInvalidInput):
+			writeErr(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, domain.ErrDeviceInactive):
+			writeErr(w, http.StatusConflict, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	out := make([]map[string]any, len(results))
+	for i, res := range results {
+		out[i] = signatureJSON(res)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"signatures": out})
+}
+
+// Rotate replaces the device's key and returns the device with its key history.
+func (h *Device) Rotate(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	dev, err := h.svc.RotateKey(c, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			http.NotFound(w, r)
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, domain.ErrDeviceInactive):
+			writeErr(w, http.StatusConflict, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dev)
+}
+
+// SetStatus moves the device to status and returns it. Leaving the
+// decommissioned state is a conflict. A decommission whose key is still on
+// disk is committed all the same and answered with 202.
+func (h *Device) SetStatus(w http.ResponseWriter, r *http.Request, id string, status domain.DeviceStatus) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	dev, err := h.svc.SetStatus(c, id, status)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrKeyRetained):
+			writeJSON(w, http.StatusAccepted, dev)
+		case errors.Is(err, domain.ErrNotFound):
+			http.NotFound(w, r)
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, domain.ErrInvalidTransition):
+			writeErr(w, http.StatusConflict, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dev)
+}
+
+// verifyItem is one signature in a verify request.
+type verifyItem struct {
+	SignedData string `json:"signed_data"`
+	Signature  string `json:"signature"`
+	KeyID      string `json:"key_id"`
+}
+
+func (it verifyItem) request() service.VerifyRequest {
+	return service.VerifyRequest{SignedData: it.SignedData, SignatureB64: it.Signature, KeyID: it.KeyID}
+}
+
+func verificationJSON(res domain.VerificationResult) map[string]any {
+	out := map[string]any{
+		"valid":     res.Valid,
+		"algorithm": res.Algorithm,
+		"scheme":    res.Scheme,
+		"key_id":    res.KeyID,
+	}
+	if res.Err != nil {
+		out["error"] = res.Err.Error()
+	}
+	return out
+}
+
+// Verify checks one signature: {"signed_data", "signature", "key_id" (optional)}.
+// An invalid signature is a 200 with "valid": false.
+func (h *Device) Verify(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	var req verifyItem
+	if !decodeJSON(w, r, maxBodyBytes, &req) {
+		return
+	}
+
+	res, err := h.svc.Verify(c, id, req.request())
+	if err != nil {
+		writeVerifyErr(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, verificationJSON(*res))
+}
+
+// VerifyBatch checks up to maxBatchItems signatures: {"items": [...]}.
+// Results come back in request order; malformed items carry an "error".
+func (h *Device) VerifyBatch(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	var req struct {
+		Items []verifyItem `json:"items"`
+	}
+	if !decodeJSON(w, r, maxBatchBodyBytes, &req) {
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBatchItems {
+		writeErr(w, http.StatusBadRequest, "items must hold 1.."+strconv.Itoa(maxBatchItems)+" entries")
+		return
+	}
+
+	reqs := make([]service.VerifyRequest, len(req.Items))
+	for i, it := range req.Items {
+		reqs[i] = it.request()
+	}
+	results, err := h.svc.VerifyBatch(c, id, reqs)
+	if err != nil {
+		writeVerifyErr(w, r, err)
+		return
+	}
+
+	out := make([]map[string]any, len(results))
+	for i, res := range results {
+		out[i] = verificationJSON(res)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": out})
+}
+
+func writeVerifyErr(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, domain.ErrNotFound):
+		http.NotFound(w, r)
+	case errors.Is(err, domain.ErrForbidden):
+		writeErr(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, domain.ErrInvalidInput), errors.Is(err, domain.ErrInvalidKey),
+		errors.Is(err, domain.ErrInvalidScheme), errors.Is(err, domain.ErrInvalidAlgorithm):
+		writeErr(w, http.StatusBadRequest, err.Error())
+	default:
+		writeErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	maxBatchItems    = 1000
+	// request bodies beyond these are refused with 413 before they are read
+	maxBodyBytes      = 1 << 20
+	maxBatchBodyBytes = 16 << 20
+)
+
+// Signatures returns a device's signature journal, paged by counter:
+// ?from=<counter>&to=<counter>&limit=<n>. next_from is set when more records may follow.
+func (h *Device) Signatures(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	sr := storage.AllSignatures
+	sr.Limit = defaultPageLimit
+	var err error
+	if v := q.Get("from"); v != "" {
+		if sr.From, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid from")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if sr.To, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid to")
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if sr.Limit, err = strconv.Atoi(v); err != nil || sr.Limit < 1 || sr.Limit > maxPageLimit {
+			writeErr(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	recs, err := h.svc.ListSignatures(c, id, sr)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			http.NotFound(w, r)
+		case errors.Is(err, domain.ErrForbidden):
+			writeErr(w, http.StatusForbidden, err.Error())
+		default:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	out := map[string]any{"signatures": recs}
+	if n := len(recs); n == sr.Limit && recs[n-1].Counter < sr.To {
+		out["next_from"] = recs[n-1].Counter + 1
+	}
+	writeJSON(w, http.StatusOK, out)
 }
 
 // helpers
 
+// caller returns who the request acts for, as established by the tenant or
+// auth middleware. Without a caller the request is refused rather than
+// served unscoped. What the caller may do is checked by the service, which
+// knows the device's ACL; its ErrForbidden becomes a 403.
+func caller(w http.ResponseWriter, r *http.Request) (service.Caller, bool) {
+	c, ok := service.CallerFrom(r.Context())
+	if !ok {
+		writeErr(w, http.StatusUnauthorized, "no tenant")
+	}
+	return c, ok
+}
+
+// decodeJSON reads r's body into v, reading at most limit bytes. It answers
+// 413 for a larger body and 400 for one that is not JSON, and then reports false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		writeErr(w, http.StatusRequestEntityTooLarge, "request body exceeds "+strconv.FormatInt(limit, 10)+" bytes")
+	default:
+		writeErr(w, http.StatusBadRequest, "invalid JSON")
+	}
+	return false
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("content-type", "application/json")
 	w.WriteHeader(status)
@@ -2,17 +2,27 @@ package handler_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/oxygenesis/signature/internal/app/http/handler"
+	"github.com/oxygenesis/signature/internal/crypto"
 	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/service"
 	"github.com/oxygenesis/signature/internal/storage"
+	"github.com/oxygenesis/signature/pkg/id"
 )
 
 // fakes
@@ -23,29 +33,54 @@ func (fakeSigner) Verify(p, s []byte) bool       { return true }
 func (fakeSigner) PublicPEM() string             { return "PEM" }
 func (fakeSigner) AlgorithmName() string         { return "RSA" }
 
-type fakeFactory struct{}
+var fakeAlgs = crypto.NewRegistry(
+	domain.AlgorithmSpec{Name: domain.AlgRSA, DefaultKey: domain.KeyParams{Bits: 2048},
+		Schemes: []domain.Scheme{domain.SchemeRSAPKCS1v15SHA256, domain.SchemeRSAPSSSHA256}, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return fakeSigner{}, nil }},
+	domain.AlgorithmSpec{Name: domain.AlgECC, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return fakeSigner{}, nil }},
+	domain.AlgorithmSpec{Name: domain.AlgEd25519, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return fakeSigner{}, nil }},
+)
 
-func (fakeFactory) NewRSA(int) (domain.Signer, error) { return fakeSigner{}, nil }
-func (fakeFactory) NewECDSA() (domain.Signer, error)  { return fakeSigner{}, nil }
+// dflt is the caller the tests' direct service calls act for.
+var dflt = service.Caller{Tenant: domain.DefaultTenant, Scopes: []service.Scope{service.ScopeAdmin}}
 
-type errCreateRepo struct{ storage.Memory }
+type errCreateRepo struct{ *storage.Memory }
 
 func (errCreateRepo) Create(*domain.SignatureDevice, domain.Signer) error {
 	return errors.New("db down")
 }
 
-type errListRepo struct{ storage.Memory }
+type errListRepo struct{ *storage.Memory }
 
-func (errListRepo) List() ([]*domain.SignatureDevice, error) { return nil, errors.New("boom") }
+func (errListRepo) List(string, storage.DeviceFilter) ([]*domain.SignatureDevice, error) {
+	return nil, errors.New("boom")
+}
 
-type errUpdateRepo struct{ storage.Memory }
+type errUpdateRepo struct{ *storage.Memory }
 
-func (errUpdateRepo) Update(string, func(*domain.SignatureDevice, domain.Signer) error) error {
+func (errUpdateRepo) Update(string, string, func(storage.Tx) error) error {
 	return errors.New("update fail")
 }
 
-func rrDo(h http.HandlerFunc, method, path string, body io.Reader) *httptest.ResponseRecorder {
+// retainRepo commits every update but reports the destroyed key as still on
+// disk, like a file store whose snapshot failed.
+type retainRepo struct{ *storage.Memory }
+
+func (r retainRepo) Update(tenant, id string, fn func(storage.Tx) error) error {
+	if err := r.Memory.Update(tenant, id, fn); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: snapshot failed", storage.ErrKeyRetained)
+}
+
+// newReq builds a request scoped to the default tenant, as the tenant
+// middleware would.
+func newReq(method, path string, body io.Reader) *http.Request {
 	req := httptest.NewRequest(method, path, body)
+	return req.WithContext(service.WithCaller(req.Context(), dflt))
+}
+
+func rrDo(h http.HandlerFunc, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	req := newReq(method, path, body)
 	if body != nil {
 		req.Header.Set("content-type", "application/json")
 	}
@@ -55,7 +90,7 @@ func rrDo(h http.HandlerFunc, method, path string, body io.Reader) *httptest.Res
 }
 
 func Test_Health_Dispatch(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
 	hd := handler.NewDevice(svc)
 
 	if rr := rrDo(hd.Health, http.MethodGet, "/v1/health", nil); rr.Code != http.StatusOK {
@@ -67,7 +102,7 @@ func Test_Health_Dispatch(t *testing.T) {
 }
 
 func Test_Devices_Create_List_And_Methods(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
 	hd := handler.NewDevice(svc)
 
 	// create: missing id -> 400
@@ -86,7 +121,7 @@ func Test_Devices_Create_List_And_Methods(t *testing.T) {
 
 func Test_Create_Variants(t *testing.T) {
 	// invalid JSON
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
 	hd := handler.NewDevice(svc)
 	if rr := rrDo(hd.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte("{"))); rr.Code != http.StatusBadRequest {
 		t.Fatalf("invalid JSON=%d", rr.Code)
@@ -96,21 +131,47 @@ func Test_Create_Variants(t *testing.T) {
 		t.Fatalf("invalid algo=%d", rr.Code)
 	}
 	// repo error -> 500
-	svc2 := service.New(&errCreateRepo{}, fakeFactory{}, nil)
+	svc2 := service.New(&errCreateRepo{}, fakeAlgs, nil)
 	hd2 := handler.NewDevice(svc2)
 	if rr := rrDo(hd2.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"x","algorithm":"RSA"}`))); rr.Code != http.StatusInternalServerError {
 		t.Fatalf("repo err=%d", rr.Code)
 	}
 	// happy path -> 201
-	svc3 := service.New(storage.NewMemory(), fakeFactory{}, nil)
+	svc3 := service.New(storage.NewMemory(), fakeAlgs, nil)
 	hd3 := handler.NewDevice(svc3)
 	if rr := rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-1","algorithm":"RSA","label":"L"}`))); rr.Code != http.StatusCreated {
 		t.Fatalf("create ok=%d", rr.Code)
 	}
+	if rr := rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-2","algorithm":"ED25519"}`))); rr.Code != http.StatusCreated {
+		t.Fatalf("create ed25519=%d", rr.Code)
+	}
+	// scheme selection; unsupported schemes -> 400
+	rr := rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-pss","algorithm":"RSA","scheme":"RSA-PSS-SHA256"}`)))
+	if rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"scheme":"RSA-PSS-SHA256"`) {
+		t.Fatalf("create pss=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-md5","algorithm":"RSA","scheme":"RSA-MD5"}`))); rr.Code != http.StatusBadRequest {
+		t.Fatalf("create bad scheme=%d", rr.Code)
+	}
+	// key parameters outside the allow-list -> 400
+	if rr := rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-3","algorithm":"RSA","key_params":{"bits":1024}}`))); rr.Code != http.StatusBadRequest {
+		t.Fatalf("create bad key params=%d", rr.Code)
+	}
+	// payload format: default v0, v1 on request, unknown -> 400
+	if !strings.Contains(rr.Body.String(), `"payload_format":"v0"`) {
+		t.Fatalf("default payload format: %s", rr.Body.String())
+	}
+	rr = rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-v1","algorithm":"RSA","payload_format":"v1"}`)))
+	if rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"payload_format":"v1"`) {
+		t.Fatalf("create v1=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := rrDo(hd3.Create, http.MethodPost, "/v1/devices", bytes.NewReader([]byte(`{"id":"dev-v9","algorithm":"RSA","payload_format":"v9"}`))); rr.Code != http.StatusBadRequest {
+		t.Fatalf("create bad payload format=%d", rr.Code)
+	}
 }
 
 func Test_List_RepoError_500(t *testing.T) {
-	svc := service.New(&errListRepo{}, fakeFactory{}, nil)
+	svc := service.New(&errListRepo{}, fakeAlgs, nil)
 	hd := handler.NewDevice(svc)
 	if rr := rrDo(hd.List, http.MethodGet, "/v1/devices", nil); rr.Code != http.StatusInternalServerError {
 		t.Fatalf("list repo err=%d", rr.Code)
@@ -119,13 +180,13 @@ func Test_List_RepoError_500(t *testing.T) {
 
 func Test_Get_NotFound_Then_OK(t *testing.T) {
 	mem := storage.NewMemory()
-	svc := service.New(mem, fakeFactory{}, nil)
+	svc := service.New(mem, fakeAlgs, nil)
 	hd := handler.NewDevice(svc)
 
 	if rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Get(w, r, "missing") }, http.MethodGet, "/v1/devices/missing", nil); rr.Code != http.StatusNotFound {
 		t.Fatalf("get missing=%d", rr.Code)
 	}
-	_, _ = svc.CreateDevice("dev-1", domain.AlgRSA, "")
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-1", Algorithm: domain.AlgRSA})
 	if rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Get(w, r, "dev-1") }, http.MethodGet, "/v1/devices/dev-1", nil); rr.Code != http.StatusOK {
 		t.Fatalf("get ok=%d", rr.Code)
 	}
@@ -133,7 +194,7 @@ func Test_Get_NotFound_Then_OK(t *testing.T) {
 
 func Test_Sign_Flows(t *testing.T) {
 	mem := storage.NewMemory()
-	svc := service.New(mem, fakeFactory{}, nil)
+	svc := service.New(mem, fakeAlgs, nil)
 	hd := handler.NewDevice(svc)
 
 	// invalid JSON
@@ -141,26 +202,34 @@ func Test_Sign_Flows(t *testing.T) {
 		t.Fatalf("sign invalid json=%d", rr.Code)
 	}
 	// create device
-	_, _ = svc.CreateDevice("dev-1", domain.AlgRSA, "")
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-1", Algorithm: domain.AlgRSA})
 	// empty data -> 400 (ErrInvalidInput)
 	empty, _ := json.Marshal(map[string]any{"data": ""})
 	if rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Sign(w, r, "dev-1") }, http.MethodPost, "/v1/devices/dev-1/sign", bytes.NewReader(empty)); rr.Code != http.StatusBadRequest {
 		t.Fatalf("sign empty=%d", rr.Code)
 	}
-	// ok
+	// ok, the response names the scheme
 	ok, _ := json.Marshal(map[string]any{"data": "hello"})
-	if rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Sign(w, r, "dev-1") }, http.MethodPost, "/v1/devices/dev-1/sign", bytes.NewReader(ok)); rr.Code != http.StatusOK {
+	rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Sign(w, r, "dev-1") }, http.MethodPost, "/v1/devices/dev-1/sign", bytes.NewReader(ok))
+	if rr.Code != http.StatusOK {
 		t.Fatalf("sign ok=%d", rr.Code)
 	}
+	var res struct {
+		Scheme string `json:"scheme"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &res)
+	if res.Scheme != string(domain.SchemeRSAPKCS1v15SHA256) {
+		t.Fatalf("sign scheme=%q", res.Scheme)
+	}
 }
 
 func Test_DeviceOps_Fallthroughs_And_WrongMethods(t *testing.T) {
 	mem := storage.NewMemory()
-	s := service.New(mem, fakeFactory{}, nil)
+	s := service.New(mem, fakeAlgs, nil)
 	hd := handler.NewDevice(s)
 
 	// rest == ""  -> 404
-	req := httptest.NewRequest(http.MethodGet, "/v1/devices/", nil)
+	req := newReq(http.MethodGet, "/v1/devices/", nil)
 	rr := httptest.NewRecorder()
 	hd.DeviceOps(rr, req)
 	if rr.Code != http.StatusNotFound {
@@ -168,7 +237,7 @@ func Test_DeviceOps_Fallthroughs_And_WrongMethods(t *testing.T) {
 	}
 
 	// "/sign" but empty id -> 404
-	req = httptest.NewRequest(http.MethodPost, "/v1/devices//sign", bytes.NewReader([]byte(`{"data":"hi"}`)))
+	req = newReq(http.MethodPost, "/v1/devices//sign", bytes.NewReader([]byte(`{"data":"hi"}`)))
 	req.Header.Set("content-type", "application/json")
 	rr = httptest.NewRecorder()
 	hd.DeviceOps(rr, req)
@@ -177,7 +246,7 @@ func Test_DeviceOps_Fallthroughs_And_WrongMethods(t *testing.T) {
 	}
 
 	// "/sign" with GET (wrong method) -> final 404
-	req = httptest.NewRequest(http.MethodGet, "/v1/devices/dev-1/sign", nil)
+	req = newReq(http.MethodGet, "/v1/devices/dev-1/sign", nil)
 	rr = httptest.NewRecorder()
 	hd.DeviceOps(rr, req)
 	if rr.Code != http.StatusNotFound {
@@ -185,7 +254,7 @@ func Test_DeviceOps_Fallthroughs_And_WrongMethods(t *testing.T) {
 	}
 
 	// GET /v1/devices/dev-1/extra -> final 404 (contains slash)
-	req = httptest.NewRequest(http.MethodGet, "/v1/devices/dev-1/extra", nil)
+	req = newReq(http.MethodGet, "/v1/devices/dev-1/extra", nil)
 	rr = httptest.NewRecorder()
 	hd.DeviceOps(rr, req)
 	if rr.Code != http.StatusNotFound {
@@ -195,7 +264,7 @@ func Test_DeviceOps_Fallthroughs_And_WrongMethods(t *testing.T) {
 
 func Test_Sign_NotFound_404(t *testing.T) {
 	mem := storage.NewMemory()
-	s := service.New(mem, fakeFactory{}, nil)
+	s := service.New(mem, fakeAlgs, nil)
 	hd := handler.NewDevice(s)
 
 	body, _ := json.Marshal(map[string]any{"data": "hello"})
@@ -208,7 +277,7 @@ func Test_Sign_NotFound_404(t *testing.T) {
 
 func Test_Create_AlreadyExists_409(t *testing.T) {
 	mem := storage.NewMemory()
-	s := service.New(mem, fakeFactory{}, nil)
+	s := service.New(mem, fakeAlgs, nil)
 	hd := handler.NewDevice(s)
 
 	// first create OK
@@ -223,14 +292,14 @@ func Test_Create_AlreadyExists_409(t *testing.T) {
 	}
 }
 
-type errGetRepo struct{ storage.Memory }
+type errGetRepo struct{ *storage.Memory }
 
-func (errGetRepo) Get(string) (*domain.SignatureDevice, domain.Signer, error) {
+func (errGetRepo) Get(string, string) (*domain.SignatureDevice, domain.Signer, error) {
 	return nil, nil, errors.New("db oops")
 }
 
 func Test_Get_InternalError_500(t *testing.T) {
-	s := service.New(&errGetRepo{}, fakeFactory{}, nil)
+	s := service.New(&errGetRepo{}, fakeAlgs, nil)
 	hd := handler.NewDevice(s)
 	rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Get(w, r, "any") },
 		http.MethodGet, "/v1/devices/any", nil)
@@ -241,7 +310,7 @@ func Test_Get_InternalError_500(t *testing.T) {
 
 // helper
 func rr(method, path string, body []byte, h http.HandlerFunc) *httptest.ResponseRecorder {
-	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req := newReq(method, path, bytes.NewReader(body))
 	if body != nil {
 		req.Header.Set("content-type", "application/json")
 	}
@@ -253,9 +322,9 @@ func rr(method, path string, body []byte, h http.HandlerFunc) *httptest.Response
 // --- 1) SIGN default branch (500) ---
 func Test_Sign_Default_InternalError_500(t *testing.T) {
 	mem := storage.NewMemory()
-	svc := service.New(&errUpdateRepo{*mem}, fakeFactory{}, nil)
+	svc := service.New(&errUpdateRepo{mem}, fakeAlgs, nil)
 	// device must exist so Sign tries Update and gets our error
-	if _, err := svc.CreateDevice("dev-x", domain.AlgRSA, ""); err != nil {
+	if _, err := svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-x", Algorithm: domain.AlgRSA}); err != nil {
 		t.Fatal(err)
 	}
 	hd := handler.NewDevice(svc)
@@ -272,12 +341,12 @@ func Test_Sign_Default_InternalError_500(t *testing.T) {
 // --- 2) DEVICEOPS: cover the `h.Sign(...); return` branch ---
 func Test_DeviceOps_SignBranch_ReturnCovered(t *testing.T) {
 	mem := storage.NewMemory()
-	svc := service.New(mem, fakeFactory{}, nil)
-	_, _ = svc.CreateDevice("dev-ok", domain.AlgRSA, "")
+	svc := service.New(mem, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-ok", Algorithm: domain.AlgRSA})
 	hd := handler.NewDevice(svc)
 
 	b, _ := json.Marshal(map[string]any{"data": "hello"})
-	req := httptest.NewRequest(http.MethodPost, "/v1/devices/dev-ok/sign", bytes.NewReader(b))
+	req := newReq(http.MethodPost, "/v1/devices/dev-ok/sign", bytes.NewReader(b))
 	req.Header.Set("content-type", "application/json")
 	rr := httptest.NewRecorder()
 	hd.DeviceOps(rr, req)
@@ -290,11 +359,11 @@ func Test_DeviceOps_SignBranch_ReturnCovered(t *testing.T) {
 // --- 3) DEVICEOPS: cover the `h.Get(...); return` branch ---
 func Test_DeviceOps_GetBranch_ReturnCovered(t *testing.T) {
 	mem := storage.NewMemory()
-	svc := service.New(mem, fakeFactory{}, nil)
-	_, _ = svc.CreateDevice("dev-get", domain.AlgRSA, "")
+	svc := service.New(mem, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-get", Algorithm: domain.AlgRSA})
 	hd := handler.NewDevice(svc)
 
-	req := httptest.NewRequest(http.MethodGet, "/v1/devices/dev-get", nil)
+	req := newReq(http.MethodGet, "/v1/devices/dev-get", nil)
 	rr := httptest.NewRecorder()
 	hd.DeviceOps(rr, req)
 	if rr.Code != http.StatusOK {
@@ -302,3 +371,514 @@ func Test_DeviceOps_GetBranch_ReturnCovered(t *testing.T) {
 	}
 	// executing through this path covers the `h.Get(...); return` line
 }
+
+func Test_Signatures_Paging(t *testing.T) {
+	mem := storage.NewMemory()
+	svc := service.New(mem, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-1", Algorithm: domain.AlgRSA})
+	for i := 0; i < 3; i++ {
+		_, _ = svc.Sign(dflt, "dev-1", "hello")
+	}
+	hd := handler.NewDevice(svc)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := newReq(http.MethodGet, path, nil)
+		rr := httptest.NewRecorder()
+		hd.DeviceOps(rr, req)
+		return rr
+	}
+
+	rr := get("/v1/devices/dev-1/signatures?limit=2")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d", rr.Code)
+	}
+	var page struct {
+		Signatures []domain.SignatureRecord `json:"signatures"`
+		NextFrom   *uint64                  `json:"next_from"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &page)
+	if len(page.Signatures) != 2 || page.NextFrom == nil || *page.NextFrom != 2 {
+		t.Fatalf("first page=%s", rr.Body.String())
+	}
+
+	rr = get("/v1/devices/dev-1/signatures?from=2&limit=2")
+	page.NextFrom = nil
+	_ = json.Unmarshal(rr.Body.Bytes(), &page)
+	if len(page.Signatures) != 1 || page.Signatures[0].Counter != 2 || page.NextFrom != nil {
+		t.Fatalf("last page=%s", rr.Body.String())
+	}
+
+	rr = get("/v1/devices/dev-1/signatures?from=0&to=0")
+	_ = json.Unmarshal(rr.Body.Bytes(), &page)
+	if len(page.Signatures) != 1 {
+		t.Fatalf("range page=%s", rr.Body.String())
+	}
+
+	for _, q := range []string{"from=x", "to=-1", "limit=0", "limit=1001", "limit=x"} {
+		if rr := get("/v1/devices/dev-1/signatures?" + q); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s status=%d", q, rr.Code)
+		}
+	}
+	if rr := get("/v1/devices/missing/signatures"); rr.Code != http.StatusNotFound {
+		t.Fatalf("missing status=%d", rr.Code)
+	}
+}
+
+type errSignaturesRepo struct{ *storage.Memory }
+
+func (errSignaturesRepo) Signatures(string, string, storage.SignatureRange) ([]domain.SignatureRecord, error) {
+	return nil, errors.New("db oops")
+}
+
+func Test_Signatures_InternalError_500(t *testing.T) {
+	hd := handler.NewDevice(service.New(&errSignaturesRepo{}, fakeAlgs, nil))
+	rr := rrDo(func(w http.ResponseWriter, r *http.Request) { hd.Signatures(w, r, "any") },
+		http.MethodGet, "/v1/devices/any/signatures", nil)
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status=%d", rr.Code)
+	}
+}
+
+func Test_Algorithms(t *testing.T) {
+	hd := handler.NewDevice(service.New(storage.NewMemory(), crypto.Default(), nil))
+	rr := rrDo(hd.Algorithms, http.MethodGet, "/v1/algorithms", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d", rr.Code)
+	}
+	var got []map[string]any
+	_ = json.Unmarshal(rr.Body.Bytes(), &got)
+	if len(got) != 3 || got[2]["name"] != "ED25519" || got[0]["allowed_key_params"] == nil {
+		t.Fatalf("body=%s", rr.Body.String())
+	}
+	if rr := rrDo(hd.Algorithms, http.MethodPost, "/v1/algorithms", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("POST status=%d", rr.Code)
+	}
+}
+
+func Test_Import(t *testing.T) {
+	svc := service.New(storage.NewMemory(), crypto.Default(), nil)
+	hd := handler.NewDevice(svc)
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(k)
+	key := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	body, _ := json.Marshal(map[string]any{
+		"id": "m", "algorithm": "ECC", "private_key_pem": key,
+		"signature_counter": 7, "last_signature_base64": "cHJldg==",
+	})
+	rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/import", bytes.NewReader(body))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("import=%d %s", rr.Code, rr.Body.String())
+	}
+	var dev domain.SignatureDevice
+	_ = json.Unmarshal(rr.Body.Bytes(), &dev)
+	if dev.SignatureCounter != 7 || dev.KeyParams.Curve != "P-256" || strings.Contains(rr.Body.String(), "PRIVATE") {
+		t.Fatalf("import body=%s", rr.Body.String())
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/import", bytes.NewReader(body)); rr.Code != http.StatusConflict {
+		t.Fatalf("import twice=%d", rr.Code)
+	}
+
+	for name, b := range map[string]string{
+		"invalid json": "{",
+		"bad key":      `{"id":"x","algorithm":"ECC","private_key_pem":"nope"}`,
+		"wrong alg":    `{"id":"x","algorithm":"RSA","private_key_pem":` + strconv.Quote(key) + `}`,
+		"no head":      `{"id":"x","algorithm":"ECC","signature_counter":2,"private_key_pem":` + strconv.Quote(key) + `}`,
+	} {
+		if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/import", bytes.NewReader([]byte(b))); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s=%d", name, rr.Code)
+		}
+	}
+	// storage failures -> 500
+	hd2 := handler.NewDevice(service.New(&errCreateRepo{}, crypto.Default(), nil))
+	body, _ = json.Marshal(map[string]any{"id": "n", "algorithm": "ECC", "private_key_pem": key})
+	if rr := rrDo(hd2.DeviceOps, http.MethodPost, "/v1/devices/import", bytes.NewReader(body)); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("repo err=%d", rr.Code)
+	}
+}
+
+func Test_Rotate(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-r", Algorithm: domain.AlgRSA})
+
+	rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-r/rotate", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rotate=%d", rr.Code)
+	}
+	var dev domain.SignatureDevice
+	_ = json.Unmarshal(rr.Body.Bytes(), &dev)
+	if len(dev.Keys) != 2 || dev.Keys[1].ID != "k2" {
+		t.Fatalf("rotate body=%s", rr.Body.String())
+	}
+	b, _ := json.Marshal(map[string]any{"data": "hello"})
+	rr = rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-r/sign", bytes.NewReader(b))
+	var res struct {
+		KeyID string `json:"key_id"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &res)
+	if res.KeyID != "k2" {
+		t.Fatalf("sign key_id=%q", res.KeyID)
+	}
+
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/missing/rotate", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("rotate missing=%d", rr.Code)
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodGet, "/v1/devices/dev-r/rotate", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("rotate wrong method=%d", rr.Code)
+	}
+	mem := storage.NewMemory()
+	svc2 := service.New(&errUpdateRepo{mem}, fakeAlgs, nil)
+	_, _ = svc2.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-x", Algorithm: domain.AlgRSA})
+	if rr := rrDo(handler.NewDevice(svc2).DeviceOps, http.MethodPost, "/v1/devices/dev-x/rotate", nil); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("rotate repo err=%d", rr.Code)
+	}
+}
+
+func Test_Verify(t *testing.T) {
+	svc := service.New(storage.NewMemory(), crypto.Default(), nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-v", Algorithm: domain.AlgECC})
+	sig, _ := svc.Sign(dflt, "dev-v", "hello")
+
+	body, _ := json.Marshal(map[string]any{"signed_data": sig.SignedData, "signature": sig.SignatureB64})
+	rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-v/verify", bytes.NewReader(body))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"valid":true`) || !strings.Contains(rr.Body.String(), `"key_id":"k1"`) {
+		t.Fatalf("verify=%d %s", rr.Code, rr.Body.String())
+	}
+	body, _ = json.Marshal(map[string]any{"signed_data": "tampered", "signature": sig.SignatureB64})
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-v/verify", bytes.NewReader(body)); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"valid":false`) {
+		t.Fatalf("verify tampered=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-v/verify", bytes.NewReader([]byte(`{"signed_data":"x","signature":"%%"}`))); rr.Code != http.StatusBadRequest {
+		t.Fatalf("verify bad base64=%d", rr.Code)
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/missing/verify", bytes.NewReader([]byte(`{"signed_data":"x","signature":"eA=="}`))); rr.Code != http.StatusNotFound {
+		t.Fatalf("verify missing=%d", rr.Code)
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-v/verify", bytes.NewReader([]byte("{"))); rr.Code != http.StatusBadRequest {
+		t.Fatalf("verify invalid json=%d", rr.Code)
+	}
+	hd2 := handler.NewDevice(service.New(&errGetRepo{}, fakeAlgs, nil))
+	if rr := rrDo(hd2.DeviceOps, http.MethodPost, "/v1/devices/x/verify", bytes.NewReader([]byte(`{"signed_data":"x","signature":"eA=="}`))); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("verify repo err=%d", rr.Code)
+	}
+
+	// batch: results in request order, malformed items flagged individually
+	body, _ = json.Marshal(map[string]any{"items": []map[string]any{
+		{"signed_data": sig.SignedData, "signature": sig.SignatureB64},
+		{"signed_data": "tampered", "signature": sig.SignatureB64},
+		{"signed_data": "x", "signature": "%%"},
+	}})
+	rr = rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-v/verify/batch", bytes.NewReader(body))
+	var out struct {
+		Results []struct {
+			Valid bool   `json:"valid"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &out)
+	if rr.Code != http.StatusOK || len(out.Results) != 3 || !out.Results[0].Valid || out.Results[1].Valid || out.Results[2].Error == "" {
+		t.Fatalf("batch=%d %s", rr.Code, rr.Body.String())
+	}
+	for name, b := range map[string]string{"invalid json": "{", "empty": `{"items":[]}`} {
+		if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-v/verify/batch", bytes.NewReader([]byte(b))); rr.Code != http.StatusBadRequest {
+			t.Fatalf("batch %s=%d", name, rr.Code)
+		}
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/missing/verify/batch", bytes.NewReader(body)); rr.Code != http.StatusNotFound {
+		t.Fatalf("batch missing=%d", rr.Code)
+	}
+}
+
+func Test_SignBatch(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-b", Algorithm: domain.AlgRSA})
+
+	rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-b/sign/batch", bytes.NewReader([]byte(`{"items":["a","b"]}`)))
+	var out struct {
+		Signatures []struct {
+			SignedData string `json:"signed_data"`
+		} `json:"signatures"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &out)
+	if rr.Code != http.StatusOK || len(out.Signatures) != 2 || !strings.HasPrefix(out.Signatures[1].SignedData, "1_b_") {
+		t.Fatalf("batch=%d %s", rr.Code, rr.Body.String())
+	}
+
+	tooMany, _ := json.Marshal(map[string]any{"items": make([]string, 1001)})
+	for name, b := range map[string][]byte{
+		"invalid json": []byte("{"),
+		"empty":        []byte(`{"items":[]}`),
+		"blank item":   []byte(`{"items":["a",""]}`),
+		"too many":     tooMany,
+	} {
+		if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-b/sign/batch", bytes.NewReader(b)); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s=%d", name, rr.Code)
+		}
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/missing/sign/batch", bytes.NewReader([]byte(`{"items":["a"]}`))); rr.Code != http.StatusNotFound {
+		t.Fatalf("missing=%d", rr.Code)
+	}
+	svc2 := service.New(&errUpdateRepo{storage.NewMemory()}, fakeAlgs, nil)
+	_, _ = svc2.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-x", Algorithm: domain.AlgRSA})
+	if rr := rrDo(handler.NewDevice(svc2).DeviceOps, http.MethodPost, "/v1/devices/dev-x/sign/batch", bytes.NewReader([]byte(`{"items":["a"]}`))); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("repo err=%d", rr.Code)
+	}
+}
+
+func Test_OversizedBodies_413(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-big", Algorithm: domain.AlgRSA})
+	huge := func(n int) io.Reader {
+		return strings.NewReader(`{"data":"` + strings.Repeat("x", n) + `","items":["` + strings.Repeat("x", n) + `"]}`)
+	}
+	for _, tc := range []struct {
+		h      http.HandlerFunc
+		method string
+		path   string
+	}{
+		{hd.Devices, http.MethodPost, "/v1/devices"},
+		{hd.DeviceOps, http.MethodPatch, "/v1/devices/dev-big"},
+		{hd.DeviceOps, http.MethodPost, "/v1/devices/dev-big/sign"},
+		{hd.DeviceOps, http.MethodPost, "/v1/devices/dev-big/sign/batch"},
+	} {
+		if rr := rrDo(tc.h, tc.method, tc.path, huge(16<<20)); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s %s=%d", tc.method, tc.path, rr.Code)
+		}
+	}
+	// a batch may be larger than a single request
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-big/sign/batch", strings.NewReader(`{"items":["`+strings.Repeat("x", 2<<20)+`"]}`)); rr.Code != http.StatusOK {
+		t.Fatalf("2 MiB batch=%d", rr.Code)
+	}
+	if d, _ := svc.GetDevice(dflt, "dev-big"); d.SignatureCounter != 1 {
+		t.Fatalf("counter=%d", d.SignatureCounter)
+	}
+}
+
+func Test_Sign_IdempotencyKey(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-i", Algorithm: domain.AlgRSA})
+
+	sign := func(key, body string) *httptest.ResponseRecorder {
+		req := newReq(http.MethodPost, "/v1/devices/dev-i/sign", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		hd.DeviceOps(rr, req)
+		return rr
+	}
+	first := sign("retry-1", `{"data":"a"}`)
+	retry := sign("retry-1", `{"data":"a"}`)
+	if first.Code != http.StatusOK || retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry=%d %s, first=%s", retry.Code, retry.Body.String(), first.Body.String())
+	}
+	if rr := sign("retry-1", `{"data":"b"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("reused key with other data=%d", rr.Code)
+	}
+	if d, _ := svc.GetDevice(dflt, "dev-i"); d.SignatureCounter != 1 {
+		t.Fatalf("counter=%d", d.SignatureCounter)
+	}
+}
+
+func Test_Sign_ExpectedCounter(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-e", Algorithm: domain.AlgRSA})
+
+	if rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-e/sign", strings.NewReader(`{"data":"a","expected_counter":0}`)); rr.Code != http.StatusOK {
+		t.Fatalf("matching counter=%d %s", rr.Code, rr.Body.String())
+	}
+	rr := rrDo(hd.DeviceOps, http.MethodPost, "/v1/devices/dev-e/sign", strings.NewReader(`{"data":"b","expected_counter":0}`))
+	var out struct {
+		Error            string `json:"error"`
+		SignatureCounter uint64 `json:"signature_counter"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &out)
+	if rr.Code != http.StatusConflict || out.SignatureCounter != 1 || out.Error == "" {
+		t.Fatalf("stale counter=%d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func Test_Lifecycle(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-l", Algorithm: domain.AlgRSA})
+	post := func(path, body string) *httptest.ResponseRecorder {
+		return rrDo(hd.DeviceOps, http.MethodPost, path, strings.NewReader(body))
+	}
+
+	if rr := post("/v1/devices/dev-l/suspend", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":"suspended"`) {
+		t.Fatalf("suspend=%d %s", rr.Code, rr.Body.String())
+	}
+	for path, body := range map[string]string{
+		"/v1/devices/dev-l/sign":       `{"data":"a"}`,
+		"/v1/devices/dev-l/sign/batch": `{"items":["a"]}`,
+	} {
+		if rr := post(path, body); rr.Code != http.StatusConflict {
+			t.Fatalf("%s on suspended device=%d", path, rr.Code)
+		}
+	}
+	if rr := post("/v1/devices/dev-l/activate", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":"active"`) {
+		t.Fatalf("activate=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("/v1/devices/dev-l/decommission", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":"decommissioned"`) {
+		t.Fatalf("decommission=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("/v1/devices/dev-l/activate", ""); rr.Code != http.StatusConflict {
+		t.Fatalf("reactivate decommissioned=%d", rr.Code)
+	}
+	if rr := post("/v1/devices/dev-l/rotate", ""); rr.Code != http.StatusConflict {
+		t.Fatalf("rotate decommissioned=%d", rr.Code)
+	}
+	if rr := post("/v1/devices/missing/suspend", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("missing=%d", rr.Code)
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodGet, "/v1/devices/dev-l/suspend", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("GET suspend=%d", rr.Code)
+	}
+}
+
+func Test_Decommission_KeyRetained(t *testing.T) {
+	svc := service.New(retainRepo{storage.NewMemory()}, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-k", Algorithm: domain.AlgRSA})
+	rr := rrDo(handler.NewDevice(svc).DeviceOps, http.MethodPost, "/v1/devices/dev-k/decommission", nil)
+	if rr.Code != http.StatusAccepted || !strings.Contains(rr.Body.String(), `"status":"decommissioned"`) {
+		t.Fatalf("decommission=%d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := svc.Sign(dflt, "dev-k", "a"); !errors.Is(err, domain.ErrDeviceInactive) {
+		t.Fatalf("sign after decommission: %v", err)
+	}
+}
+
+func Test_Patch_And_ListFilters(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	for _, body := range []string{
+		`{"id":"a","algorithm":"RSA","label":"till-1","tags":{"store":"berlin"}}`,
+		`{"id":"b","algorithm":"ECC","label":"till-2","tags":{"store":"berlin"}}`,
+		`{"id":"c","algorithm":"RSA","label":"kiosk"}`,
+	} {
+		if rr := rrDo(hd.Devices, http.MethodPost, "/v1/devices", strings.NewReader(body)); rr.Code != http.StatusCreated {
+			t.Fatalf("create=%d %s", rr.Code, rr.Body.String())
+		}
+	}
+	if rr := rrDo(hd.Devices, http.MethodPost, "/v1/devices", strings.NewReader(`{"id":"d","algorithm":"RSA","tags":{"a b":"x"}}`)); rr.Code != http.StatusBadRequest {
+		t.Fatalf("create with bad tag=%d", rr.Code)
+	}
+
+	patch := func(id, body string) *httptest.ResponseRecorder {
+		return rrDo(hd.DeviceOps, http.MethodPatch, "/v1/devices/"+id, strings.NewReader(body))
+	}
+	rr := patch("a", `{"label":"till-9","tags":{"store":null,"floor":"2"}}`)
+	var dev domain.SignatureDevice
+	_ = json.Unmarshal(rr.Body.Bytes(), &dev)
+	if rr.Code != http.StatusOK || dev.Label != "till-9" || len(dev.Tags) != 1 || dev.Tags["floor"] != "2" {
+		t.Fatalf("patch=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := patch("a", `{"tags":{"a b":"x"}}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad tag key=%d", rr.Code)
+	}
+	if rr := patch("a", `{`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid JSON=%d", rr.Code)
+	}
+	if rr := patch("missing", `{"label":"x"}`); rr.Code != http.StatusNotFound {
+		t.Fatalf("missing=%d", rr.Code)
+	}
+	if rr := rrDo(handler.NewDevice(service.New(&errUpdateRepo{storage.NewMemory()}, fakeAlgs, nil)).DeviceOps, http.MethodPatch, "/v1/devices/a", strings.NewReader(`{}`)); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("repo err=%d", rr.Code)
+	}
+
+	for query, want := range map[string]string{
+		"":                                 "a,b,c",
+		"?algorithm=RSA":                   "a,c",
+		"?label_prefix=till-":              "a,b",
+		"?tag=store:berlin":                "b",
+		"?tag=floor:2&label_prefix=till-9": "a",
+		"?tag=floor:2&tag=store:berlin":    "",
+	} {
+		rr := rrDo(hd.Devices, http.MethodGet, "/v1/devices"+query, nil)
+		var out struct{ Devices []domain.SignatureDevice }
+		_ = json.Unmarshal(rr.Body.Bytes(), &out)
+		ids := make([]string, len(out.Devices))
+		for i, d := range out.Devices {
+			ids[i] = d.ID
+		}
+		if rr.Code != http.StatusOK || strings.Join(ids, ",") != want {
+			t.Fatalf("list%s=%d %v, want %s", query, rr.Code, ids, want)
+		}
+	}
+	for _, query := range []string{"?tag=store", "?tag=bad%20key:x"} {
+		if rr := rrDo(hd.Devices, http.MethodGet, "/v1/devices"+query, nil); rr.Code != http.StatusBadRequest {
+			t.Fatalf("list%s=%d", query, rr.Code)
+		}
+	}
+}
+
+func Test_List_Paging(t *testing.T) {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	hd := handler.NewDevice(svc)
+	for _, id := range []string{"d", "b", "e", "a", "c"} {
+		_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: id, Algorithm: domain.AlgRSA})
+	}
+
+	var ids []string
+	cursor, pages := "", 0
+	for {
+		rr := rrDo(hd.Devices, http.MethodGet, "/v1/devices?limit=2&cursor="+cursor, nil)
+		var out struct {
+			Devices    []domain.SignatureDevice `json:"devices"`
+			NextCursor string                   `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("page %d: %d %s", pages, rr.Code, rr.Body.String())
+		}
+		pages++
+		for _, d := range out.Devices {
+			ids = append(ids, d.ID)
+		}
+		if out.NextCursor == "" {
+			break
+		}
+		cursor = out.NextCursor
+	}
+	if strings.Join(ids, ",") != "a,b,c,d,e" || pages != 3 {
+		t.Fatalf("pages=%d ids=%v", pages, ids)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?limit=x", "?cursor=***"} {
+		if rr := rrDo(hd.Devices, http.MethodGet, "/v1/devices"+query, nil); rr.Code != http.StatusBadRequest {
+			t.Fatalf("list%s=%d", query, rr.Code)
+		}
+	}
+}
+
+func Test_Create_GeneratesID(t *testing.T) {
+	hd := handler.NewDevice(service.New(storage.NewMemory(), fakeAlgs, id.UUIDv7{}))
+	rr := rrDo(hd.Devices, http.MethodPost, "/v1/devices", strings.NewReader(`{"algorithm":"RSA"}`))
+	var dev domain.SignatureDevice
+	_ = json.Unmarshal(rr.Body.Bytes(), &dev)
+	if rr.Code != http.StatusCreated || len(dev.ID) != 36 {
+		t.Fatalf("create without id=%d %s", rr.Code, rr.Body.String())
+	}
+	if rr := rrDo(hd.DeviceOps, http.MethodGet, "/v1/devices/"+dev.ID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("get generated id=%d", rr.Code)
+	}
+}
+
+func Test_NoCaller_401(t *testing.T) {
+	hd := handler.NewDevice(service.New(storage.NewMemory(), fakeAlgs, nil))
+	for _, path := range []string{"/v1/devices", "/v1/devices/a", "/v1/devices/a/signatures"} {
+		rr := httptest.NewRecorder()
+		if path == "/v1/devices" {
+			hd.Devices(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		} else {
+			hd.DeviceOps(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		}
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%s without caller=%d", path, rr.Code)
+		}
+	}
+}
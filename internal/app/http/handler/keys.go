@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/oxygenesis/signature/internal/auth"
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// Keys manages the API keys of the caller's tenant. Every route needs the
+// admin scope.
+type Keys struct{ store *auth.KeyStore }
+
+func NewKeys(store *auth.KeyStore) *Keys { return &Keys{store: store} }
+
+// ServeHTTP handles
+// - GET    /v1/keys      -> list
+// - POST   /v1/keys      -> issue
+// - DELETE /v1/keys/{id} -> revoke
+func (h *Keys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, ok := caller(w, r)
+	if !ok {
+		return
+	}
+	if !c.Can(service.ScopeAdmin) {
+		writeErr(w, http.StatusForbidden, "missing scope "+string(service.ScopeAdmin))
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/keys"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w, c)
+	case id == "" && r.Method == http.MethodPost:
+		h.issue(w, r, c)
+	case id != "" && !strings.Contains(id, "/") && r.Method == http.MethodDelete:
+		h.revoke(w, r, c, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Keys) list(w http.ResponseWriter, c service.Caller) {
+	keys, err := h.store.List(c.Tenant)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+// issue creates a key in the caller's tenant: {"name": "...", "scopes": [...]}.
+// The response carries the secret in "key"; it is not shown again.
+func (h *Keys) issue(w http.ResponseWriter, r *http.Request, c service.Caller) {
+	defer r.Body.Close()
+	var req struct {
+		Name   string          `json:"name"`
+		Scopes []service.Scope `json:"scopes"`
+	}
+	if !decodeJSON(w, r, maxBodyBytes, &req) {
+		return
+	}
+
+	k, secret, err := h.store.Issue(c.Tenant, req.Name, req.Scopes)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidInput) {
+			writeErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		auth.Key
+		Secret string `json:"key"`
+	}{k, secret})
+}
+
+func (h *Keys) revoke(w http.ResponseWriter, r *http.Request, c service.Caller, id string) {
+	if err := h.store.Revoke(c.Tenant, id); err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
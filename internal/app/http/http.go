@@ -2,37 +2,124 @@ package http
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/oxygenesis/signature/internal/app/http/handler"
 	"github.com/oxygenesis/signature/internal/app/http/middleware"
+	"github.com/oxygenesis/signature/internal/auth"
 	"github.com/oxygenesis/signature/internal/service"
 )
 
-func defaultListenAndServe(srv *http.Server) error { return srv.ListenAndServe() }
+func defaultListenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
 
 var listenAndServe = defaultListenAndServe
 
-// Start assembles the server. If test==true it returns without serving (for coverage/CI).
-func Start(ctx context.Context, addr string, svc *service.DeviceService, test bool) error {
-	srv := buildServer(addr, svc)
+// DefaultShutdownTimeout is how long Start waits for in-flight requests once
+// its context is done, unless Options says otherwise.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Options configures authentication, what is served besides the device
+// routes, and shutdown.
+type Options struct {
+	// Keys, when set, accepts API keys and serves key management under /v1/keys.
+	Keys *auth.KeyStore
+	// JWT, when set, accepts bearer tokens signed by the configured issuer.
+	JWT *auth.JWTVerifier
+	// TLS, when set, serves HTTPS. With a client CA, verified client
+	// certificates authenticate requests that carry no other credential.
+	TLS *TLSFiles
+	// Without any of them, requests are anonymous and scoped by the
+	// X-Tenant-ID header alone. Otherwise every route except health and
+	// algorithms requires a credential.
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// after the context is done (0 means DefaultShutdownTimeout).
+	ShutdownTimeout time.Duration
+}
+
+// clientCerts reports whether client certificates are verified.
+func (o Options) clientCerts() bool { return o.TLS != nil && o.TLS.ClientCAFile != "" }
+
+// Start assembles the server and serves until ctx is done. Then it stops
+// accepting connections and waits up to opts.ShutdownTimeout for in-flight
+// requests, so a sign request is never cut off between signing and
+// answering. Connections still open after that are closed and the timeout is
+// returned. If test==true it returns without serving (for coverage/CI).
+func Start(ctx context.Context, addr string, svc *service.DeviceService, opts Options, test bool) error {
+	srv := buildServer(addr, svc, opts)
+	if opts.TLS != nil {
+		// only certificates can authenticate when nothing else is configured,
+		// so then they are required during the handshake
+		cfg, err := newTLSConfig(*opts.TLS, opts.Keys == nil && opts.JWT == nil)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = cfg
+	}
 	if test {
 		return nil
 	}
-	log.Printf("listening on %s", addr)
-	return listenAndServe(srv)
+	log.Printf("listening on %s (tls=%t, client certificates=%t)", addr, opts.TLS != nil, opts.clientCerts())
+	served := make(chan error, 1)
+	go func() { served <- listenAndServe(srv) }()
+	select {
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := opts.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	log.Printf("shutting down: waiting up to %s for in-flight requests", timeout)
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(sctx)
+	if err != nil {
+		_ = srv.Close()
+		err = fmt.Errorf("shutdown: %w", err)
+	}
+	<-served // ErrServerClosed once the listener is gone
+	return err
 }
 
 // buildServer is kept package-private so tests can exercise routes without binding a port.
-func buildServer(addr string, svc *service.DeviceService) *http.Server {
+func buildServer(addr string, svc *service.DeviceService, opts Options) *http.Server {
 	h := handler.NewDevice(svc)
 
+	api := http.NewServeMux()
+	api.HandleFunc("/v1/devices", h.Devices)    // GET -> list, POST -> create
+	api.HandleFunc("/v1/devices/", h.DeviceOps) // GET -> get by id, POST + /sign -> sign
+
+	if opts.Keys != nil {
+		keys := handler.NewKeys(opts.Keys)
+		api.Handle("/v1/keys", keys)
+		api.Handle("/v1/keys/", keys)
+	}
+	var scoped http.Handler
+	if opts.Keys != nil || opts.JWT != nil || opts.clientCerts() {
+		scoped = middleware.Auth(auth.Credentials{Keys: opts.Keys, JWT: opts.JWT, ClientCerts: opts.clientCerts()}, api)
+	} else {
+		scoped = middleware.Tenant(api)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/health", h.Health)
-	mux.HandleFunc("/v1/devices", h.Devices)    // GET -> list, POST -> create
-	mux.HandleFunc("/v1/devices/", h.DeviceOps) // GET -> get by id, POST + /sign -> sign
+	mux.HandleFunc("/v1/algorithms", h.Algorithms)
+	mux.Handle("/", scoped)
 
 	root := middleware.Recovery(mux)
 
@@ -3,13 +3,25 @@ package http
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/oxygenesis/signature/internal/app/http/handler"
+	"github.com/oxygenesis/signature/internal/app/http/middleware"
+	"github.com/oxygenesis/signature/internal/auth"
+	"github.com/oxygenesis/signature/internal/crypto"
 	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/service"
 	"github.com/oxygenesis/signature/internal/storage"
@@ -24,42 +36,48 @@ func (fakeSigner) Verify(p, s []byte) bool       { return true }
 func (fakeSigner) PublicPEM() string             { return "PEM" }
 func (fakeSigner) AlgorithmName() string         { return "RSA" }
 
-type fakeFactory struct{}
+var fakeAlgs = crypto.NewRegistry(
+	domain.AlgorithmSpec{Name: domain.AlgRSA, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return fakeSigner{}, nil }},
+	domain.AlgorithmSpec{Name: domain.AlgECC, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return fakeSigner{}, nil }},
+	domain.AlgorithmSpec{Name: domain.AlgEd25519, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return fakeSigner{}, nil }},
+)
 
-func (fakeFactory) NewRSA(int) (domain.Signer, error) { return fakeSigner{}, nil }
-func (fakeFactory) NewECDSA() (domain.Signer, error)  { return fakeSigner{}, nil }
+// dflt is the caller the tests' direct service calls act for.
+var dflt = service.Caller{Tenant: domain.DefaultTenant, Scopes: []service.Scope{service.ScopeAdmin}}
 
 // repo that fails at Create
-type errCreateRepo struct{ storage.Memory }
+type errCreateRepo struct{ *storage.Memory }
 
 func (errCreateRepo) Create(*domain.SignatureDevice, domain.Signer) error {
 	return errors.New("db down")
 }
 
 // repo that fails at List
-type errListRepo struct{ storage.Memory }
+type errListRepo struct{ *storage.Memory }
 
-func (errListRepo) List() ([]*domain.SignatureDevice, error) { return nil, errors.New("boom") }
+func (errListRepo) List(string, storage.DeviceFilter) ([]*domain.SignatureDevice, error) {
+	return nil, errors.New("boom")
+}
 
 // repo that returns device but Update fails (to hit POST /sign 500)
 type errUpdateRepo struct {
-	storage.Memory
+	*storage.Memory
 }
 
-func (r *errUpdateRepo) Update(id string, fn func(*domain.SignatureDevice, domain.Signer) error) error {
+func (r *errUpdateRepo) Update(tenant, id string, fn func(storage.Tx) error) error {
 	return errors.New("update fail")
 }
 
 func Test_Start_TestMode(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	if err := Start(nil, ":0", svc, true); err != nil {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	if err := Start(nil, ":0", svc, Options{}, true); err != nil {
 		t.Fatalf("start test mode: %v", err)
 	}
 }
 
 func Test_Routes_HappyFlow(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -97,8 +115,8 @@ func Test_Routes_HappyFlow(t *testing.T) {
 }
 
 func Test_Create_InvalidAlgorithm_Maps400(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -110,8 +128,8 @@ func Test_Create_InvalidAlgorithm_Maps400(t *testing.T) {
 }
 
 func Test_Create_RepoError_500(t *testing.T) {
-	svc := service.New(&errCreateRepo{}, fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(&errCreateRepo{}, fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -123,8 +141,8 @@ func Test_Create_RepoError_500(t *testing.T) {
 }
 
 func Test_List_RepoError_500(t *testing.T) {
-	svc := service.New(&errListRepo{}, fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(&errListRepo{}, fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -135,8 +153,8 @@ func Test_List_RepoError_500(t *testing.T) {
 }
 
 func Test_Get_NotFound_404(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -147,8 +165,8 @@ func Test_Get_NotFound_404(t *testing.T) {
 }
 
 func Test_Sign_InvalidJSON_400(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -161,9 +179,9 @@ func Test_Sign_InvalidJSON_400(t *testing.T) {
 func Test_Sign_ErrInvalidInput_400(t *testing.T) {
 	// create device first
 	mem := storage.NewMemory()
-	svc := service.New(mem, fakeFactory{}, nil)
-	_, _ = svc.CreateDevice("dev-1", domain.AlgRSA, "")
-	srv := buildServer(":0", svc)
+	svc := service.New(mem, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-1", Algorithm: domain.AlgRSA})
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -178,10 +196,10 @@ func Test_Sign_ErrInvalidInput_400(t *testing.T) {
 func Test_Sign_InternalError_500(t *testing.T) {
 	// prepare repo that will fail Update
 	mem := storage.NewMemory()
-	svc := service.New(&errUpdateRepo{*mem}, fakeFactory{}, nil)
-	_, _ = svc.CreateDevice("dev-1", domain.AlgRSA, "")
+	svc := service.New(&errUpdateRepo{mem}, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev-1", Algorithm: domain.AlgRSA})
 
-	srv := buildServer(":0", svc)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -196,8 +214,8 @@ func Test_Sign_InternalError_500(t *testing.T) {
 var _ = handler.NewDevice
 
 func TestStart_TestMode(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	if err := Start(context.Background(), ":0", svc, true); err != nil {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	if err := Start(context.Background(), ":0", svc, Options{}, true); err != nil {
 		t.Fatalf("start test mode: %v", err)
 	}
 }
@@ -215,8 +233,8 @@ func TestStart_ServeBranch_WithStub(t *testing.T) {
 		return nil
 	}
 
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	if err := Start(context.Background(), ":0", svc, false); err != nil {
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	if err := Start(context.Background(), ":0", svc, Options{}, false); err != nil {
 		t.Fatalf("start serve stub err: %v", err)
 	}
 	if !called {
@@ -225,8 +243,8 @@ func TestStart_ServeBranch_WithStub(t *testing.T) {
 }
 
 func TestBuildServer_Routes(t *testing.T) {
-	svc := service.New(storage.NewMemory(), fakeFactory{}, nil)
-	srv := buildServer(":0", svc)
+	svc := service.New(storage.NewMemory(), fakeAlgs, nil)
+	srv := buildServer(":0", svc, Options{})
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
 
@@ -244,6 +262,223 @@ func TestBuildServer_Routes(t *testing.T) {
 	}
 }
 
+func TestBuildServer_TenantHeader(t *testing.T) {
+	srv := buildServer(":0", service.New(storage.NewMemory(), fakeAlgs, nil), Options{})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	do := func(method, path, tenant, body string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if tenant != "" {
+			req.Header.Set(middleware.TenantHeader, tenant)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// the same ID is free in every tenant
+	for _, tenant := range []string{"", "acme", "globex"} {
+		if code := do(http.MethodPost, "/v1/devices", tenant, `{"id":"dev-1","algorithm":"RSA"}`); code != http.StatusCreated {
+			t.Fatalf("create in %q=%d", tenant, code)
+		}
+	}
+	if code := do(http.MethodPost, "/v1/devices/dev-1/sign", "acme", `{"data":"x"}`); code != http.StatusOK {
+		t.Fatalf("sign=%d", code)
+	}
+	if code := do(http.MethodGet, "/v1/devices/dev-1", "initech", ""); code != http.StatusNotFound {
+		t.Fatalf("get from other tenant=%d", code)
+	}
+	if code := do(http.MethodGet, "/v1/devices", "bad tenant", ""); code != http.StatusBadRequest {
+		t.Fatalf("invalid tenant=%d", code)
+	}
+}
+
+func TestBuildServer_APIKeys(t *testing.T) {
+	keys := auth.NewKeyStore()
+	_, admin, _ := keys.Issue("acme", "ops", []service.Scope{service.ScopeAdmin})
+	_, till, _ := keys.Issue("acme", "till", []service.Scope{service.ScopeSign})
+	srv := buildServer(":0", service.New(storage.NewMemory(), fakeAlgs, nil), Options{Keys: keys})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	do := func(method, path, key, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	for _, tc := range []struct {
+		method, path, key, body string
+		code                    int
+	}{
+		{http.MethodGet, "/v1/health", "", "", http.StatusOK},
+		{http.MethodGet, "/v1/devices", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/devices", "sk_forged", "", http.StatusUnauthorized},
+		{http.MethodPost, "/v1/devices", till, `{"id":"d","algorithm":"RSA"}`, http.StatusForbidden},
+		{http.MethodPost, "/v1/devices", admin, `{"id":"d","algorithm":"RSA"}`, http.StatusCreated},
+		{http.MethodPost, "/v1/devices/d/sign", till, `{"data":"x"}`, http.StatusOK},
+		{http.MethodGet, "/v1/devices/d", till, "", http.StatusForbidden},
+		{http.MethodPost, "/v1/devices/d/rotate", till, "", http.StatusForbidden},
+		{http.MethodGet, "/v1/keys", till, "", http.StatusForbidden},
+	} {
+		if code, body := do(tc.method, tc.path, tc.key, tc.body); code != tc.code {
+			t.Fatalf("%s %s: status=%d want %d (%s)", tc.method, tc.path, code, tc.code, body)
+		}
+	}
+
+	// admins manage their tenant's keys over the API
+	code, body := do(http.MethodPost, "/v1/keys", admin, `{"name":"reader","scopes":["devices:read"]}`)
+	var issued struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal([]byte(body), &issued); err != nil || code != http.StatusCreated || issued.Key == "" {
+		t.Fatalf("issue=%d %s", code, body)
+	}
+	if code, _ := do(http.MethodGet, "/v1/devices/d", issued.Key, ""); code != http.StatusOK {
+		t.Fatalf("read with issued key=%d", code)
+	}
+	if code, body := do(http.MethodGet, "/v1/keys", admin, ""); code != http.StatusOK || strings.Count(body, `"id"`) != 3 || strings.Contains(body, "hash") {
+		t.Fatalf("list=%d %s", code, body)
+	}
+	if code, _ := do(http.MethodPost, "/v1/keys", admin, `{"scopes":["root"]}`); code != http.StatusBadRequest {
+		t.Fatalf("issue unknown scope=%d", code)
+	}
+	if code, _ := do(http.MethodDelete, "/v1/keys/"+issued.ID, admin, ""); code != http.StatusNoContent {
+		t.Fatalf("revoke=%d", code)
+	}
+	if code, _ := do(http.MethodDelete, "/v1/keys/"+issued.ID, admin, ""); code != http.StatusNotFound {
+		t.Fatalf("revoke twice=%d", code)
+	}
+	if code, _ := do(http.MethodGet, "/v1/devices/d", issued.Key, ""); code != http.StatusUnauthorized {
+		t.Fatalf("read with revoked key=%d", code)
+	}
+}
+
+func TestBuildServer_DeviceACL(t *testing.T) {
+	keys := auth.NewKeyStore()
+	_, admin, _ := keys.Issue("acme", "ops", []service.Scope{service.ScopeAdmin})
+	reg1, secret1, _ := keys.Issue("acme", "register-1", []service.Scope{service.ScopeRead, service.ScopeSign})
+	reg2, secret2, _ := keys.Issue("acme", "register-2", []service.Scope{service.ScopeRead, service.ScopeSign, service.ScopeManage})
+	dash, secret3, _ := keys.Issue("acme", "dashboard", []service.Scope{service.ScopeRead})
+	srv := buildServer(":0", service.New(storage.NewMemory(), fakeAlgs, nil), Options{Keys: keys})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	do := func(method, path, key, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	for _, tc := range []struct {
+		method, path, key, body string
+		code                    int
+	}{
+		// each register gets its own device
+		{http.MethodPost, "/v1/devices", admin, `{"id":"till-1","algorithm":"RSA","acl":{"key:` + reg1.ID + `":"sign","key:` + dash.ID + `":"sign"}}`, http.StatusCreated},
+		{http.MethodPost, "/v1/devices", admin, `{"id":"till-2","algorithm":"RSA"}`, http.StatusCreated},
+		{http.MethodPatch, "/v1/devices/till-2", admin, `{"acl":{"key:` + reg2.ID + `":"admin"}}`, http.StatusOK},
+		{http.MethodPost, "/v1/devices/till-1/sign", secret1, `{"data":"x"}`, http.StatusOK},
+		{http.MethodPost, "/v1/devices/till-2/sign", secret1, `{"data":"x"}`, http.StatusForbidden},
+		{http.MethodGet, "/v1/devices/till-1", secret1, "", http.StatusOK},
+		{http.MethodGet, "/v1/devices/till-1/signatures", secret2, "", http.StatusForbidden},
+		// the ACL never grants more than the key's scopes
+		{http.MethodGet, "/v1/devices/till-1", secret3, "", http.StatusOK},
+		{http.MethodPost, "/v1/devices/till-1/sign", secret3, `{"data":"x"}`, http.StatusForbidden},
+		{http.MethodPost, "/v1/devices/till-2/sign", secret2, `{"data":"x"}`, http.StatusOK},
+		{http.MethodPost, "/v1/devices/till-1/rotate", secret3, "", http.StatusForbidden},
+		// a device admin with the manage scope manages its device, but no other
+		{http.MethodPost, "/v1/devices/till-2/rotate", secret2, "", http.StatusOK},
+		{http.MethodPost, "/v1/devices/till-1/suspend", secret2, "", http.StatusForbidden},
+		{http.MethodPatch, "/v1/devices/till-2", secret2, `{"label":"front"}`, http.StatusOK},
+		{http.MethodPatch, "/v1/devices/till-2", secret2, `{"acl":{"key:x":"owner"}}`, http.StatusBadRequest},
+	} {
+		if code, body := do(tc.method, tc.path, tc.key, tc.body); code != tc.code {
+			t.Fatalf("%s %s: status=%d want %d (%s)", tc.method, tc.path, code, tc.code, body)
+		}
+	}
+	_, signOnly, _ := keys.Issue("acme", "register-3", []service.Scope{service.ScopeSign})
+	if code, body := do(http.MethodGet, "/v1/devices", signOnly, ""); code != http.StatusForbidden {
+		t.Fatalf("list without read scope=%d %s", code, body)
+	}
+	if code, body := do(http.MethodGet, "/v1/devices", secret2, ""); code != http.StatusOK || !strings.Contains(body, `"till-2"`) || strings.Contains(body, `"till-1"`) {
+		t.Fatalf("list=%d %s", code, body)
+	}
+}
+
+func TestBuildServer_JWT(t *testing.T) {
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{"kty": "EC", "crv": "P-256", "kid": "k1",
+			"x": b64(ec.X.FillBytes(make([]byte, 32))), "y": b64(ec.Y.FillBytes(make([]byte, 32)))}}})
+	}))
+	defer jwks.Close()
+	verifier, err := auth.NewJWTVerifier(auth.JWTConfig{JWKS: jwks.URL, Audience: "signer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(claims map[string]any) string {
+		hdr, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+		body, _ := json.Marshal(claims)
+		input := b64(hdr) + "." + b64(body)
+		digest := sha256.Sum256([]byte(input))
+		r, s, _ := ecdsa.Sign(rand.Reader, ec, digest[:])
+		return input + "." + b64(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	admin := token(map[string]any{"sub": "ops", "aud": "signer", "tenant": "acme", "scope": "admin", "exp": exp})
+	reader := token(map[string]any{"sub": "dash", "aud": "signer", "tenant": "acme", "scope": "devices:read", "exp": exp})
+	otherAud := token(map[string]any{"sub": "ops", "aud": "billing", "tenant": "acme", "scope": "admin", "exp": exp})
+
+	srv := buildServer(":0", service.New(storage.NewMemory(), fakeAlgs, nil), Options{JWT: verifier})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+	do := func(method, path, bearer, body string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for _, tc := range []struct {
+		method, path, bearer, body string
+		code                       int
+	}{
+		{http.MethodGet, "/v1/devices", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/devices", otherAud, "", http.StatusUnauthorized},
+		{http.MethodPost, "/v1/devices", reader, `{"id":"d","algorithm":"RSA"}`, http.StatusForbidden},
+		{http.MethodPost, "/v1/devices", admin, `{"id":"d","algorithm":"RSA"}`, http.StatusCreated},
+		{http.MethodGet, "/v1/devices/d", reader, "", http.StatusOK},
+		{http.MethodGet, "/v1/keys", admin, "", http.StatusNotFound}, // no key store configured
+	} {
+		if code := do(tc.method, tc.path, tc.bearer, tc.body); code != tc.code {
+			t.Fatalf("%s %s: status=%d want %d", tc.method, tc.path, code, tc.code)
+		}
+	}
+}
+
 func TestDefaultListenAndServe_ReturnsError(t *testing.T) {
 	// invalid port forces immediate error without binding
 	srv := &http.Server{Addr: "127.0.0.1:-1", Handler: http.NewServeMux()}
@@ -251,3 +486,99 @@ func TestDefaultListenAndServe_ReturnsError(t *testing.T) {
 		t.Fatal("expected error from defaultListenAndServe on invalid addr")
 	}
 }
+
+// blockingRepo holds every Update until release is closed, announcing it on entered.
+type blockingRepo struct {
+	*storage.Memory
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRepo) Update(tenant, id string, fn func(storage.Tx) error) error {
+	r.entered <- struct{}{}
+	<-r.release
+	return r.Memory.Update(tenant, id, fn)
+}
+
+// startServing runs Start on a local port until ctx is done and returns its
+// base URL and the channel Start's result arrives on.
+func startServing(t *testing.T, ctx context.Context, svc *service.DeviceService, opts Options) (string, <-chan error) {
+	t.Helper()
+	orig := listenAndServe
+	t.Cleanup(func() { listenAndServe = orig })
+	addr := make(chan string, 1)
+	listenAndServe = func(srv *http.Server) error {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		addr <- ln.Addr().String()
+		return srv.Serve(ln)
+	}
+	done := make(chan error, 1)
+	go func() { done <- Start(ctx, ":0", svc, opts, false) }()
+	return "http://" + <-addr, done
+}
+
+func TestStart_DrainsInFlightRequestsOnCancel(t *testing.T) {
+	repo := &blockingRepo{storage.NewMemory(), make(chan struct{}, 1), make(chan struct{})}
+	svc := service.New(repo, fakeAlgs, nil)
+	if _, err := svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "d", Algorithm: domain.AlgRSA}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	base, done := startServing(t, ctx, svc, Options{})
+
+	signed := make(chan int, 1)
+	go func() {
+		res, err := http.Post(base+"/v1/devices/d/sign", "application/json", strings.NewReader(`{"data":"x"}`))
+		if err != nil {
+			signed <- 0
+			return
+		}
+		res.Body.Close()
+		signed <- res.StatusCode
+	}()
+	<-repo.entered
+	cancel()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Start returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := http.Get(base + "/v1/health"); err == nil {
+		t.Fatal("new connections still accepted while draining")
+	}
+	close(repo.release)
+	if code := <-signed; code != http.StatusOK {
+		t.Fatalf("in-flight sign status=%d", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if d, _ := svc.GetDevice(dflt, "d"); d.SignatureCounter != 1 {
+		t.Fatalf("counter=%d", d.SignatureCounter)
+	}
+}
+
+func TestStart_ShutdownTimeout(t *testing.T) {
+	repo := &blockingRepo{storage.NewMemory(), make(chan struct{}, 1), make(chan struct{})}
+	defer close(repo.release)
+	svc := service.New(repo, fakeAlgs, nil)
+	_, _ = svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "d", Algorithm: domain.AlgRSA})
+	ctx, cancel := context.WithCancel(context.Background())
+	base, done := startServing(t, ctx, svc, Options{ShutdownTimeout: 20 * time.Millisecond})
+
+	go func() {
+		if res, err := http.Post(base+"/v1/devices/d/sign", "application/json", strings.NewReader(`{"data":"x"}`)); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-repo.entered
+	cancel()
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the drain deadline, got %v", err)
+	}
+}
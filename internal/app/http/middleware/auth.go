@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// Authenticator resolves a request credential to the caller it acts for.
+type Authenticator interface {
+	Authenticate(credential string) (service.Caller, error)
+}
+
+// CertAuthenticator is implemented by Authenticators that also accept the
+// client certificate a TLS connection was verified with.
+type CertAuthenticator interface {
+	AuthenticateCert(cert *x509.Certificate) (service.Caller, error)
+}
+
+// Auth replaces Tenant when credentials are required: the credential in
+// "Authorization: Bearer <credential>" or X-API-Key decides the caller and
+// its tenant. Without one, a verified client certificate does, if a
+// implements CertAuthenticator. A request without a valid credential is a
+// 401. X-Tenant-ID may still be sent, but it must name the caller's tenant.
+func Auth(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred := r.Header.Get("X-API-Key")
+		if v := r.Header.Get("Authorization"); cred == "" && len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			cred = strings.TrimSpace(v[7:])
+		}
+		var c service.Caller
+		var err error
+		certs, _ := a.(CertAuthenticator)
+		switch {
+		case cred != "":
+			c, err = a.Authenticate(cred)
+		case certs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+			c, err = certs.AuthenticateCert(r.TLS.VerifiedChains[0][0])
+		default:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "credentials required", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("auth: %s %s: %v", r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if t := r.Header.Get(TenantHeader); t != "" && t != c.Tenant {
+			http.Error(w, TenantHeader+" does not match the credential", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(service.WithCaller(r.Context(), c)))
+	})
+}
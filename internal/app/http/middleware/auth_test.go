@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+type fakeAuth map[string]service.Caller
+
+func (f fakeAuth) Authenticate(cred string) (service.Caller, error) {
+	if c, ok := f[cred]; ok {
+		return c, nil
+	}
+	return service.Caller{}, errors.New("unknown")
+}
+
+func TestAuth(t *testing.T) {
+	var got service.Caller
+	h := Auth(fakeAuth{"good": {Tenant: "acme", Principal: "key:1"}}, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got, _ = service.CallerFrom(r.Context())
+	}))
+	for name, tc := range map[string]struct {
+		headers map[string]string
+		code    int
+	}{
+		"bearer":        {map[string]string{"Authorization": "Bearer good"}, http.StatusOK},
+		"bearer case":   {map[string]string{"Authorization": "bearer good"}, http.StatusOK},
+		"api key":       {map[string]string{"X-API-Key": "good"}, http.StatusOK},
+		"own tenant":    {map[string]string{"X-API-Key": "good", TenantHeader: "acme"}, http.StatusOK},
+		"none":          {nil, http.StatusUnauthorized},
+		"basic":         {map[string]string{"Authorization": "Basic Z29vZA=="}, http.StatusUnauthorized},
+		"unknown":       {map[string]string{"X-API-Key": "bad"}, http.StatusUnauthorized},
+		"other tenant":  {map[string]string{"X-API-Key": "good", TenantHeader: "globex"}, http.StatusForbidden},
+		"header wins":   {map[string]string{"X-API-Key": "bad", "Authorization": "Bearer good"}, http.StatusUnauthorized},
+		"empty bearer":  {map[string]string{"Authorization": "Bearer "}, http.StatusUnauthorized},
+		"no tenant hdr": {map[string]string{"Authorization": "Bearer good", TenantHeader: ""}, http.StatusOK},
+	} {
+		got = service.Caller{}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Fatalf("%s: status=%d", name, rr.Code)
+		}
+		if ok := got.Principal == "key:1"; ok != (tc.code == http.StatusOK) {
+			t.Fatalf("%s: caller=%+v", name, got)
+		}
+	}
+}
+
+// fakeCertAuth also accepts client certificates, by common name.
+type fakeCertAuth struct{ fakeAuth }
+
+func (fakeCertAuth) AuthenticateCert(cert *x509.Certificate) (service.Caller, error) {
+	if cert.Subject.CommonName == "till" {
+		return service.Caller{Tenant: "acme", Principal: "cert:CN=till"}, nil
+	}
+	return service.Caller{}, errors.New("unknown")
+}
+
+func TestAuth_ClientCertificate(t *testing.T) {
+	var got service.Caller
+	next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) { got, _ = service.CallerFrom(r.Context()) })
+	withCert := func(cn, key string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		return req
+	}
+	for name, tc := range map[string]struct {
+		a         Authenticator
+		req       *http.Request
+		code      int
+		principal string
+	}{
+		"certificate":       {fakeCertAuth{}, withCert("till", ""), http.StatusOK, "cert:CN=till"},
+		"unknown cert":      {fakeCertAuth{}, withCert("x", ""), http.StatusUnauthorized, ""},
+		"header wins":       {fakeCertAuth{fakeAuth{"good": {Tenant: "acme", Principal: "key:1"}}}, withCert("till", "good"), http.StatusOK, "key:1"},
+		"certs not handled": {fakeAuth{}, withCert("till", ""), http.StatusUnauthorized, ""},
+	} {
+		got = service.Caller{}
+		rr := httptest.NewRecorder()
+		Auth(tc.a, next).ServeHTTP(rr, tc.req)
+		if rr.Code != tc.code || got.Principal != tc.principal {
+			t.Fatalf("%s: status=%d caller=%+v", name, rr.Code, got)
+		}
+	}
+}
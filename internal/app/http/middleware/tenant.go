@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// TenantHeader names the tenant a request acts for.
+const TenantHeader = "X-Tenant-ID"
+
+// Tenant scopes each request to the tenant in the X-Tenant-ID header, or to
+// domain.DefaultTenant when the header is absent. Malformed names are a 400.
+// It authenticates nobody, so callers get every scope; use Auth instead when
+// the server is reachable by anyone but trusted clients.
+func Tenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(TenantHeader)
+		if tenant == "" {
+			tenant = domain.DefaultTenant
+		}
+		if !domain.ValidTenant(tenant) {
+			http.Error(w, "invalid "+TenantHeader, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(service.WithCaller(r.Context(), service.Caller{Tenant: tenant, Scopes: []service.Scope{service.ScopeAdmin}})))
+	})
+}
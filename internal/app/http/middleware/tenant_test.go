@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+func TestTenant(t *testing.T) {
+	var got string
+	h := Tenant(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := service.CallerFrom(r.Context())
+		if !ok {
+			t.Fatal("no caller in context")
+		}
+		got = c.Tenant
+	}))
+	for header, want := range map[string]string{"": domain.DefaultTenant, "acme": "acme", "shop-42_eu": "shop-42_eu"} {
+		got = ""
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set(TenantHeader, header)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || got != want {
+			t.Fatalf("%q: status=%d tenant=%q", header, rr.Code, got)
+		}
+	}
+	for _, header := range []string{"a b", "../x", strings.Repeat("t", domain.MaxTenantLen+1)} {
+		got = ""
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(TenantHeader, header)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest || got != "" {
+			t.Fatalf("%q: status=%d tenant=%q", header, rr.Code, got)
+		}
+	}
+}
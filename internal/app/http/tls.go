@@ -0,0 +1,155 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles names the PEM files the server is served with.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, when set, turns on mutual TLS: client certificates must
+	// chain to one of these CAs.
+	ClientCAFile string
+}
+
+// tlsFileCheckEvery bounds how often handshakes look for changed TLS files,
+// so a burst of handshakes is not also a burst of stat calls. A variable so
+// tests can turn the throttle off.
+var tlsFileCheckEvery = time.Second
+
+// tlsFiles keeps the certificate and client CA pool loaded from TLSFiles and
+// reloads them when a file's modification time changes, so rotated
+// certificates take effect within tlsFileCheckEvery without a restart. A
+// rotation that fails to load is logged and the previous material kept.
+type tlsFiles struct {
+	files TLSFiles
+
+	mu      sync.Mutex
+	checked time.Time // last look at the files
+	mtimes  [3]time.Time
+	cert    *tls.Certificate
+	clients *x509.CertPool
+}
+
+// newTLSConfig loads files once, so bad paths fail at startup. requireCert
+// makes a client certificate mandatory during the handshake; otherwise it is
+// verified only if the client sends one.
+func newTLSConfig(files TLSFiles, requireCert bool) (*tls.Config, error) {
+	t := &tlsFiles{files: files}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: t.certificate,
+	}
+	if files.ClientCAFile != "" {
+		clientAuth := tls.VerifyClientCertIfGiven
+		if requireCert {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.reload()
+			c := cfg.Clone()
+			c.GetConfigForClient = nil
+			c.GetCertificate = t.current // reloaded just above
+			c.ClientAuth = clientAuth
+			t.mu.Lock()
+			c.ClientCAs = t.clients
+			t.mu.Unlock()
+			return c, nil
+		}
+	}
+	return cfg, nil
+}
+
+func (t *tlsFiles) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.reload()
+	return t.current(hello)
+}
+
+// current returns the loaded certificate without looking for changes.
+func (t *tlsFiles) current(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cert, nil
+}
+
+// reload loads the files again if they changed, looking at most once every
+// tlsFileCheckEvery.
+func (t *tlsFiles) reload() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.checked) < tlsFileCheckEvery {
+		return
+	}
+	t.checked = now
+	if !t.changed() {
+		return
+	}
+	if err := t.loadLocked(); err != nil {
+		log.Printf("tls: reload failed, keeping the current certificates: %v", err)
+	}
+}
+
+func (t *tlsFiles) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loadLocked()
+}
+
+// changed reports whether any file's modification time differs from the
+// last load attempt.
+func (t *tlsFiles) changed() bool {
+	for i, p := range []string{t.files.CertFile, t.files.KeyFile, t.files.ClientCAFile} {
+		if p == "" {
+			continue
+		}
+		if st, err := os.Stat(p); err == nil && !st.ModTime().Equal(t.mtimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tlsFiles) loadLocked() error {
+	var mtimes [3]time.Time
+	for i, p := range []string{t.files.CertFile, t.files.KeyFile, t.files.ClientCAFile} {
+		if p == "" {
+			continue
+		}
+		st, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		mtimes[i] = st.ModTime()
+	}
+	// a broken rotation is retried once the files change again, not on every handshake
+	t.mtimes = mtimes
+	cert, err := tls.LoadX509KeyPair(t.files.CertFile, t.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	var clients *x509.CertPool
+	if t.files.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.files.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		clients = x509.NewCertPool()
+		if !clients.AppendCertsFromPEM(pem) {
+			return errors.New("tls: no certificates in " + t.files.ClientCAFile)
+		}
+	}
+	t.cert, t.clients = &cert, clients
+	return nil
+}
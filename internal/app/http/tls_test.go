@@ -0,0 +1,270 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/service"
+	"github.com/oxygenesis/signature/internal/storage"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for subject, valid for 127.0.0.1
+// as a server and usable as a client certificate.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	p := x509.NewCertPool()
+	p.AddCert(ca.cert)
+	return p
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS runs Start with opts and serves the server it builds on a local
+// port, returning the https base URL.
+func serveTLS(t *testing.T, opts Options) string {
+	t.Helper()
+	orig := listenAndServe
+	defer func() { listenAndServe = orig }()
+	var srv *http.Server
+	listenAndServe = func(s *http.Server) error { srv = s; return nil }
+	if err := Start(context.Background(), ":0", service.New(storage.NewMemory(), fakeAlgs, nil), opts, false); err != nil {
+		t.Fatal(err)
+	}
+	if srv.TLSConfig == nil {
+		t.Fatal("no TLS config")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func tlsClient(roots *x509.CertPool, certPEM, keyPEM []byte) *http.Client {
+	cfg := &tls.Config{RootCAs: roots}
+	if certPEM != nil {
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+}
+
+func TestTLS_ClientCertificateIdentity(t *testing.T) {
+	serverCA, clientCA := newTestCA(t, "server-ca"), newTestCA(t, "client-ca")
+	dir := t.TempDir()
+	files := TLSFiles{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "clients.pem"),
+	}
+	crt, key := serverCA.issue(t, pkix.Name{CommonName: "localhost"})
+	writeFile(t, files.CertFile, crt)
+	writeFile(t, files.KeyFile, key)
+	writeFile(t, files.ClientCAFile, clientCA.pem)
+	base := serveTLS(t, Options{TLS: &files})
+
+	adminCrt, adminKey := clientCA.issue(t, pkix.Name{CommonName: "ops", Organization: []string{"acme"}, OrganizationalUnit: []string{"admin"}})
+	readCrt, readKey := clientCA.issue(t, pkix.Name{CommonName: "dash", Organization: []string{"acme"}, OrganizationalUnit: []string{"devices:read", "finance"}})
+	strangerCrt, strangerKey := newTestCA(t, "other-ca").issue(t, pkix.Name{CommonName: "x", Organization: []string{"acme"}})
+	admin := tlsClient(serverCA.pool(), adminCrt, adminKey)
+	reader := tlsClient(serverCA.pool(), readCrt, readKey)
+
+	do := func(c *http.Client, method, path, body string) int {
+		req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for _, tc := range []struct {
+		client             *http.Client
+		method, path, body string
+		code               int
+	}{
+		{admin, http.MethodPost, "/v1/devices", `{"id":"d","algorithm":"RSA"}`, http.StatusCreated},
+		{reader, http.MethodGet, "/v1/devices/d", "", http.StatusOK},
+		{reader, http.MethodPost, "/v1/devices/d/sign", `{"data":"x"}`, http.StatusForbidden},
+	} {
+		if code := do(tc.client, tc.method, tc.path, tc.body); code != tc.code {
+			t.Fatalf("%s %s: status=%d want %d", tc.method, tc.path, code, tc.code)
+		}
+	}
+
+	// with no other credential configured the handshake itself needs a certificate
+	for name, c := range map[string]*http.Client{
+		"no certificate":  tlsClient(serverCA.pool(), nil, nil),
+		"untrusted chain": tlsClient(serverCA.pool(), strangerCrt, strangerKey),
+	} {
+		if res, err := c.Get(base + "/v1/health"); err == nil {
+			res.Body.Close()
+			t.Fatalf("%s: handshake succeeded", name)
+		}
+	}
+}
+
+func TestTLS_ReloadsRotatedCertificate(t *testing.T) {
+	every := tlsFileCheckEvery
+	tlsFileCheckEvery = 0
+	t.Cleanup(func() { tlsFileCheckEvery = every })
+	oldCA, newCA := newTestCA(t, "old"), newTestCA(t, "new")
+	dir := t.TempDir()
+	files := TLSFiles{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}
+	crt, key := oldCA.issue(t, pkix.Name{CommonName: "localhost"})
+	writeFile(t, files.CertFile, crt)
+	writeFile(t, files.KeyFile, key)
+	base := serveTLS(t, Options{TLS: &files})
+
+	get := func(roots *x509.CertPool) error {
+		res, err := tlsClient(roots, nil, nil).Get(base + "/v1/health")
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	if err := get(oldCA.pool()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files are rotated in place; bump the mtime in case the clock is coarse
+	crt, key = newCA.issue(t, pkix.Name{CommonName: "localhost"})
+	writeFile(t, files.CertFile, crt)
+	writeFile(t, files.KeyFile, key)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(files.CertFile, later, later)
+	_ = os.Chtimes(files.KeyFile, later, later)
+	if err := get(newCA.pool()); err != nil {
+		t.Fatalf("rotated certificate not served: %v", err)
+	}
+
+	// a broken rotation keeps serving the last good certificate
+	writeFile(t, files.KeyFile, []byte("garbage"))
+	_ = os.Chtimes(files.KeyFile, later.Add(time.Minute), later.Add(time.Minute))
+	if err := get(newCA.pool()); err != nil {
+		t.Fatalf("after failed reload: %v", err)
+	}
+}
+
+func TestTLS_ReloadChecksFilesAtMostOncePerInterval(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	dir := t.TempDir()
+	files := TLSFiles{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")}
+	crt, key := ca.issue(t, pkix.Name{CommonName: "localhost"})
+	writeFile(t, files.CertFile, crt)
+	writeFile(t, files.KeyFile, key)
+	tf := &tlsFiles{files: files}
+	if err := tf.load(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := tf.certificate(nil)
+
+	crt, key = ca.issue(t, pkix.Name{CommonName: "localhost"})
+	writeFile(t, files.CertFile, crt)
+	writeFile(t, files.KeyFile, key)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(files.CertFile, later, later)
+	_ = os.Chtimes(files.KeyFile, later, later)
+	if got, _ := tf.certificate(nil); got != first {
+		t.Fatal("files checked again within the interval")
+	}
+	tf.checked = tf.checked.Add(-tlsFileCheckEvery)
+	if got, _ := tf.certificate(nil); got == first {
+		t.Fatal("rotated certificate not loaded after the interval")
+	}
+}
+
+func TestNewTLSConfig_Errors(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	dir := t.TempDir()
+	crt, key := ca.issue(t, pkix.Name{CommonName: "localhost"})
+	good := TLSFiles{CertFile: filepath.Join(dir, "s.crt"), KeyFile: filepath.Join(dir, "s.key")}
+	writeFile(t, good.CertFile, crt)
+	writeFile(t, good.KeyFile, key)
+	empty := filepath.Join(dir, "empty.pem")
+	writeFile(t, empty, []byte("no pem here"))
+
+	for name, files := range map[string]TLSFiles{
+		"missing cert": {CertFile: filepath.Join(dir, "nope.crt"), KeyFile: good.KeyFile},
+		"mismatch":     {CertFile: good.CertFile, KeyFile: empty},
+		"missing ca":   {CertFile: good.CertFile, KeyFile: good.KeyFile, ClientCAFile: filepath.Join(dir, "nope.pem")},
+		"empty ca":     {CertFile: good.CertFile, KeyFile: good.KeyFile, ClientCAFile: empty},
+	} {
+		if _, err := newTLSConfig(files, false); err == nil {
+			t.Fatalf("%s: want error", name)
+		}
+	}
+	if err := Start(context.Background(), ":0", service.New(storage.NewMemory(), fakeAlgs, nil),
+		Options{TLS: &TLSFiles{CertFile: good.CertFile, KeyFile: empty}}, true); err == nil {
+		t.Fatal("Start should fail on an unusable key")
+	}
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// CertCaller maps a verified TLS client certificate to a caller: the first
+// Organization (O) of the subject is the tenant, Organizational Units (OU)
+// naming a scope are its scopes, and the subject DN is the principal
+// "cert:<subject>", e.g. "cert:CN=till-7,OU=devices:sign,O=acme".
+func CertCaller(cert *x509.Certificate) (service.Caller, error) {
+	if len(cert.Subject.Organization) == 0 || !domain.ValidTenant(cert.Subject.Organization[0]) {
+		return service.Caller{}, fmt.Errorf("%w: client certificate %q has no valid O (tenant)", ErrInvalidCredential, cert.Subject)
+	}
+	var scopes []service.Scope
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if s := service.Scope(ou); service.ValidScope(s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return service.Caller{Tenant: cert.Subject.Organization[0], Principal: "cert:" + cert.Subject.String(), Scopes: scopes}, nil
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+func TestCertCaller(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "till-7", Organization: []string{"acme", "ignored"},
+		OrganizationalUnit: []string{"devices:sign", "finance", "devices:read"}}}
+	c, err := CertCaller(cert)
+	if err != nil || c.Tenant != "acme" || c.Principal != "cert:CN=till-7,OU=devices:sign+OU=finance+OU=devices:read,O=acme+O=ignored" ||
+		len(c.Scopes) != 2 || !c.Can(service.ScopeSign) || c.Can(service.ScopeAdmin) {
+		t.Fatalf("caller=%+v err=%v", c, err)
+	}
+
+	for name, subject := range map[string]pkix.Name{
+		"no O":    {CommonName: "x"},
+		"bad O":   {CommonName: "x", Organization: []string{"a/b"}},
+		"empty O": {CommonName: "x", Organization: []string{""}},
+	} {
+		if _, err := CertCaller(&x509.Certificate{Subject: subject}); !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	if _, err := (Credentials{}).AuthenticateCert(cert); !errors.Is(err, ErrInvalidCredential) {
+		t.Fatalf("client certificates off: %v", err)
+	}
+	if c, err := (Credentials{ClientCerts: true}).AuthenticateCert(cert); err != nil || c.Tenant != "acme" {
+		t.Fatalf("client certificates on: %+v %v", c, err)
+	}
+}
@@ -0,0 +1,37 @@
+// Package auth turns request credentials into service callers.
+package auth
+
+import (
+	"crypto/x509"
+	"strings"
+
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// Credentials accepts API keys and JWT bearer tokens side by side, telling
+// them apart by form, and verified TLS client certificates. Each kind is off
+// while its field is unset.
+type Credentials struct {
+	Keys        *KeyStore
+	JWT         *JWTVerifier
+	ClientCerts bool
+}
+
+// Authenticate resolves cred with the verifier for its kind.
+func (c Credentials) Authenticate(cred string) (service.Caller, error) {
+	switch {
+	case c.Keys != nil && strings.HasPrefix(cred, keyPrefix):
+		return c.Keys.Authenticate(cred)
+	case c.JWT != nil && strings.Count(cred, ".") == 2:
+		return c.JWT.Authenticate(cred)
+	}
+	return service.Caller{}, ErrInvalidCredential
+}
+
+// AuthenticateCert resolves a client certificate the TLS layer verified.
+func (c Credentials) AuthenticateCert(cert *x509.Certificate) (service.Caller, error) {
+	if !c.ClientCerts {
+		return service.Caller{}, ErrInvalidCredential
+	}
+	return CertCaller(cert)
+}
@@ -0,0 +1,380 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// JWTConfig configures JWTVerifier.
+type JWTConfig struct {
+	// JWKS is a file path or an http(s) URL serving the issuer's JSON Web Key Set.
+	JWKS string
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// TenantClaim names the claim holding the tenant (default "tenant").
+	TenantClaim string
+	// ScopeClaim names the claim holding the scopes, either a space-separated
+	// string or an array (default "scope").
+	ScopeClaim string
+}
+
+const (
+	// jwksMaxAge is how long fetched keys are used before they are fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh limits refetches for tokens signed with an unknown kid.
+	jwksMinRefresh = time.Minute
+	// clockSkew is tolerated on exp and nbf.
+	clockSkew = time.Minute
+)
+
+// httpClient fetches JWKS URLs.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// JWTVerifier authenticates RS256 and ES256 signed JWT bearer tokens against
+// a JWKS. Keys are refetched hourly and when a token names an unknown kid, so
+// the issuer can rotate keys without a restart. One request at a time
+// fetches, without holding the lock; tokens whose key is cached are verified
+// meanwhile, and only those waiting for an unknown kid wait for the fetch.
+type JWTVerifier struct {
+	cfg JWTConfig // not changed after NewJWTVerifier
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	fetched    time.Time
+	refreshing chan struct{} // closed when the fetch in progress ends
+
+	now func() time.Time
+}
+
+// NewJWTVerifier loads the key set once, so a bad -jwks fails at startup.
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "tenant"
+	}
+	if cfg.ScopeClaim == "" {
+		cfg.ScopeClaim = "scope"
+	}
+	v := &JWTVerifier{cfg: cfg, now: time.Now}
+	keys, err := loadJWKS(cfg.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, v.now()
+	return v, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate verifies token and maps its claims to a caller: the tenant
+// claim becomes the tenant, known scopes in the scope claim become scopes
+// and the subject becomes the principal "jwt:<sub>".
+func (v *JWTVerifier) Authenticate(token string) (service.Caller, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return service.Caller{}, ErrInvalidCredential
+	}
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return service.Caller{}, fmt.Errorf("%w: header: %v", ErrInvalidCredential, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return service.Caller{}, fmt.Errorf("%w: signature encoding", ErrInvalidCredential)
+	}
+	key, err := v.key(hdr.Kid)
+	if err != nil {
+		return service.Caller{}, err
+	}
+	if err := verifyJWS(hdr.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return service.Caller{}, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return service.Caller{}, fmt.Errorf("%w: claims: %v", ErrInvalidCredential, err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return service.Caller{}, err
+	}
+	tenant, _ := claims[v.cfg.TenantClaim].(string)
+	if !domain.ValidTenant(tenant) {
+		return service.Caller{}, fmt.Errorf("%w: missing or invalid %q claim", ErrInvalidCredential, v.cfg.TenantClaim)
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return service.Caller{}, fmt.Errorf("%w: missing sub claim", ErrInvalidCredential)
+	}
+	return service.Caller{Tenant: tenant, Principal: "jwt:" + sub, Scopes: scopesOf(claims[v.cfg.ScopeClaim])}, nil
+}
+
+// checkClaims validates exp (required), nbf, iss and aud.
+func (v *JWTVerifier) checkClaims(claims map[string]any) error {
+	now := v.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidCredential)
+	}
+	if now.After(unixTime(exp).Add(clockSkew)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidCredential)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(unixTime(nbf)) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidCredential)
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %v", ErrInvalidCredential, claims["iss"])
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return fmt.Errorf("%w: audience does not include %q", ErrInvalidCredential, v.cfg.Audience)
+	}
+	return nil
+}
+
+// key returns the public key for kid, refetching the set when it is stale
+// or does not know kid. Tokens without a kid need a set of exactly one key.
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	k, known := v.lookup(kid)
+	since := v.now().Sub(v.fetched)
+	if since <= jwksMaxAge && (known || since <= jwksMinRefresh) {
+		v.mu.Unlock()
+		return foundKey(kid, k, known)
+	}
+	if done := v.refreshing; done != nil {
+		v.mu.Unlock()
+		if !known {
+			<-done
+			return v.cached(kid)
+		}
+		return k, nil
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	v.mu.Unlock()
+
+	keys, err := loadJWKS(v.cfg.JWKS)
+	v.mu.Lock()
+	if err != nil {
+		log.Printf("jwks: refresh failed, keeping %d cached keys: %v", len(v.keys), err)
+	} else {
+		v.keys = keys
+	}
+	v.fetched, v.refreshing = v.now(), nil
+	v.mu.Unlock()
+	close(done)
+	return v.cached(kid)
+}
+
+// cached looks kid up in the current set.
+func (v *JWTVerifier) cached(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	k, ok := v.lookup(kid)
+	v.mu.Unlock()
+	return foundKey(kid, k, ok)
+}
+
+func foundKey(kid string, k crypto.PublicKey, ok bool) (crypto.PublicKey, error) {
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidCredential, kid)
+	}
+	return k, nil
+}
+
+// lookup requires v.mu.
+func (v *JWTVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+// verifyJWS checks sig over input. The algorithm must match the key type, so
+// a token cannot pick a weaker check than its key was published for.
+func verifyJWS(alg string, key crypto.PublicKey, input string, sig []byte) error {
+	digest := sha256.Sum256([]byte(input))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return fmt.Errorf("%w: bad signature", ErrInvalidCredential)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		// JWS carries r||s, not ASN.1
+		if len(sig) != 64 || !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return fmt.Errorf("%w: bad signature", ErrInvalidCredential)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: algorithm %q not accepted for this key", ErrInvalidCredential, alg)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS reads a key set from a file or URL. Keys it cannot use (other key
+// types or curves, encryption keys) are skipped; a set without usable keys
+// is an error.
+func loadJWKS(src string) (map[string]crypto.PublicKey, error) {
+	var raw []byte
+	var err error
+	if strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://") {
+		raw, err = fetch(src)
+	} else {
+		raw, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("jwks: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks: no usable RSA or P-256 signing keys")
+	}
+	return keys, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	res, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("bad RSA modulus or exponent")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is too short", pub.N.BitLen())
+		}
+		return pub, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("bad EC point")
+		}
+		// ecdh rejects points that are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeSegment(seg string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func unixTime(sec float64) time.Time { return time.Unix(int64(sec), 0) }
+
+func hasAudience(aud any, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []any:
+		for _, v := range a {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopesOf reads a space-separated string or an array of scopes, keeping
+// only the ones this service knows.
+func scopesOf(claim any) []service.Scope {
+	var names []string
+	switch c := claim.(type) {
+	case string:
+		names = strings.Fields(c)
+	case []any:
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	var out []service.Scope
+	for _, n := range names {
+		if s := service.Scope(n); service.ValidScope(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
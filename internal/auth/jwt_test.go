@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+var (
+	testKeysOnce sync.Once
+	testRSA      *rsa.PrivateKey
+	testEC       *ecdsa.PrivateKey
+)
+
+// testKeys returns an RSA and a P-256 key, generated once per test binary.
+func testKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		testRSA, _ = rsa.GenerateKey(rand.Reader, 2048)
+		testEC, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	})
+	return testRSA, testEC
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func pad32(n *big.Int) []byte {
+	out := make([]byte, 32)
+	n.FillBytes(out)
+	return out
+}
+
+// jwksJSON publishes the public halves of keys under their kids.
+func jwksJSON(keys map[string]crypto.Signer) []byte {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, k := range keys {
+		switch pub := k.Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+				"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": b64(pad32(pub.X)), "y": b64(pad32(pub.Y))})
+		}
+	}
+	raw, _ := json.Marshal(set)
+	return raw
+}
+
+// signJWT builds a compact JWS over claims with key, the way an issuer would.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	input := b64(hdr) + "." + b64(body)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = append(pad32(r), pad32(s)...)
+	}
+	return input + "." + b64(sig)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(jwksJSON(map[string]crypto.Signer{"r1": rsaKey, "e1": ecKey}))
+	}))
+	defer ts.Close()
+	v, err := NewJWTVerifier(JWTConfig{JWKS: ts.URL, Issuer: "https://idp", Audience: "signer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	v.now = func() time.Time { return now }
+
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": "https://idp", "aud": []string{"other", "signer"}, "sub": "till-7",
+			"tenant": "acme", "scope": "devices:sign devices:read openid", "exp": now.Add(time.Hour).Unix()}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{{"RS256", "r1", rsaKey}, {"ES256", "e1", ecKey}} {
+		c, err := v.Authenticate(signJWT(t, tc.alg, tc.kid, tc.key, claims(nil)))
+		if err != nil || c.Tenant != "acme" || c.Principal != "jwt:till-7" || len(c.Scopes) != 2 ||
+			!c.Can(service.ScopeSign) || c.Can(service.ScopeAdmin) {
+			t.Fatalf("%s: caller=%+v err=%v", tc.alg, c, err)
+		}
+	}
+	if c, err := v.Authenticate(signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) {
+		c["scope"] = []string{"admin"}
+	}))); err != nil || !c.Can(service.ScopeAdmin) {
+		t.Fatalf("array scope: %+v %v", c, err)
+	}
+
+	good := signJWT(t, "RS256", "r1", rsaKey, claims(nil))
+	parts := strings.Split(good, ".")
+	forged, _ := json.Marshal(claims(func(c map[string]any) { c["tenant"] = "globex" }))
+	for name, token := range map[string]string{
+		"expired":       signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["exp"] = now.Add(-2 * time.Minute).Unix() })),
+		"no exp":        signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { delete(c, "exp") })),
+		"not yet":       signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() })),
+		"issuer":        signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["iss"] = "https://evil" })),
+		"audience":      signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["aud"] = "other" })),
+		"no tenant":     signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { delete(c, "tenant") })),
+		"bad tenant":    signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["tenant"] = "a/b" })),
+		"no sub":        signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { delete(c, "sub") })),
+		"alg mismatch":  signJWT(t, "ES256", "r1", ecKey, claims(nil)),
+		"unknown kid":   signJWT(t, "RS256", "r9", rsaKey, claims(nil)),
+		"tampered":      parts[0] + "." + b64(forged) + "." + parts[2],
+		"alg none":      b64([]byte(`{"alg":"none","kid":"r1"}`)) + "." + parts[1] + ".",
+		"hs256":         b64([]byte(`{"alg":"HS256","kid":"r1"}`)) + "." + parts[1] + "." + parts[2],
+		"two parts":     parts[0] + "." + parts[1],
+		"bad header":    "e30x." + parts[1] + "." + parts[2],
+		"bad signature": parts[0] + "." + parts[1] + ".***",
+	} {
+		if _, err := v.Authenticate(token); !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("%s: want ErrInvalidCredential, got %v", name, err)
+		}
+	}
+}
+
+func TestJWTVerifier_RotationFromFile(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	_ = os.WriteFile(path, jwksJSON(map[string]crypto.Signer{"old": rsaKey}), 0o600)
+	v, err := NewJWTVerifier(JWTConfig{JWKS: path, TenantClaim: "org", ScopeClaim: "scp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	claims := map[string]any{"sub": "s", "org": "acme", "scp": []string{"devices:read"}, "exp": now.Add(24 * time.Hour).Unix()}
+
+	// a single key also verifies tokens without a kid
+	if c, err := v.Authenticate(signJWT(t, "RS256", "", rsaKey, claims)); err != nil || c.Tenant != "acme" || !c.Can(service.ScopeRead) {
+		t.Fatalf("no kid: %+v %v", c, err)
+	}
+
+	// the issuer rotates to a new key; unknown kids refetch at most once a minute
+	_ = os.WriteFile(path, jwksJSON(map[string]crypto.Signer{"new": ecKey}), 0o600)
+	rotated := signJWT(t, "ES256", "new", ecKey, claims)
+	if _, err := v.Authenticate(rotated); err == nil {
+		t.Fatal("refetched too early")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := v.Authenticate(rotated); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+
+	// a broken set keeps the cached keys
+	_ = os.WriteFile(path, []byte("{"), 0o600)
+	now = now.Add(2 * time.Hour)
+	if _, err := v.Authenticate(rotated); err != nil {
+		t.Fatalf("after failed refresh: %v", err)
+	}
+}
+
+func TestJWTVerifier_RefreshDoesNotBlockCachedKeys(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	var fetches atomic.Int32
+	gate := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-gate // a slow identity provider
+		}
+		_, _ = w.Write(jwksJSON(map[string]crypto.Signer{"r1": rsaKey, "e1": ecKey}))
+	}))
+	defer ts.Close()
+	v, err := NewJWTVerifier(JWTConfig{JWKS: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(2 * time.Minute) // past jwksMinRefresh
+	v.now = func() time.Time { return now }
+	claims := map[string]any{"sub": "s", "tenant": "acme", "exp": now.Add(time.Hour).Unix()}
+
+	// tokens with an unknown kid refetch, but only one of them
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.Authenticate(signJWT(t, "ES256", "gone", ecKey, claims)); err == nil {
+				t.Error("unknown kid accepted")
+			}
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// a cached key keeps working while the fetch hangs
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.Authenticate(signJWT(t, "RS256", "r1", rsaKey, claims))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached key blocked behind the JWKS fetch")
+	}
+	close(gate)
+	wg.Wait()
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+}
+
+func TestLoadJWKS_Errors(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		_ = os.WriteFile(p, []byte(body), 0o600)
+		return p
+	}
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	for name, src := range map[string]string{
+		"missing file": filepath.Join(dir, "nope.json"),
+		"http 404":     ts.URL,
+		"not json":     write("a.json", "["),
+		"no keys":      write("b.json", `{"keys":[]}`),
+		"unsupported":  write("c.json", `{"keys":[{"kty":"oct","k":"c2VjcmV0"},{"kty":"EC","crv":"P-384","x":"AA","y":"AA"}]}`),
+		"enc only":     write("d.json", strings.Replace(string(jwksJSON(map[string]crypto.Signer{"k": rsaKey})), `"use":"sig"`, `"use":"enc"`, 1)),
+		"off curve":    write("e.json", `{"keys":[{"kty":"EC","crv":"P-256","x":"`+b64(make([]byte, 32))+`","y":"`+b64(make([]byte, 32))+`"}]}`),
+		"short rsa":    write("f.json", string(jwksJSON(map[string]crypto.Signer{"k": small}))),
+	} {
+		if _, err := NewJWTVerifier(JWTConfig{JWKS: src}); err == nil {
+			t.Fatalf("%s: want error", name)
+		}
+	}
+}
+
+func TestCredentials_Dispatch(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	_ = os.WriteFile(path, jwksJSON(map[string]crypto.Signer{"k": rsaKey}), 0o600)
+	v, _ := NewJWTVerifier(JWTConfig{JWKS: path})
+	ks := NewKeyStore()
+	_, secret, _ := ks.Issue("acme", "", []service.Scope{service.ScopeRead})
+	token := signJWT(t, "RS256", "k", rsaKey, map[string]any{"sub": "s", "tenant": "globex", "exp": time.Now().Add(time.Hour).Unix()})
+
+	both := Credentials{Keys: ks, JWT: v}
+	if c, err := both.Authenticate(secret); err != nil || c.Tenant != "acme" {
+		t.Fatalf("key: %+v %v", c, err)
+	}
+	if c, err := both.Authenticate(token); err != nil || c.Tenant != "globex" {
+		t.Fatalf("jwt: %+v %v", c, err)
+	}
+	if _, err := (Credentials{Keys: ks}).Authenticate(token); !errors.Is(err, ErrInvalidCredential) {
+		t.Fatalf("jwt without verifier: %v", err)
+	}
+	if _, err := (Credentials{JWT: v}).Authenticate(secret); !errors.Is(err, ErrInvalidCredential) {
+		t.Fatalf("key without store: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+// ErrInvalidCredential is returned for unknown, revoked or malformed credentials.
+var ErrInvalidCredential = errors.New("invalid credential")
+
+// keyPrefix marks API key secrets, so they are recognisable in configs and logs.
+const keyPrefix = "sk_"
+
+// keyFileCheckEvery bounds how often Authenticate looks for changes to the
+// key file, so requests do not all queue behind a stat of it.
+const keyFileCheckEvery = time.Second
+
+// Key is an issued API key. The secret itself is never stored, only its
+// SHA-256 hash: keys are 256 random bits, so a fast hash is enough.
+type Key struct {
+	ID        string          `json:"id"`
+	Tenant    string          `json:"tenant"`
+	Name      string          `json:"name,omitempty"`
+	Scopes    []service.Scope `json:"scopes"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Caller is who requests authenticated with k act for.
+func (k Key) Caller() service.Caller {
+	return service.Caller{Tenant: k.Tenant, Principal: "key:" + k.ID, Scopes: k.Scopes}
+}
+
+type storedKey struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+type keyFile struct {
+	Keys []storedKey `json:"keys"`
+}
+
+// KeyStore holds API keys, optionally persisted to a JSON file. Changes
+// written to the file by another process (the apikey CLI) are picked up
+// within keyFileCheckEvery, so keys can be issued and revoked without a
+// restart. Issue and Revoke hold an advisory lock on "<file>.lock" while
+// they read, change and rewrite the file, so concurrent writers in
+// different processes do not undo each other's changes.
+type KeyStore struct {
+	mu      sync.RWMutex
+	path    string
+	stat    os.FileInfo
+	checked time.Time // last look at the file
+	byHash  map[string]Key
+
+	now func() time.Time
+}
+
+// NewKeyStore returns an empty store that lives in memory only.
+func NewKeyStore() *KeyStore { return &KeyStore{byHash: map[string]Key{}, now: time.Now} }
+
+// OpenKeyStore loads the keys in path. A missing file is an empty store and
+// is created on the first Issue.
+func OpenKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path, byHash: map[string]Key{}, now: time.Now}
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Authenticate resolves an API key secret to the caller it acts for.
+func (ks *KeyStore) Authenticate(secret string) (service.Caller, error) {
+	if !strings.HasPrefix(secret, keyPrefix) {
+		return service.Caller{}, ErrInvalidCredential
+	}
+	h := hashSecret(secret)
+	ks.mu.RLock()
+	stale := ks.path != "" && ks.now().Sub(ks.checked) >= keyFileCheckEvery
+	k, ok := ks.byHash[h]
+	ks.mu.RUnlock()
+	if stale {
+		ks.mu.Lock()
+		err := ks.refresh()
+		k, ok = ks.byHash[h]
+		ks.mu.Unlock()
+		if err != nil {
+			return service.Caller{}, err
+		}
+	}
+	if !ok {
+		return service.Caller{}, ErrInvalidCredential
+	}
+	return k.Caller(), nil
+}
+
+// Issue creates a key for tenant with the given scopes and returns it with
+// its secret. The secret cannot be recovered later.
+func (ks *KeyStore) Issue(tenant, name string, scopes []service.Scope) (Key, string, error) {
+	if !domain.ValidTenant(tenant) {
+		return Key{}, "", fmt.Errorf("%w: invalid tenant %q", domain.ErrInvalidInput, tenant)
+	}
+	if len(scopes) == 0 {
+		return Key{}, "", fmt.Errorf("%w: at least one scope is required", domain.ErrInvalidInput)
+	}
+	for _, s := range scopes {
+		if !service.ValidScope(s) {
+			return Key{}, "", fmt.Errorf("%w: unknown scope %q", domain.ErrInvalidInput, s)
+		}
+	}
+	var id [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return Key{}, "", err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return Key{}, "", err
+	}
+	k := Key{
+		ID: hex.EncodeToString(id[:]), Tenant: tenant, Name: name,
+		Scopes: append([]service.Scope(nil), scopes...), CreatedAt: ks.now().UTC(),
+	}
+	plain := keyPrefix + base64.RawURLEncoding.EncodeToString(secret[:])
+
+	err := ks.change(func() (bool, error) {
+		ks.byHash[hashSecret(plain)] = k
+		return true, nil
+	})
+	if err != nil {
+		return Key{}, "", err
+	}
+	return k, plain, nil
+}
+
+// List returns the tenant's keys ordered by creation, or every key when
+// tenant is empty.
+func (ks *KeyStore) List(tenant string) ([]Key, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	out := []Key{}
+	for _, k := range ks.byHash {
+		if tenant == "" || k.Tenant == tenant {
+			out = append(out, k)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return lessKey(out[i], out[j]) })
+	return out, nil
+}
+
+// Revoke deletes the tenant's key id. Requests using it fail from then on;
+// servers sharing the key file notice within keyFileCheckEvery.
+func (ks *KeyStore) Revoke(tenant, id string) error {
+	return ks.change(func() (bool, error) {
+		for h, k := range ks.byHash {
+			if k.ID == id && k.Tenant == tenant {
+				delete(ks.byHash, h)
+				return true, nil
+			}
+		}
+		return false, domain.ErrNotFound
+	})
+}
+
+// change applies fn to the latest keys and saves them if fn reports a
+// change. The file is locked across the read and the write, so a concurrent
+// change from another process is never overwritten. If saving fails the
+// keys are reloaded from the file.
+func (ks *KeyStore) change(fn func() (bool, error)) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.path == "" {
+		_, err := fn()
+		return err
+	}
+	unlock, err := lockFile(ks.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ks.stat = nil // reread even if mtime and size look unchanged
+	if err := ks.refresh(); err != nil {
+		return err
+	}
+	changed, err := fn()
+	if err != nil || !changed {
+		return err
+	}
+	if err := ks.save(); err != nil {
+		ks.stat = nil
+		_ = ks.refresh()
+		return err
+	}
+	return nil
+}
+
+// refresh reloads the file when it changed since it was last read or written.
+func (ks *KeyStore) refresh() error {
+	if ks.path == "" {
+		return nil
+	}
+	ks.checked = ks.now()
+	st, err := os.Stat(ks.path)
+	if errors.Is(err, os.ErrNotExist) {
+		ks.stat, ks.byHash = nil, map[string]Key{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ks.stat != nil && st.ModTime().Equal(ks.stat.ModTime()) && st.Size() == ks.stat.Size() {
+		return nil
+	}
+	raw, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+	var f keyFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return fmt.Errorf("reading %s: %w", ks.path, err)
+	}
+	ks.byHash = make(map[string]Key, len(f.Keys))
+	for _, sk := range f.Keys {
+		ks.byHash[sk.Hash] = sk.Key
+	}
+	ks.stat = st
+	return nil
+}
+
+// save atomically replaces the file with the keys in memory.
+func (ks *KeyStore) save() error {
+	if ks.path == "" {
+		return nil
+	}
+	f := keyFile{Keys: make([]storedKey, 0, len(ks.byHash))}
+	for h, k := range ks.byHash {
+		f.Keys = append(f.Keys, storedKey{Key: k, Hash: h})
+	}
+	sort.Slice(f.Keys, func(i, j int) bool { return lessKey(f.Keys[i].Key, f.Keys[j].Key) })
+	raw, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ks.path), filepath.Base(ks.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(raw, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), ks.path); err != nil {
+		return err
+	}
+	ks.stat, err = os.Stat(ks.path)
+	return err
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func lessKey(a, b Key) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+)
+
+func TestKeyStore_IssueAuthenticateRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	ks, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, secret, err := ks.Issue("acme", "till", []service.Scope{service.ScopeSign})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ks.Authenticate(secret)
+	if err != nil || c.Tenant != "acme" || c.Principal != "key:"+k.ID || !c.Can(service.ScopeSign) || c.Can(service.ScopeRead) {
+		t.Fatalf("caller=%+v err=%v", c, err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), secret) || !strings.Contains(string(raw), hashSecret(secret)) {
+		t.Fatalf("file must hold the hash, not the secret: %s", raw)
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("key file mode %v", st.Mode())
+	}
+
+	// a second store on the same file sees the key and revokes it for both
+	other, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := other.List("acme"); len(keys) != 1 || keys[0].ID != k.ID {
+		t.Fatalf("list=%+v", keys)
+	}
+	if err := other.Revoke("globex", k.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("revoke from another tenant: %v", err)
+	}
+	if err := other.Revoke("acme", k.ID); err != nil {
+		t.Fatal(err)
+	}
+	// the first store looks at the file again once keyFileCheckEvery has passed
+	if _, err := ks.Authenticate(secret); err != nil {
+		t.Fatalf("file checked again too early: %v", err)
+	}
+	ks.now = func() time.Time { return time.Now().Add(keyFileCheckEvery) }
+	if _, err := ks.Authenticate(secret); !errors.Is(err, ErrInvalidCredential) {
+		t.Fatalf("revoked key: %v", err)
+	}
+}
+
+func TestKeyStore_ConcurrentWritersKeepEveryChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		ks, err := OpenKeyStore(path) // one store per writer, like separate processes
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, _, err := ks.Issue("acme", "", []service.Scope{service.ScopeRead}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	ks, _ := OpenKeyStore(path)
+	if keys, _ := ks.List("acme"); len(keys) != 40 {
+		t.Fatalf("%d keys survived, want 40", len(keys))
+	}
+}
+
+func TestKeyStore_Rejects(t *testing.T) {
+	ks := NewKeyStore()
+	for name, tc := range map[string]struct {
+		tenant string
+		scopes []service.Scope
+	}{
+		"tenant":    {"a b", []service.Scope{service.ScopeAdmin}},
+		"no scopes": {"acme", nil},
+		"scope":     {"acme", []service.Scope{"devices:delete"}},
+	} {
+		if _, _, err := ks.Issue(tc.tenant, "", tc.scopes); !errors.Is(err, domain.ErrInvalidInput) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for _, secret := range []string{"", "sk_unknown", "not-a-key"} {
+		if _, err := ks.Authenticate(secret); !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("%q: %v", secret, err)
+		}
+	}
+
+	bad := filepath.Join(t.TempDir(), "keys.json")
+	_ = os.WriteFile(bad, []byte("{"), 0o600)
+	if _, err := OpenKeyStore(bad); err == nil {
+		t.Fatal("expected error for a corrupt key file")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package auth
+
+// lockFile is a no-op where flock is unavailable: there, issuing or revoking
+// keys from two processes at once can lose one of the changes.
+func lockFile(string) (func(), error) { return func() {}, nil }
@@ -0,0 +1,172 @@
+// Package chain verifies exported signature logs offline: every signature,
+// gap-free counters and the link from each payload to the previous signature.
+package chain
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+// Break is one place where a chain fails verification.
+type Break struct {
+	Index   int // position in the log, 0-based
+	Counter uint64
+	Reason  string
+}
+
+func (b Break) String() string {
+	return fmt.Sprintf("counter %d (record #%d): %s", b.Counter, b.Index, b.Reason)
+}
+
+// Verifier checks a device's signature log against its public keys.
+type Verifier struct {
+	DeviceID string
+	Scheme   domain.Scheme
+	Format   domain.PayloadFormat
+	// Keys is the device's key history. A record is checked with the key its
+	// key_id names, else with the keys whose counter range contains it.
+	Keys         []domain.DeviceKey
+	VerifyPublic func(publicPEM string, sc domain.Scheme, payload, sig []byte) (bool, error)
+}
+
+// Check verifies recs, which must be consecutive journal records oldest
+// first, and returns every break found. After a break checking continues
+// from the record as logged, so one bad entry is reported once.
+func (v Verifier) Check(recs []domain.SignatureRecord) []Break {
+	var breaks []Break
+	report := func(i int, rec domain.SignatureRecord, format string, args ...any) {
+		breaks = append(breaks, Break{Index: i, Counter: rec.Counter, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	for i, rec := range recs {
+		if i > 0 && rec.Counter != recs[i-1].Counter+1 {
+			report(i, rec, "counter does not follow %d", recs[i-1].Counter)
+		}
+
+		p, err := v.Format.Decode(rec.SignedData)
+		switch {
+		case err != nil:
+			report(i, rec, "signed_data: %v", err)
+		default:
+			if p.Counter != rec.Counter {
+				report(i, rec, "signed_data is for counter %d", p.Counter)
+			}
+			if rec.Data != "" && p.Data != rec.Data {
+				report(i, rec, "signed_data does not contain the record's data")
+			}
+			if want, ok := v.previous(recs, i); ok && p.Prev != want {
+				report(i, rec, "references previous signature %q, want %q", abbrev(p.Prev), abbrev(want))
+			}
+		}
+
+		if reason := v.checkSignature(rec); reason != "" {
+			report(i, rec, "%s", reason)
+		}
+	}
+	return breaks
+}
+
+// previous returns the signature record i must reference. The first record of
+// a log that starts mid-chain has nothing to compare against.
+func (v Verifier) previous(recs []domain.SignatureRecord, i int) (string, bool) {
+	if recs[i].Counter == 0 {
+		return domain.InitialLastSignature(v.DeviceID), true
+	}
+	if i == 0 {
+		return "", false
+	}
+	return recs[i-1].Signature, true
+}
+
+func (v Verifier) checkSignature(rec domain.SignatureRecord) string {
+	sig, err := base64.StdEncoding.DecodeString(rec.Signature)
+	if err != nil || len(sig) == 0 {
+		return "signature is not base64"
+	}
+	keys := v.keysFor(rec)
+	if len(keys) == 0 {
+		return fmt.Sprintf("no public key for key_id %q", rec.KeyID)
+	}
+	for _, k := range keys {
+		ok, err := v.VerifyPublic(k.PublicKeyPEM, v.Scheme, []byte(rec.SignedData), sig)
+		if err != nil {
+			return fmt.Sprintf("key %s: %v", k.ID, err)
+		}
+		if ok {
+			return ""
+		}
+	}
+	return "signature does not verify"
+}
+
+func (v Verifier) keysFor(rec domain.SignatureRecord) []domain.DeviceKey {
+	if rec.KeyID != "" {
+		for _, k := range v.Keys {
+			if k.ID == rec.KeyID {
+				return []domain.DeviceKey{k}
+			}
+		}
+	}
+	var out []domain.DeviceKey
+	for _, k := range v.Keys {
+		if rec.Counter >= k.FirstCounter && (k.UntilCounter == nil || rec.Counter < *k.UntilCounter) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func abbrev(s string) string {
+	if len(s) > 16 {
+		return s[:16] + "..."
+	}
+	return s
+}
+
+// ReadLog decodes an exported signature log: JSON arrays of records, pages
+// as returned by GET /v1/devices/{id}/signatures, or one record per line, in
+// any concatenation.
+func ReadLog(r io.Reader) ([]domain.SignatureRecord, error) {
+	dec := json.NewDecoder(r)
+	var out []domain.SignatureRecord
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch strings.TrimSpace(string(raw))[0] {
+		case '[':
+			var recs []domain.SignatureRecord
+			if err := json.Unmarshal(raw, &recs); err != nil {
+				return nil, err
+			}
+			out = append(out, recs...)
+		case '{':
+			var page struct {
+				Signatures *[]domain.SignatureRecord `json:"signatures"`
+			}
+			if err := json.Unmarshal(raw, &page); err != nil {
+				return nil, err
+			}
+			if page.Signatures != nil {
+				out = append(out, *page.Signatures...)
+				continue
+			}
+			var rec domain.SignatureRecord
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return nil, err
+			}
+			out = append(out, rec)
+		default:
+			return nil, fmt.Errorf("unexpected JSON value in log: %.20s", raw)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package chain
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/crypto"
+	"github.com/oxygenesis/signature/internal/domain"
+	"github.com/oxygenesis/signature/internal/service"
+	"github.com/oxygenesis/signature/internal/storage"
+)
+
+// dflt is the caller the tests act for.
+var dflt = service.Caller{Tenant: domain.DefaultTenant, Scopes: []service.Scope{service.ScopeAdmin}}
+
+type fixedID struct{}
+
+func (fixedID) New() string { return "id" }
+
+// signedChain signs five items with a key rotation after the second.
+func signedChain(t *testing.T, format domain.PayloadFormat) (Verifier, []domain.SignatureRecord) {
+	t.Helper()
+	svc := service.New(storage.NewMemory(), crypto.Default(), fixedID{})
+	if _, err := svc.CreateDevice(dflt, service.CreateDeviceRequest{ID: "dev", Algorithm: domain.AlgEd25519, PayloadFormat: format}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = svc.SignBatch(dflt, "dev", []string{"a", "b_with_underscores"})
+	if _, err := svc.RotateKey(dflt, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = svc.SignBatch(dflt, "dev", []string{"c", "d", "e"})
+	dev, _ := svc.GetDevice(dflt, "dev")
+	recs, _ := svc.ListSignatures(dflt, "dev", storage.AllSignatures)
+	return Verifier{DeviceID: dev.ID, Scheme: dev.Scheme, Format: dev.PayloadFormat, Keys: dev.Keys, VerifyPublic: crypto.VerifyPublic}, recs
+}
+
+func TestCheck_IntactChain(t *testing.T) {
+	for _, f := range []domain.PayloadFormat{domain.PayloadV0, domain.PayloadV1} {
+		v, recs := signedChain(t, f)
+		if b := v.Check(recs); len(b) != 0 {
+			t.Fatalf("%s: unexpected breaks: %v", f, b)
+		}
+		// a log exported from the middle anchors on its first record
+		if b := v.Check(recs[2:]); len(b) != 0 {
+			t.Fatalf("%s tail: %v", f, b)
+		}
+	}
+	// checking with the wrong format flags every record
+	v, recs := signedChain(t, domain.PayloadV1)
+	v.Format = domain.PayloadV0
+	if b := v.Check(recs); len(b) != len(recs) {
+		t.Fatalf("wrong format: %v", b)
+	}
+}
+
+func TestCheck_ReportsWhereTheChainBreaks(t *testing.T) {
+	cases := []struct {
+		name    string
+		tamper  func([]domain.SignatureRecord) []domain.SignatureRecord
+		counter uint64
+		reason  string
+	}{
+		{"gap", func(r []domain.SignatureRecord) []domain.SignatureRecord {
+			return append(r[:2:2], r[3:]...)
+		}, 3, "counter does not follow 1"},
+		{"data", func(r []domain.SignatureRecord) []domain.SignatureRecord {
+			r[1].Data = "forged"
+			return r
+		}, 1, "does not contain the record's data"},
+		{"previous signature", func(r []domain.SignatureRecord) []domain.SignatureRecord {
+			r[3].Signature = r[0].Signature
+			return r
+		}, 3, "signature does not verify"},
+		{"wrong key", func(r []domain.SignatureRecord) []domain.SignatureRecord {
+			r[4].KeyID = domain.FirstKeyID
+			return r
+		}, 4, "signature does not verify"},
+		{"garbage payload", func(r []domain.SignatureRecord) []domain.SignatureRecord {
+			r[0].SignedData = "nope"
+			return r
+		}, 0, "not <counter>_<data>"},
+	}
+	for _, c := range cases {
+		v, recs := signedChain(t, domain.PayloadV0)
+		breaks := v.Check(c.tamper(recs))
+		if len(breaks) == 0 || breaks[0].Counter != c.counter || !strings.Contains(breaks[0].Reason, c.reason) {
+			t.Fatalf("%s: breaks %v", c.name, breaks)
+		}
+	}
+
+	// a swapped signature also breaks the link of the record after it
+	v, recs := signedChain(t, domain.PayloadV0)
+	recs[2].Signature = recs[1].Signature
+	breaks := v.Check(recs)
+	if len(breaks) != 2 || breaks[0].Counter != 2 || breaks[1].Counter != 3 || !strings.Contains(breaks[1].Reason, "references previous signature") {
+		t.Fatalf("breaks %v", breaks)
+	}
+}
+
+func TestReadLog(t *testing.T) {
+	in := `[{"counter":0,"signature":"a"}]
+{"signatures":[{"counter":1},{"counter":2}],"next_from":3}
+{"counter":3,"key_id":"k2"}`
+	recs, err := ReadLog(strings.NewReader(in))
+	if err != nil || len(recs) != 4 || recs[3].Counter != 3 || recs[3].KeyID != "k2" {
+		t.Fatalf("recs=%+v err=%v", recs, err)
+	}
+	if _, err := ReadLog(strings.NewReader(`"x"`)); err == nil {
+		t.Fatal("want error for a bare string")
+	}
+}
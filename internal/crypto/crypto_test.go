@@ -2,11 +2,17 @@ package crypto
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"io"
 	"testing"
+
+	"github.com/oxygenesis/signature/internal/domain"
 )
 
 func TestRSAAndECDSA(t *testing.T) {
@@ -28,7 +34,7 @@ func TestRSAAndECDSA(t *testing.T) {
 	}
 
 	// ECDSA
-	es, err := NewECDSASigner()
+	es, err := NewECDSASigner(elliptic.P256())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -44,6 +50,48 @@ func TestRSAAndECDSA(t *testing.T) {
 	}
 }
 
+func TestEd25519Signer(t *testing.T) {
+	s, err := NewEd25519Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := []byte("payload")
+	sig, _ := s.Sign(p)
+	if len(sig) != ed25519.SignatureSize || !s.Verify(p, sig) {
+		t.Fatal("ed25519 verify failed")
+	}
+	if s.Verify([]byte("other"), sig) {
+		t.Fatal("ed25519 verified a different payload")
+	}
+	block, _ := pem.Decode([]byte(s.PublicPEM()))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		t.Fatal("want SPKI PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil || !ed25519.Verify(pub.(ed25519.PublicKey), p, sig) {
+		t.Fatalf("SPKI key does not verify: %v", err)
+	}
+	if s.AlgorithmName() != "ED25519" {
+		t.Fatal("ed25519 meta failed")
+	}
+}
+
+func TestEd25519Signer_New_Errors(t *testing.T) {
+	oldGen := ed25519GenerateKey
+	ed25519GenerateKey = func(io.Reader) (ed25519.PublicKey, ed25519.PrivateKey, error) { return nil, nil, errors.New("gen err") }
+	if _, err := NewEd25519Signer(); err == nil {
+		t.Fatal("want gen err")
+	}
+	ed25519GenerateKey = oldGen
+
+	oldMarshal := marshalPKIXPublicKey
+	marshalPKIXPublicKey = func(any) ([]byte, error) { return nil, errors.New("marshal err") }
+	defer func() { marshalPKIXPublicKey = oldMarshal }()
+	if _, err := NewEd25519Signer(); err == nil {
+		t.Fatal("want marshal err")
+	}
+}
+
 func TestRSASigner_New_Error(t *testing.T) {
 	old := rsaGenerateKey
 	rsaGenerateKey = func(io.Reader, int) (*rsa.PrivateKey, error) { return nil, errors.New("boom") }
@@ -57,7 +105,7 @@ func TestECDSASigner_New_Errors(t *testing.T) {
 	// ecdsa.GenerateKey error
 	oldGen := ecdsaGenerateKey
 	ecdsaGenerateKey = func(curve elliptic.Curve, r io.Reader) (*ecdsa.PrivateKey, error) { return nil, errors.New("gen err") }
-	if _, err := NewECDSASigner(); err == nil {
+	if _, err := NewECDSASigner(elliptic.P256()); err == nil {
 		t.Fatal("want gen err")
 	}
 	ecdsaGenerateKey = oldGen
@@ -66,7 +114,199 @@ func TestECDSASigner_New_Errors(t *testing.T) {
 	oldMarshal := marshalPKIXPublicKey
 	marshalPKIXPublicKey = func(any) ([]byte, error) { return nil, errors.New("marshal err") }
 	defer func() { marshalPKIXPublicKey = oldMarshal }()
-	if _, err := NewECDSASigner(); err == nil {
+	if _, err := NewECDSASigner(elliptic.P256()); err == nil {
+		t.Fatal("want marshal err")
+	}
+}
+
+func TestPEMCodec_RoundTrip(t *testing.T) {
+	rs, _ := NewRSASigner(1024)
+	es, _ := NewECDSASigner(elliptic.P256())
+	eds, _ := NewEd25519Signer()
+	for alg, s := range map[domain.Algorithm]domain.Signer{domain.AlgRSA: rs, domain.AlgECC: es, domain.AlgEd25519: eds} {
+		key, err := PEMCodec{}.MarshalSigner(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := PEMCodec{}.UnmarshalSigner(alg, "", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.PublicPEM() != s.PublicPEM() {
+			t.Fatalf("%s: public key mismatch", alg)
+		}
+	}
+	// algorithm must match the key type
+	key, _ := PEMCodec{}.MarshalSigner(es)
+	if _, err := (PEMCodec{}).UnmarshalSigner(domain.AlgRSA, "", key); !errors.Is(err, domain.ErrInvalidAlgorithm) {
+		t.Fatalf("want ErrInvalidAlgorithm, got %v", err)
+	}
+	if _, err := (PEMCodec{}).UnmarshalSigner(domain.AlgRSA, "", "garbage"); err == nil {
+		t.Fatal("want PEM error")
+	}
+}
+
+type otherSigner struct{ domain.Signer }
+
+func TestPEMCodec_MarshalErrors(t *testing.T) {
+	if _, err := (PEMCodec{}).MarshalSigner(otherSigner{}); err == nil {
+		t.Fatal("want unsupported signer error")
+	}
+	old := marshalPKCS8PrivateKey
+	marshalPKCS8PrivateKey = func(any) ([]byte, error) { return nil, errors.New("marshal err") }
+	defer func() { marshalPKCS8PrivateKey = old }()
+	es, _ := NewECDSASigner(elliptic.P256())
+	if _, err := (PEMCodec{}).MarshalSigner(es); err == nil {
 		t.Fatal("want marshal err")
 	}
 }
+
+func TestSchemes_InteropWithStdlib(t *testing.T) {
+	// PSS with SHA-512 needs room for a 64-byte salt and digest
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("0_data_ZGV2")
+	for name, sc := range rsaSchemes {
+		s, err := withScheme(newRSASigner(rk), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := s.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := digest(sc.hash, payload)
+		if sc.pss {
+			err = rsa.VerifyPSS(&rk.PublicKey, sc.hash, h, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		} else {
+			err = rsa.VerifyPKCS1v15(&rk.PublicKey, sc.hash, h, sig)
+		}
+		if err != nil || !s.Verify(payload, sig) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	ek, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	for name, hash := range ecdsaSchemes {
+		es, _ := newECDSASigner(ek)
+		s, err := withScheme(es, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, _ := s.Sign(payload)
+		if !ecdsa.VerifyASN1(&ek.PublicKey, digest(hash, payload), sig) {
+			t.Fatalf("%s: stdlib verify failed", name)
+		}
+	}
+
+	// a scheme of another algorithm is rejected
+	eds, _ := NewEd25519Signer()
+	if _, err := withScheme(eds, domain.SchemeECDSASHA256); !errors.Is(err, domain.ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+	if _, err := withScheme(newRSASigner(rk), domain.SchemeEd25519); !errors.Is(err, domain.ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+}
+
+func TestPEMCodec_KeepsScheme(t *testing.T) {
+	rs, _ := NewRSASigner(1024)
+	key, _ := PEMCodec{}.MarshalSigner(rs)
+	pss, err := PEMCodec{}.UnmarshalSigner(domain.AlgRSA, domain.SchemeRSAPSSSHA256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := pss.Sign([]byte("p"))
+	if rs.Verify([]byte("p"), sig) || !pss.Verify([]byte("p"), sig) {
+		t.Fatal("restored signer does not use the stored scheme")
+	}
+	if _, err := (PEMCodec{}).UnmarshalSigner(domain.AlgRSA, "RSA-MD5", key); !errors.Is(err, domain.ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+}
+
+func TestImportSigner(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ek, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edk, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8 := func(k any) string {
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+	sec1, _ := x509.MarshalECPrivateKey(ek)
+
+	cases := []struct {
+		name   string
+		alg    domain.Algorithm
+		key    string
+		params domain.KeyParams
+	}{
+		{"pkcs8 rsa", domain.AlgRSA, pkcs8(rk), domain.KeyParams{Bits: 1024}},
+		{"pkcs1 rsa", domain.AlgRSA, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rk)})), domain.KeyParams{Bits: 1024}},
+		{"pkcs8 ecdsa", domain.AlgECC, pkcs8(ek), domain.KeyParams{Curve: "P-384"}},
+		{"sec1 ecdsa", domain.AlgECC, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})), domain.KeyParams{Curve: "P-384"}},
+		{"pkcs8 ed25519", domain.AlgEd25519, pkcs8(edk), domain.KeyParams{}},
+	}
+	for _, c := range cases {
+		s, params, err := ImportSigner(c.alg, "", c.key)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if params != c.params {
+			t.Fatalf("%s: params %+v", c.name, params)
+		}
+		sig, _ := s.Sign([]byte("p"))
+		if !s.Verify([]byte("p"), sig) {
+			t.Fatalf("%s: verify failed", c.name)
+		}
+	}
+
+	for name, key := range map[string]string{
+		"garbage":      "garbage",
+		"wrong type":   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})),
+		"bad der":      string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte{1}})),
+		"alg mismatch": pkcs8(ek),
+	} {
+		if _, _, err := ImportSigner(domain.AlgRSA, "", key); !errors.Is(err, domain.ErrInvalidKey) {
+			t.Fatalf("%s: want ErrInvalidKey, got %v", name, err)
+		}
+	}
+	if _, _, err := ImportSigner(domain.AlgRSA, domain.SchemeECDSASHA256, pkcs8(rk)); !errors.Is(err, domain.ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+}
+
+func TestVerifyPublic(t *testing.T) {
+	rs, _ := NewRSASigner(1024)
+	pss, _ := withScheme(newRSASigner(rs.priv), domain.SchemeRSAPSSSHA256)
+	es, _ := NewECDSASigner(elliptic.P256())
+	eds, _ := NewEd25519Signer()
+	payload := []byte("3_x_eQ==")
+	for sc, s := range map[domain.Scheme]domain.Signer{
+		domain.SchemeRSAPKCS1v15SHA256: rs,
+		domain.SchemeRSAPSSSHA256:      pss,
+		domain.SchemeECDSASHA256:       es,
+		domain.SchemeEd25519:           eds,
+	} {
+		sig, _ := s.Sign(payload)
+		if ok, err := VerifyPublic(s.PublicPEM(), sc, payload, sig); !ok || err != nil {
+			t.Fatalf("%s: %v %v", sc, ok, err)
+		}
+		if ok, _ := VerifyPublic(s.PublicPEM(), sc, []byte("tampered"), sig); ok {
+			t.Fatalf("%s: tampered payload verified", sc)
+		}
+	}
+	if _, err := VerifyPublic(es.PublicPEM(), domain.SchemeRSAPSSSHA256, payload, []byte{1}); !errors.Is(err, domain.ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+	for _, bad := range []string{"nope", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE"})), string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}))} {
+		if _, err := VerifyPublic(bad, domain.SchemeEd25519, payload, []byte{1}); !errors.Is(err, domain.ErrInvalidKey) {
+			t.Fatalf("want ErrInvalidKey, got %v", err)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 
@@ -17,28 +17,53 @@ var marshalPKIXPublicKey = x509.MarshalPKIXPublicKey
 type ECDSASigner struct {
 	priv   *ecdsa.PrivateKey
 	pubPEM string
+	hash   crypto.Hash
 }
 
-func NewECDSASigner() (*ECDSASigner, error) {
-	k, err := ecdsaGenerateKey(elliptic.P256(), rand.Reader)
+// curves are the ECDSA curves devices may use, by name.
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// CurveByName returns the named curve ("P-256", "P-384" or "P-521").
+func CurveByName(name string) (elliptic.Curve, bool) {
+	c, ok := curves[name]
+	return c, ok
+}
+
+func NewECDSASigner(curve elliptic.Curve) (*ECDSASigner, error) {
+	k, err := ecdsaGenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
+	return newECDSASigner(k)
+}
+
+func newECDSASigner(k *ecdsa.PrivateKey) (*ECDSASigner, error) {
 	der, err := marshalPKIXPublicKey(&k.PublicKey)
 	if err != nil {
 		return nil, err
 	}
 	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
-	return &ECDSASigner{priv: k, pubPEM: string(pemBytes)}, nil
+	return &ECDSASigner{priv: k, pubPEM: string(pemBytes), hash: crypto.SHA256}, nil
+}
+
+func (s *ECDSASigner) setScheme(scheme domain.Scheme) error {
+	h, ok := ecdsaSchemes[scheme]
+	if !ok {
+		return domain.ErrInvalidScheme
+	}
+	s.hash = h
+	return nil
 }
 
 func (s *ECDSASigner) Sign(payload []byte) ([]byte, error) {
-	h := sha256.Sum256(payload)
-	return ecdsa.SignASN1(rand.Reader, s.priv, h[:])
+	return ecdsa.SignASN1(rand.Reader, s.priv, digest(s.hash, payload))
 }
 func (s *ECDSASigner) Verify(payload, signature []byte) bool {
-	h := sha256.Sum256(payload)
-	return ecdsa.VerifyASN1(&s.priv.PublicKey, h[:], signature)
+	return ecdsa.VerifyASN1(&s.priv.PublicKey, digest(s.hash, payload), signature)
 }
 func (s *ECDSASigner) PublicPEM() string     { return s.pubPEM }
 func (s *ECDSASigner) AlgorithmName() string { return "ECC" }
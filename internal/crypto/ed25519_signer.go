@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+var ed25519GenerateKey = ed25519.GenerateKey
+
+// Ed25519Signer signs the payload directly (PureEdDSA, no pre-hash).
+type Ed25519Signer struct {
+	priv   ed25519.PrivateKey
+	pubPEM string
+}
+
+func NewEd25519Signer() (*Ed25519Signer, error) {
+	_, k, err := ed25519GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newEd25519Signer(k)
+}
+
+func newEd25519Signer(k ed25519.PrivateKey) (*Ed25519Signer, error) {
+	der, err := marshalPKIXPublicKey(k.Public())
+	if err != nil {
+		return nil, err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return &Ed25519Signer{priv: k, pubPEM: string(pemBytes)}, nil
+}
+
+// setScheme accepts only Ed25519: PureEdDSA has no digest to choose.
+func (s *Ed25519Signer) setScheme(scheme domain.Scheme) error {
+	if scheme != domain.SchemeEd25519 {
+		return domain.ErrInvalidScheme
+	}
+	return nil
+}
+
+func (s *Ed25519Signer) Sign(payload []byte) ([]byte, error) {
+	return ed25519.Sign(s.priv, payload), nil
+}
+func (s *Ed25519Signer) Verify(payload, signature []byte) bool {
+	return ed25519.Verify(s.priv.Public().(ed25519.PublicKey), payload, signature)
+}
+func (s *Ed25519Signer) PublicPEM() string     { return s.pubPEM }
+func (s *Ed25519Signer) AlgorithmName() string { return "ED25519" }
+
+var _ domain.Signer = (*Ed25519Signer)(nil)
@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+var marshalPKCS8PrivateKey = x509.MarshalPKCS8PrivateKey
+
+// PEMCodec persists signers as PKCS#8 PEM private keys. It satisfies storage.KeyCodec.
+type PEMCodec struct{}
+
+// MarshalSigner returns the PKCS#8 PEM encoding of the signer's private key.
+func (PEMCodec) MarshalSigner(s domain.Signer) (string, error) {
+	var key any
+	switch v := s.(type) {
+	case *RSASigner:
+		key = v.priv
+	case *ECDSASigner:
+		key = v.priv
+	case *Ed25519Signer:
+		key = v.priv
+	default:
+		return "", fmt.Errorf("unsupported signer %T", s)
+	}
+	der, err := marshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// UnmarshalSigner restores a signer for alg and scheme from a PKCS#8 PEM private key.
+func (PEMCodec) UnmarshalSigner(alg domain.Algorithm, scheme domain.Scheme, key string) (domain.Signer, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("invalid private key PEM")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return signerFor(alg, scheme, k)
+}
+
+// ParsePrivateKey decodes a PEM private key in PKCS#8 ("PRIVATE KEY"),
+// PKCS#1 ("RSA PRIVATE KEY") or SEC1 ("EC PRIVATE KEY") form.
+func ParsePrivateKey(key string) (any, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block", domain.ErrInvalidKey)
+	}
+	var (
+		k   any
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		k, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		k, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unsupported PEM type %q", domain.ErrInvalidKey, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrInvalidKey, err)
+	}
+	return k, nil
+}
+
+// ImportSigner builds a signer for alg and scheme from an externally
+// generated PEM private key and reports the key's parameters.
+func ImportSigner(alg domain.Algorithm, scheme domain.Scheme, key string) (domain.Signer, domain.KeyParams, error) {
+	k, err := ParsePrivateKey(key)
+	if err != nil {
+		return nil, domain.KeyParams{}, err
+	}
+	var params domain.KeyParams
+	switch priv := k.(type) {
+	case *rsa.PrivateKey:
+		if err := priv.Validate(); err != nil {
+			return nil, params, fmt.Errorf("%w: %v", domain.ErrInvalidKey, err)
+		}
+		params.Bits = priv.N.BitLen()
+	case *ecdsa.PrivateKey:
+		params.Curve = priv.Curve.Params().Name
+	}
+	s, err := signerFor(alg, scheme, k)
+	if errors.Is(err, domain.ErrInvalidAlgorithm) {
+		return nil, params, fmt.Errorf("%w: %T is not a %s key", domain.ErrInvalidKey, k, alg)
+	}
+	if err != nil {
+		return nil, params, err
+	}
+	return s, params, nil
+}
+
+// signerFor wraps the parsed private key k, which must be of alg's key type.
+func signerFor(alg domain.Algorithm, scheme domain.Scheme, k any) (domain.Signer, error) {
+	switch priv := k.(type) {
+	case *rsa.PrivateKey:
+		if alg == domain.AlgRSA {
+			return withScheme(newRSASigner(priv), scheme)
+		}
+	case *ecdsa.PrivateKey:
+		if alg == domain.AlgECC {
+			s, err := newECDSASigner(priv)
+			if err != nil {
+				return nil, err
+			}
+			return withScheme(s, scheme)
+		}
+	case ed25519.PrivateKey:
+		if alg == domain.AlgEd25519 {
+			s, err := newEd25519Signer(priv)
+			if err != nil {
+				return nil, err
+			}
+			return withScheme(s, scheme)
+		}
+	}
+	return nil, fmt.Errorf("%w: key type %T does not match %s", domain.ErrInvalidAlgorithm, k, alg)
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+// Registry maps algorithms to their specs. The service and HTTP layer only
+// go through the registry; an algorithm whose keys the persistent stores
+// must keep also needs a case in PEMCodec.MarshalSigner and signerFor.
+type Registry struct {
+	mu    sync.RWMutex
+	specs map[domain.Algorithm]domain.AlgorithmSpec
+	order []domain.Algorithm
+}
+
+// NewRegistry returns a registry holding specs. It panics on an invalid or
+// duplicate spec, since that is a wiring bug.
+func NewRegistry(specs ...domain.AlgorithmSpec) *Registry {
+	r := &Registry{specs: make(map[domain.Algorithm]domain.AlgorithmSpec)}
+	for _, s := range specs {
+		if err := r.Register(s); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Default returns the registry of every algorithm this package implements,
+// with the key parameters the server allows out of the box.
+func Default() *Registry {
+	return NewRegistry(
+		domain.AlgorithmSpec{
+			Name:        domain.AlgRSA,
+			Description: "RSA, PKCS#1 v1.5 or PSS (salt length = digest size)",
+			Metadata:    map[string]string{"public_key": "PKCS#1 PEM"},
+			DefaultKey:  domain.KeyParams{Bits: 2048},
+			AllowedKeys: []domain.KeyParams{{Bits: 2048}, {Bits: 3072}, {Bits: 4096}},
+			Schemes: []domain.Scheme{
+				domain.SchemeRSAPKCS1v15SHA256, domain.SchemeRSAPKCS1v15SHA384, domain.SchemeRSAPKCS1v15SHA512,
+				domain.SchemeRSAPSSSHA256, domain.SchemeRSAPSSSHA384, domain.SchemeRSAPSSSHA512,
+			},
+			New:          newRSAFromParams,
+			Import:       importer(domain.AlgRSA),
+			VerifyPublic: VerifyPublic,
+		},
+		domain.AlgorithmSpec{
+			Name:         domain.AlgECC,
+			Description:  "ECDSA, ASN.1 DER signatures",
+			Metadata:     map[string]string{"public_key": "SPKI PEM"},
+			DefaultKey:   domain.KeyParams{Curve: "P-256"},
+			AllowedKeys:  []domain.KeyParams{{Curve: "P-256"}, {Curve: "P-384"}, {Curve: "P-521"}},
+			Schemes:      []domain.Scheme{domain.SchemeECDSASHA256, domain.SchemeECDSASHA384, domain.SchemeECDSASHA512},
+			New:          newECDSAFromParams,
+			Import:       importer(domain.AlgECC),
+			VerifyPublic: VerifyPublic,
+		},
+		domain.AlgorithmSpec{
+			Name:        domain.AlgEd25519,
+			Description: "Ed25519 (PureEdDSA), 64-byte signatures",
+			Metadata:    map[string]string{"public_key": "SPKI PEM"},
+			Schemes:     []domain.Scheme{domain.SchemeEd25519},
+			New: func(_ domain.KeyParams, sc domain.Scheme) (domain.Signer, error) {
+				s, err := NewEd25519Signer()
+				if err != nil {
+					return nil, err
+				}
+				return withScheme(s, sc)
+			},
+			Import:       importer(domain.AlgEd25519),
+			VerifyPublic: VerifyPublic,
+		},
+	)
+}
+
+func importer(alg domain.Algorithm) func(string, domain.Scheme) (domain.Signer, domain.KeyParams, error) {
+	return func(key string, sc domain.Scheme) (domain.Signer, domain.KeyParams, error) {
+		return ImportSigner(alg, sc, key)
+	}
+}
+
+func newRSAFromParams(p domain.KeyParams, sc domain.Scheme) (domain.Signer, error) {
+	s, err := NewRSASigner(p.Bits)
+	if err != nil {
+		return nil, err
+	}
+	return withScheme(s, sc)
+}
+
+func newECDSAFromParams(p domain.KeyParams, sc domain.Scheme) (domain.Signer, error) {
+	curve, ok := CurveByName(p.Curve)
+	if !ok {
+		return nil, domain.ErrInvalidKeyParams
+	}
+	s, err := NewECDSASigner(curve)
+	if err != nil {
+		return nil, err
+	}
+	return withScheme(s, sc)
+}
+
+// Register adds spec to the registry.
+func (r *Registry) Register(spec domain.AlgorithmSpec) error {
+	if spec.Name == "" || spec.New == nil {
+		return fmt.Errorf("algorithm spec %q: name and constructor are required", spec.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.specs[spec.Name]; ok {
+		return fmt.Errorf("algorithm %q already registered", spec.Name)
+	}
+	r.specs[spec.Name] = spec
+	r.order = append(r.order, spec.Name)
+	return nil
+}
+
+// Restrict narrows the allow-list of alg to allowed, which must be a subset
+// of what the algorithm supports. The first entry becomes the default.
+func (r *Registry) Restrict(alg domain.Algorithm, allowed []domain.KeyParams) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spec, ok := r.specs[alg]
+	if !ok {
+		return fmt.Errorf("%w: %q", domain.ErrInvalidAlgorithm, alg)
+	}
+	if len(allowed) == 0 {
+		return fmt.Errorf("algorithm %q: empty allow-list", alg)
+	}
+	for _, p := range allowed {
+		if _, err := spec.ResolveKey(p); err != nil {
+			return fmt.Errorf("algorithm %q: %+v: %w", alg, p, err)
+		}
+	}
+	spec.DefaultKey = allowed[0]
+	spec.AllowedKeys = append([]domain.KeyParams(nil), allowed...)
+	r.specs[alg] = spec
+	return nil
+}
+
+// Lookup returns the spec registered for alg.
+func (r *Registry) Lookup(alg domain.Algorithm) (domain.AlgorithmSpec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.specs[alg]
+	return s, ok
+}
+
+// List returns every spec in registration order.
+func (r *Registry) List() []domain.AlgorithmSpec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]domain.AlgorithmSpec, 0, len(r.order))
+	for _, name := range r.order {
+		out = append(out, r.specs[name])
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+func TestDefaultRegistry(t *testing.T) {
+	r := Default()
+	for _, spec := range r.List() {
+		got, ok := r.Lookup(spec.Name)
+		if !ok || got.Name != spec.Name {
+			t.Fatalf("lookup %s failed", spec.Name)
+		}
+		if spec.Name == domain.AlgRSA {
+			continue // 2048-bit keygen is slow; covered by TestRSAAndECDSA
+		}
+		s, err := spec.New(spec.DefaultKey, "")
+		if err != nil || s.AlgorithmName() != string(spec.Name) {
+			t.Fatalf("%s constructor: %v", spec.Name, err)
+		}
+	}
+	if _, ok := r.Lookup("BAD"); ok {
+		t.Fatal("unexpected algorithm")
+	}
+}
+
+func TestECDSACurves(t *testing.T) {
+	for _, name := range []string{"P-384", "P-521"} {
+		s, err := newECDSAFromParams(domain.KeyParams{Curve: name}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.(*ECDSASigner).priv.Curve.Params().Name != name {
+			t.Fatalf("curve %s not used", name)
+		}
+		sig, _ := s.Sign([]byte("p"))
+		if !s.Verify([]byte("p"), sig) {
+			t.Fatalf("%s verify failed", name)
+		}
+	}
+	if _, err := newECDSAFromParams(domain.KeyParams{Curve: "P-192"}, ""); !errors.Is(err, domain.ErrInvalidKeyParams) {
+		t.Fatalf("want ErrInvalidKeyParams, got %v", err)
+	}
+}
+
+func TestRegistry_Restrict(t *testing.T) {
+	r := Default()
+	if err := r.Restrict(domain.AlgRSA, []domain.KeyParams{{Bits: 4096}, {Bits: 3072}}); err != nil {
+		t.Fatal(err)
+	}
+	spec, _ := r.Lookup(domain.AlgRSA)
+	if spec.DefaultKey.Bits != 4096 || len(spec.AllowedKeys) != 2 {
+		t.Fatalf("restricted spec %+v", spec)
+	}
+	if _, err := spec.ResolveKey(domain.KeyParams{Bits: 2048}); err == nil {
+		t.Fatal("2048 must no longer be allowed")
+	}
+	// cannot widen, cannot empty, cannot restrict unknown algorithms
+	if err := r.Restrict(domain.AlgRSA, []domain.KeyParams{{Bits: 2048}}); err == nil {
+		t.Fatal("want error widening the allow-list")
+	}
+	if err := r.Restrict(domain.AlgRSA, nil); err == nil {
+		t.Fatal("want error for empty allow-list")
+	}
+	if err := r.Restrict("BAD", []domain.KeyParams{{Bits: 2048}}); !errors.Is(err, domain.ErrInvalidAlgorithm) {
+		t.Fatalf("want ErrInvalidAlgorithm, got %v", err)
+	}
+}
+
+func TestRegistry_RegisterValidation(t *testing.T) {
+	r := NewRegistry()
+	ok := domain.AlgorithmSpec{Name: "X", New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return nil, nil }}
+	if err := r.Register(ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(ok); err == nil {
+		t.Fatal("want duplicate error")
+	}
+	if err := r.Register(domain.AlgorithmSpec{Name: "Y"}); err == nil {
+		t.Fatal("want missing constructor error")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NewRegistry must panic on duplicates")
+		}
+	}()
+	NewRegistry(ok, ok)
+}
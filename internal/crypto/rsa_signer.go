@@ -1,10 +1,8 @@
 package crypto
 
 import (
-	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 
@@ -16,6 +14,7 @@ var rsaGenerateKey = rsa.GenerateKey
 type RSASigner struct {
 	priv   *rsa.PrivateKey
 	pubPEM string
+	scheme rsaScheme
 }
 
 func NewRSASigner(bits int) (*RSASigner, error) {
@@ -23,18 +22,41 @@ func NewRSASigner(bits int) (*RSASigner, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newRSASigner(k), nil
+}
+
+func newRSASigner(k *rsa.PrivateKey) *RSASigner {
 	pubDER := x509.MarshalPKCS1PublicKey(&k.PublicKey)
 	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pubDER})
-	return &RSASigner{priv: k, pubPEM: string(pemBytes)}, nil
+	return &RSASigner{priv: k, pubPEM: string(pemBytes), scheme: rsaSchemes[domain.SchemeRSAPKCS1v15SHA256]}
+}
+
+// pssOptions salts PSS signatures with as many bytes as the digest, the
+// common choice verifiers assume.
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+
+func (s *RSASigner) setScheme(scheme domain.Scheme) error {
+	sc, ok := rsaSchemes[scheme]
+	if !ok {
+		return domain.ErrInvalidScheme
+	}
+	s.scheme = sc
+	return nil
 }
 
 func (s *RSASigner) Sign(payload []byte) ([]byte, error) {
-	h := sha256.Sum256(payload)
-	return rsa.SignPKCS1v15(rand.Reader, s.priv, crypto.SHA256, h[:])
+	h := digest(s.scheme.hash, payload)
+	if s.scheme.pss {
+		return rsa.SignPSS(rand.Reader, s.priv, s.scheme.hash, h, pssOptions)
+	}
+	return rsa.SignPKCS1v15(rand.Reader, s.priv, s.scheme.hash, h)
 }
 func (s *RSASigner) Verify(payload, signature []byte) bool {
-	h := sha256.Sum256(payload)
-	return rsa.VerifyPKCS1v15(&s.priv.PublicKey, crypto.SHA256, h[:], signature) == nil
+	h := digest(s.scheme.hash, payload)
+	if s.scheme.pss {
+		return rsa.VerifyPSS(&s.priv.PublicKey, s.scheme.hash, h, signature, pssOptions) == nil
+	}
+	return rsa.VerifyPKCS1v15(&s.priv.PublicKey, s.scheme.hash, h, signature) == nil
 }
 
 func (s *RSASigner) PublicPEM() string     { return s.pubPEM }
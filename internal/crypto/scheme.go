@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"crypto"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash.New
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+type rsaScheme struct {
+	pss  bool
+	hash crypto.Hash
+}
+
+var rsaSchemes = map[domain.Scheme]rsaScheme{
+	domain.SchemeRSAPKCS1v15SHA256: {hash: crypto.SHA256},
+	domain.SchemeRSAPKCS1v15SHA384: {hash: crypto.SHA384},
+	domain.SchemeRSAPKCS1v15SHA512: {hash: crypto.SHA512},
+	domain.SchemeRSAPSSSHA256:      {pss: true, hash: crypto.SHA256},
+	domain.SchemeRSAPSSSHA384:      {pss: true, hash: crypto.SHA384},
+	domain.SchemeRSAPSSSHA512:      {pss: true, hash: crypto.SHA512},
+}
+
+var ecdsaSchemes = map[domain.Scheme]crypto.Hash{
+	domain.SchemeECDSASHA256: crypto.SHA256,
+	domain.SchemeECDSASHA384: crypto.SHA384,
+	domain.SchemeECDSASHA512: crypto.SHA512,
+}
+
+// schemedSigner is implemented by signers whose scheme is selectable.
+type schemedSigner interface {
+	domain.Signer
+	setScheme(domain.Scheme) error
+}
+
+// withScheme configures s to sign with scheme. An empty scheme keeps the
+// signer's legacy scheme.
+func withScheme(s schemedSigner, scheme domain.Scheme) (domain.Signer, error) {
+	if scheme == "" {
+		return s, nil
+	}
+	if err := s.setScheme(scheme); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func digest(h crypto.Hash, payload []byte) []byte {
+	d := h.New()
+	d.Write(payload)
+	return d.Sum(nil)
+}
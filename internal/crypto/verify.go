@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+// VerifyPublic checks signature over payload with a PEM public key as
+// published by the signers (PKCS#1 "RSA PUBLIC KEY" or SPKI "PUBLIC KEY"),
+// using scheme. It lets retired keys, whose private half is gone, still verify.
+func VerifyPublic(publicPEM string, scheme domain.Scheme, payload, signature []byte) (bool, error) {
+	block, _ := pem.Decode([]byte(publicPEM))
+	if block == nil {
+		return false, fmt.Errorf("%w: invalid public key PEM", domain.ErrInvalidKey)
+	}
+	var (
+		pub any
+		err error
+	)
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return false, fmt.Errorf("%w: unsupported PEM type %q", domain.ErrInvalidKey, block.Type)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", domain.ErrInvalidKey, err)
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if sc, ok := rsaSchemes[scheme]; ok {
+			h := digest(sc.hash, payload)
+			if sc.pss {
+				return rsa.VerifyPSS(k, sc.hash, h, signature, pssOptions) == nil, nil
+			}
+			return rsa.VerifyPKCS1v15(k, sc.hash, h, signature) == nil, nil
+		}
+	case *ecdsa.PublicKey:
+		if hash, ok := ecdsaSchemes[scheme]; ok {
+			return ecdsa.VerifyASN1(k, digest(hash, payload), signature), nil
+		}
+	case ed25519.PublicKey:
+		if scheme == domain.SchemeEd25519 {
+			return ed25519.Verify(k, payload, signature), nil
+		}
+	}
+	return false, fmt.Errorf("%w: %s with a %T", domain.ErrInvalidScheme, scheme, pub)
+}
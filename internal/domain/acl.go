@@ -0,0 +1,95 @@
+package domain
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// DeviceRight is what an ACL entry lets a principal do with one device. Each
+// right includes the ones before it. The caller's scopes must allow the
+// action as well; an ACL only narrows them.
+type DeviceRight string
+
+const (
+	RightRead  DeviceRight = "read"  // get, verify, signature journal
+	RightSign  DeviceRight = "sign"  // and sign
+	RightAdmin DeviceRight = "admin" // and patch, rotate, lifecycle, ACL changes
+)
+
+// ACL limits keep devices small.
+const (
+	MaxACLEntries   = 64
+	MaxPrincipalLen = 256
+)
+
+func (r DeviceRight) rank() int {
+	switch r {
+	case RightRead:
+		return 1
+	case RightSign:
+		return 2
+	case RightAdmin:
+		return 3
+	}
+	return 0
+}
+
+// ValidRight reports whether r is one of the rights above.
+func ValidRight(r DeviceRight) bool { return r.rank() > 0 }
+
+// Covers reports whether holding r grants need.
+func (r DeviceRight) Covers(need DeviceRight) bool {
+	return ValidRight(need) && r.rank() >= need.rank()
+}
+
+// ValidPrincipal reports whether p is 1..MaxPrincipalLen bytes without
+// control characters, e.g. "key:<id>" or "cert:CN=till-7,O=acme".
+func ValidPrincipal(p string) bool {
+	if p == "" || len(p) > MaxPrincipalLen {
+		return false
+	}
+	for _, c := range p {
+		if unicode.IsControl(c) || c == unicode.ReplacementChar {
+			return false
+		}
+	}
+	return true
+}
+
+// PatchACL applies patch to the device's ACL: a right grants it to the
+// principal, nil removes the principal. Like PatchTags, the device gets a
+// new map.
+func (d *SignatureDevice) PatchACL(patch map[string]*DeviceRight) error {
+	next := make(map[string]DeviceRight, len(d.ACL)+len(patch))
+	for p, r := range d.ACL {
+		next[p] = r
+	}
+	for p, r := range patch {
+		if !ValidPrincipal(p) {
+			return fmt.Errorf("%w: ACL principal %q", ErrInvalidInput, p)
+		}
+		if r == nil {
+			delete(next, p)
+			continue
+		}
+		if !ValidRight(*r) {
+			return fmt.Errorf("%w: ACL right %q for %q, want read, sign or admin", ErrInvalidInput, *r, p)
+		}
+		next[p] = *r
+	}
+	if len(next) > MaxACLEntries {
+		return fmt.Errorf("%w: more than %d ACL entries", ErrInvalidInput, MaxACLEntries)
+	}
+	if len(next) == 0 {
+		next = nil
+	}
+	d.ACL = next
+	return nil
+}
+
+// Allows reports whether the device's ACL grants principal need. It says
+// nothing about devices without an ACL.
+func (d *SignatureDevice) Allows(principal string, need DeviceRight) bool {
+	r, ok := d.ACL[principal]
+	return ok && r.Covers(need)
+}
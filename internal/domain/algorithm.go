@@ -0,0 +1,63 @@
+package domain
+
+// KeyParams are a device's key generation parameters. Only the field that
+// applies to the device's algorithm is set.
+type KeyParams struct {
+	Bits  int    `json:"bits,omitempty"`  // RSA modulus size
+	Curve string `json:"curve,omitempty"` // ECDSA curve, e.g. "P-256"
+}
+
+// AlgorithmSpec describes a signing algorithm: its constructor plus the
+// key parameters and schemes it accepts and the metadata advertised to clients.
+type AlgorithmSpec struct {
+	Name        Algorithm         `json:"name"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// DefaultKey is used when a create request carries no key parameters.
+	DefaultKey KeyParams `json:"default_key_params"`
+	// AllowedKeys is the server-side allow-list; empty means only DefaultKey.
+	AllowedKeys []KeyParams `json:"allowed_key_params,omitempty"`
+	// Schemes lists the signature schemes devices may use; the first is the default.
+	Schemes []Scheme                                `json:"schemes,omitempty"`
+	New     func(KeyParams, Scheme) (Signer, error) `json:"-"`
+	// Import wraps an externally generated PEM private key and reports its
+	// key parameters. Nil means the algorithm does not support imports.
+	Import func(key string, sc Scheme) (Signer, KeyParams, error) `json:"-"`
+	// VerifyPublic checks a signature with a public key alone, for keys the
+	// device has rotated away from. Nil limits verification to the current key.
+	VerifyPublic func(publicPEM string, sc Scheme, payload, sig []byte) (bool, error) `json:"-"`
+}
+
+// ResolveKey returns the key parameters to use for requested: the default
+// when requested is zero, otherwise requested if it is allow-listed.
+func (s AlgorithmSpec) ResolveKey(requested KeyParams) (KeyParams, error) {
+	if requested == (KeyParams{}) {
+		return s.DefaultKey, nil
+	}
+	if requested == s.DefaultKey {
+		return requested, nil
+	}
+	for _, p := range s.AllowedKeys {
+		if p == requested {
+			return requested, nil
+		}
+	}
+	return KeyParams{}, ErrInvalidKeyParams
+}
+
+// ResolveScheme returns the scheme to use for requested: the default when
+// requested is empty, otherwise requested if the algorithm supports it.
+func (s AlgorithmSpec) ResolveScheme(requested Scheme) (Scheme, error) {
+	if requested == "" {
+		if len(s.Schemes) == 0 {
+			return "", nil
+		}
+		return s.Schemes[0], nil
+	}
+	for _, sc := range s.Schemes {
+		if sc == requested {
+			return requested, nil
+		}
+	}
+	return "", ErrInvalidScheme
+}
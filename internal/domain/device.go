@@ -1,21 +1,74 @@
 package domain
 
-import "encoding/base64"
+import (
+	"encoding/base64"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Algorithm string
 
 const (
-	AlgRSA Algorithm = "RSA"
-	AlgECC Algorithm = "ECC"
+	AlgRSA     Algorithm = "RSA"
+	AlgECC     Algorithm = "ECC"
+	AlgEd25519 Algorithm = "ED25519"
 )
 
+// DefaultTenant owns devices created before tenants existed and those of
+// callers that do not name a tenant.
+const DefaultTenant = "default"
+
+// MaxTenantLen bounds tenant names.
+const MaxTenantLen = 64
+
+// ValidTenant reports whether t is 1..MaxTenantLen of [A-Za-z0-9_.-].
+func ValidTenant(t string) bool { return validName(t, MaxTenantLen) }
+
+// MaxDeviceIDLen bounds client-chosen device IDs.
+const MaxDeviceIDLen = 128
+
+// ValidDeviceID reports whether id can name a device: 1..MaxDeviceIDLen
+// bytes of UTF-8 without control characters. Every device must be
+// addressable as /v1/devices/{id}, so IDs may not contain '/', be a path
+// dot segment or collide with the import route.
+func ValidDeviceID(id string) bool {
+	switch id {
+	case "", ".", "..", "import":
+		return false
+	}
+	if len(id) > MaxDeviceIDLen || !utf8.ValidString(id) {
+		return false
+	}
+	for _, c := range id {
+		if c == '/' || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
 type SignatureDevice struct {
-	ID               string    `json:"id"`
-	Algorithm        Algorithm `json:"algorithm"`
-	Label            string    `json:"label,omitempty"`
-	SignatureCounter uint64    `json:"signature_counter"`
-	LastSignatureB64 string    `json:"last_signature_base64"`
-	PublicKeyPEM     string    `json:"public_key_pem"`
+	// Tenant owns the device; IDs are unique per tenant only.
+	Tenant    string       `json:"tenant"`
+	ID        string       `json:"id"`
+	Algorithm Algorithm    `json:"algorithm"`
+	Label     string       `json:"label,omitempty"`
+	Status    DeviceStatus `json:"status"`
+	// Tags are free-form key/value metadata (store, register, ...). Change
+	// them with PatchTags; the map is shared between copies of a device.
+	Tags map[string]string `json:"tags,omitempty"`
+	// ACL, when not empty, limits the device to the principals it names;
+	// see PatchACL. Like Tags, the map is shared between copies.
+	ACL       map[string]DeviceRight `json:"acl,omitempty"`
+	KeyParams KeyParams              `json:"key_params"`
+	Scheme    Scheme                 `json:"scheme"`
+	// PayloadFormat encodes what the device signs; see PayloadV0 and PayloadV1.
+	PayloadFormat    PayloadFormat `json:"payload_format"`
+	SignatureCounter uint64        `json:"signature_counter"`
+	LastSignatureB64 string        `json:"last_signature_base64"`
+	PublicKeyPEM     string        `json:"public_key_pem"` // current key
+	// Keys is the key history, oldest first; the last entry is current.
+	Keys []DeviceKey `json:"keys,omitempty"`
 }
 
 // InitialLastSignature returns base64(deviceID) for the base case.
@@ -23,7 +76,19 @@ func InitialLastSignature(id string) string {
 	return base64.StdEncoding.EncodeToString([]byte(id))
 }
 
+// VerificationResult is the outcome of checking one signature. Err is set
+// when the signature could not be checked at all, e.g. it is not base64.
+type VerificationResult struct {
+	Valid     bool
+	Algorithm Algorithm
+	Scheme    Scheme
+	KeyID     string
+	Err       error
+}
+
 type SignatureResult struct {
 	SignatureB64 string
 	SignedData   string
+	Scheme       Scheme
+	KeyID        string
 }
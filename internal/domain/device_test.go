@@ -2,6 +2,9 @@ package domain
 
 import (
 	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -13,3 +16,246 @@ func TestInitialLastSignature(t *testing.T) {
 		t.Fatalf("got %q want %q", got, want)
 	}
 }
+
+func TestValidDeviceID(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		want bool
+	}{
+		{"till-1", true},
+		{"01ARYZ6S41TSV4RRFFQ69G5FAV", true},
+		{"kasse ä", true},
+		{strings.Repeat("d", MaxDeviceIDLen), true},
+		{"", false},
+		{strings.Repeat("d", MaxDeviceIDLen+1), false},
+		{"import", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{"till\n1", false},
+		{"till\x00", false},
+		{"till\u0085", false},
+		{"till\xff", false},
+	} {
+		if got := ValidDeviceID(tc.id); got != tc.want {
+			t.Fatalf("%q: got %v", tc.id, got)
+		}
+	}
+}
+
+func TestAlgorithmSpec_ResolveScheme(t *testing.T) {
+	spec := AlgorithmSpec{Schemes: []Scheme{SchemeRSAPKCS1v15SHA256, SchemeRSAPSSSHA256}}
+	if sc, err := spec.ResolveScheme(""); err != nil || sc != SchemeRSAPKCS1v15SHA256 {
+		t.Fatalf("default: %q %v", sc, err)
+	}
+	if sc, err := spec.ResolveScheme(SchemeRSAPSSSHA256); err != nil || sc != SchemeRSAPSSSHA256 {
+		t.Fatalf("allowed: %q %v", sc, err)
+	}
+	if _, err := spec.ResolveScheme(SchemeECDSASHA256); !errors.Is(err, ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+	if LegacyScheme(AlgECC) != SchemeECDSASHA256 || LegacyScheme("X") != "" {
+		t.Fatal("unexpected legacy scheme")
+	}
+}
+
+func TestAlgorithmSpec_ResolveKey(t *testing.T) {
+	spec := AlgorithmSpec{DefaultKey: KeyParams{Bits: 2048}, AllowedKeys: []KeyParams{{Bits: 2048}, {Bits: 4096}}}
+	if p, err := spec.ResolveKey(KeyParams{}); err != nil || p.Bits != 2048 {
+		t.Fatalf("default: %+v %v", p, err)
+	}
+	if p, err := spec.ResolveKey(KeyParams{Bits: 4096}); err != nil || p.Bits != 4096 {
+		t.Fatalf("allowed: %+v %v", p, err)
+	}
+	if _, err := spec.ResolveKey(KeyParams{Bits: 1024}); !errors.Is(err, ErrInvalidKeyParams) {
+		t.Fatalf("want ErrInvalidKeyParams, got %v", err)
+	}
+	// without an allow-list only the default is accepted
+	spec.AllowedKeys = nil
+	if _, err := spec.ResolveKey(KeyParams{Bits: 2048}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.ResolveKey(KeyParams{Bits: 4096}); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestSignatureDevice_RotateKey(t *testing.T) {
+	d := &SignatureDevice{ID: "d", PublicKeyPEM: "pem1", SignatureCounter: 3}
+	if k, ok := d.KeyFor(0); !ok || k.ID != FirstKeyID {
+		t.Fatalf("legacy device: %+v %v", k, ok)
+	}
+	d.EnsureKeys()
+	before := *d
+
+	k2 := d.RotateKey("pem2")
+	if k2.ID != "k2" || k2.FirstCounter != 3 || d.PublicKeyPEM != "pem2" || d.CurrentKey().ID != "k2" {
+		t.Fatalf("rotated: %+v %+v", k2, d)
+	}
+	if *d.Keys[0].UntilCounter != 3 || before.Keys[0].UntilCounter != nil {
+		t.Fatalf("history not replaced: %+v / %+v", d.Keys, before.Keys)
+	}
+	d.SignatureCounter = 5
+	for c, want := range map[uint64]string{0: "k1", 2: "k1", 3: "k2", 4: "k2"} {
+		if k, ok := d.KeyFor(c); !ok || k.ID != want {
+			t.Fatalf("KeyFor(%d)=%+v %v want %s", c, k, ok, want)
+		}
+	}
+	if _, ok := d.KeyFor(5); ok {
+		t.Fatal("counter 5 has not been signed yet")
+	}
+}
+
+func TestPayloadFormat_RoundTrip(t *testing.T) {
+	p := Payload{Counter: 7, Data: `a_b "c" é_`, Prev: "c2lnPQ=="}
+	for _, f := range []PayloadFormat{PayloadV0, PayloadV1, ""} {
+		s, err := f.Encode(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.Decode(s)
+		if err != nil || got != p {
+			t.Fatalf("%q: %q decoded to %+v, %v", f, s, got, err)
+		}
+	}
+	if s, _ := PayloadV0.Encode(p); s != `7_a_b "c" é__c2lnPQ==` {
+		t.Fatalf("v0 changed: %q", s)
+	}
+	if s, _ := PayloadV1.Encode(p); s != `{"v":1,"counter":7,"data":"a_b \"c\" é_","prev":"c2lnPQ=="}` {
+		t.Fatalf("v1 not canonical: %q", s)
+	}
+	// no HTML escaping, so external verifiers re-serialising with plain JSON agree
+	html := Payload{Counter: 1, Data: "<a&b>", Prev: "p"}
+	if s, _ := PayloadV1.Encode(html); s != `{"v":1,"counter":1,"data":"<a&b>","prev":"p"}` {
+		t.Fatalf("v1 escaped HTML: %q", s)
+	} else if got, err := PayloadV1.Decode(s); err != nil || got != html {
+		t.Fatalf("decoded to %+v, %v", got, err)
+	}
+	if _, err := PayloadV1.Encode(Payload{Data: "a\xffb"}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("invalid UTF-8: want ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestPayloadFormat_DecodeRejects(t *testing.T) {
+	for f, inputs := range map[PayloadFormat][]string{
+		PayloadV0: {"", "7", "x_data_prev"},
+		PayloadV1: {
+			`{"counter":7,"data":"d","prev":"p"}`,
+			`{"v":1, "counter":7,"data":"d","prev":"p"}`,
+			`{"v":1,"counter":7,"prev":"p","data":"d"}`,
+			`{"v":1,"counter":7,"data":"d","prev":"p","x":1}`,
+			`{"v":1,"counter":7,"data":"\u003c","prev":"p"}`,
+		},
+	} {
+		for _, in := range inputs {
+			if _, err := f.Decode(in); !errors.Is(err, ErrInvalidInput) {
+				t.Fatalf("%s %q: want ErrInvalidInput, got %v", f, in, err)
+			}
+		}
+	}
+	if _, err := ResolvePayloadFormat("v9"); !errors.Is(err, ErrInvalidPayloadFormat) {
+		t.Fatalf("want ErrInvalidPayloadFormat, got %v", err)
+	}
+	if f, _ := ResolvePayloadFormat(""); f != DefaultPayloadFormat {
+		t.Fatalf("default format %q", f)
+	}
+}
+
+func TestSignatureDevice_SetStatus(t *testing.T) {
+	d := &SignatureDevice{}
+	if !d.Active() {
+		t.Fatal("devices without a status are active")
+	}
+	for _, s := range []DeviceStatus{StatusSuspended, StatusActive, StatusDecommissioned, StatusDecommissioned} {
+		if err := d.SetStatus(s); err != nil || d.Status != s {
+			t.Fatalf("to %s: %v", s, err)
+		}
+	}
+	if err := d.SetStatus(StatusActive); !errors.Is(err, ErrInvalidTransition) || d.Active() {
+		t.Fatalf("decommissioning must be final: %v", err)
+	}
+	if err := (&SignatureDevice{}).SetStatus("retired"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("want ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestSignatureDevice_PatchTags(t *testing.T) {
+	v := func(s string) *string { return &s }
+	d := &SignatureDevice{Tags: map[string]string{"store": "berlin", "floor": "1"}}
+	shared := d.Tags
+	if err := d.PatchTags(map[string]*string{"store": v("hamburg"), "floor": nil, "till.no": v("3")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Tags) != 2 || d.Tags["store"] != "hamburg" || d.Tags["till.no"] != "3" {
+		t.Fatalf("tags=%v", d.Tags)
+	}
+	if shared["store"] != "berlin" || len(shared) != 2 {
+		t.Fatalf("old map mutated: %v", shared)
+	}
+	if err := d.PatchTags(map[string]*string{"store": nil, "till.no": nil}); err != nil || d.Tags != nil {
+		t.Fatalf("removing every tag: %v %v", d.Tags, err)
+	}
+
+	many := map[string]*string{}
+	for i := 0; i <= MaxTags; i++ {
+		many["k"+strconv.Itoa(i)] = v("")
+	}
+	for name, patch := range map[string]map[string]*string{
+		"empty key": {"": v("x")},
+		"bad key":   {"a b": v("x")},
+		"long key":  {strings.Repeat("k", MaxTagKeyLen+1): v("x")},
+		"long val":  {"k": v(strings.Repeat("v", MaxTagValueLen+1))},
+		"too many":  many,
+	} {
+		if err := d.PatchTags(patch); !errors.Is(err, ErrInvalidInput) || d.Tags != nil {
+			t.Fatalf("%s: want ErrInvalidInput and no change, got %v %v", name, err, d.Tags)
+		}
+	}
+}
+
+func TestSignatureDevice_PatchACL(t *testing.T) {
+	r := func(r DeviceRight) *DeviceRight { return &r }
+	d := &SignatureDevice{ACL: map[string]DeviceRight{"key:a": RightRead, "key:b": RightSign}}
+	shared := d.ACL
+	if err := d.PatchACL(map[string]*DeviceRight{"key:a": r(RightAdmin), "key:b": nil, "cert:CN=x,O=acme": r(RightSign)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.ACL) != 2 || len(shared) != 2 || shared["key:a"] != RightRead {
+		t.Fatalf("acl=%v shared=%v", d.ACL, shared)
+	}
+	for _, tc := range []struct {
+		principal string
+		need      DeviceRight
+		want      bool
+	}{
+		{"key:a", RightSign, true},
+		{"key:a", RightAdmin, true},
+		{"cert:CN=x,O=acme", RightRead, true},
+		{"cert:CN=x,O=acme", RightAdmin, false},
+		{"key:b", RightRead, false},
+		{"key:a", "owner", false},
+	} {
+		if got := d.Allows(tc.principal, tc.need); got != tc.want {
+			t.Fatalf("%s %s: got %v", tc.principal, tc.need, got)
+		}
+	}
+
+	many := map[string]*DeviceRight{}
+	for i := 0; i <= MaxACLEntries; i++ {
+		many["key:"+strconv.Itoa(i)] = r(RightRead)
+	}
+	for name, patch := range map[string]map[string]*DeviceRight{
+		"empty principal": {"": r(RightRead)},
+		"long principal":  {strings.Repeat("p", MaxPrincipalLen+1): r(RightRead)},
+		"bad utf-8":       {"key:\xff": r(RightRead)},
+		"bad right":       {"key:c": r("owner")},
+		"too many":        many,
+	} {
+		if err := d.PatchACL(patch); !errors.Is(err, ErrInvalidInput) || len(d.ACL) != 2 {
+			t.Fatalf("%s: want ErrInvalidInput and no change, got %v %v", name, err, d.ACL)
+		}
+	}
+	if err := d.PatchACL(map[string]*DeviceRight{"key:a": nil, "cert:CN=x,O=acme": nil}); err != nil || d.ACL != nil {
+		t.Fatalf("removing every entry: %v %v", d.ACL, err)
+	}
+}
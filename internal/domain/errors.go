@@ -1,10 +1,36 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrNotFound         = errors.New("device not found")
-	ErrAlreadyExists    = errors.New("device already exists")
-	ErrInvalidAlgorithm = errors.New("invalid algorithm")
-	ErrInvalidInput     = errors.New("invalid input")
+	ErrNotFound             = errors.New("device not found")
+	ErrAlreadyExists        = errors.New("device already exists")
+	ErrInvalidAlgorithm     = errors.New("invalid algorithm")
+	ErrInvalidInput         = errors.New("invalid input")
+	ErrInvalidKeyParams     = errors.New("key parameters not allowed")
+	ErrInvalidScheme        = errors.New("signature scheme not supported")
+	ErrInvalidKey           = errors.New("invalid private key")
+	ErrInvalidPayloadFormat = errors.New("payload format not supported")
+	ErrIdempotencyConflict  = errors.New("idempotency key reused with a different request")
+	ErrCounterMismatch      = errors.New("signature counter does not match")
+	ErrDeviceInactive       = errors.New("device is not active")
+	ErrInvalidTransition    = errors.New("device status change not allowed")
+	ErrForbidden            = errors.New("access denied")
 )
+
+// CounterMismatchError is returned when a sign request expected a different
+// signature counter, i.e. another client has used the device meanwhile. It
+// matches ErrCounterMismatch.
+type CounterMismatchError struct {
+	Expected uint64
+	Current  uint64
+}
+
+func (e *CounterMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %d, device is at %d", ErrCounterMismatch, e.Expected, e.Current)
+}
+
+func (e *CounterMismatchError) Is(target error) bool { return target == ErrCounterMismatch }
@@ -0,0 +1,66 @@
+package domain
+
+import "strconv"
+
+// DeviceKey is one key a device has signed with. It signed the counters
+// FirstCounter <= c < UntilCounter; UntilCounter is nil while the key is current.
+type DeviceKey struct {
+	ID           string  `json:"key_id"`
+	PublicKeyPEM string  `json:"public_key_pem"`
+	FirstCounter uint64  `json:"first_counter"`
+	UntilCounter *uint64 `json:"until_counter,omitempty"`
+}
+
+// FirstKeyID identifies a device's initial key.
+const FirstKeyID = "k1"
+
+// EnsureKeys starts the key history of a device stored before keys could be
+// rotated: its only key has signed everything so far.
+func (d *SignatureDevice) EnsureKeys() {
+	if len(d.Keys) == 0 {
+		d.Keys = []DeviceKey{{ID: FirstKeyID, PublicKeyPEM: d.PublicKeyPEM}}
+	}
+}
+
+// CurrentKey returns the key the device signs with.
+func (d *SignatureDevice) CurrentKey() DeviceKey {
+	if len(d.Keys) == 0 {
+		return DeviceKey{ID: FirstKeyID, PublicKeyPEM: d.PublicKeyPEM}
+	}
+	return d.Keys[len(d.Keys)-1]
+}
+
+// KeyFor returns the key that signed counter.
+func (d *SignatureDevice) KeyFor(counter uint64) (DeviceKey, bool) {
+	if counter >= d.SignatureCounter {
+		return DeviceKey{}, false
+	}
+	for _, k := range d.Keys {
+		if counter >= k.FirstCounter && (k.UntilCounter == nil || counter < *k.UntilCounter) {
+			return k, true
+		}
+	}
+	if len(d.Keys) == 0 {
+		return d.CurrentKey(), true
+	}
+	return DeviceKey{}, false
+}
+
+// RotateKey retires the current key at the device's counter and makes
+// publicPEM current. Keys is replaced rather than modified in place, so
+// copies of the device taken earlier keep their history.
+func (d *SignatureDevice) RotateKey(publicPEM string) DeviceKey {
+	d.EnsureKeys()
+	keys := make([]DeviceKey, len(d.Keys), len(d.Keys)+1)
+	copy(keys, d.Keys)
+	until := d.SignatureCounter
+	keys[len(keys)-1].UntilCounter = &until
+	next := DeviceKey{
+		ID:           "k" + strconv.Itoa(len(keys)+1),
+		PublicKeyPEM: publicPEM,
+		FirstCounter: d.SignatureCounter,
+	}
+	d.Keys = append(keys, next)
+	d.PublicKeyPEM = publicPEM
+	return next
+}
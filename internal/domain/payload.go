@@ -0,0 +1,108 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// PayloadFormat names how a device encodes the bytes it signs from the
+// counter, the data and the previous signature. It is fixed per device.
+type PayloadFormat string
+
+const (
+	// PayloadV0 is "<counter>_<data>_<previous signature>". data is not
+	// escaped, so the fields can only be recovered because counters and
+	// base64 never contain an underscore.
+	PayloadV0 PayloadFormat = "v0"
+	// PayloadV1 is canonical JSON with explicit fields, always in this order
+	// and without whitespace: {"v":1,"counter":N,"data":"...","prev":"..."}.
+	// Strings are escaped as encoding/json does minus HTML escaping: only
+	// '"', '\\', control characters, U+2028 and U+2029. data must be valid UTF-8.
+	PayloadV1 PayloadFormat = "v1"
+)
+
+// DefaultPayloadFormat is used when a device is created without a format.
+// It stays v0 so that clients parsing signed_data keep working.
+const DefaultPayloadFormat = PayloadV0
+
+// Payload holds the fields a device signs.
+type Payload struct {
+	Counter uint64
+	Data    string
+	Prev    string
+}
+
+type payloadV1 struct {
+	V       int    `json:"v"`
+	Counter uint64 `json:"counter"`
+	Data    string `json:"data"`
+	Prev    string `json:"prev"`
+}
+
+// ResolvePayloadFormat validates f, mapping empty to DefaultPayloadFormat.
+func ResolvePayloadFormat(f PayloadFormat) (PayloadFormat, error) {
+	switch f {
+	case "":
+		return DefaultPayloadFormat, nil
+	case PayloadV0, PayloadV1:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidPayloadFormat, f)
+}
+
+// Encode returns the bytes to sign for p. Devices stored before formats
+// existed have no format and use v0.
+func (f PayloadFormat) Encode(p Payload) (string, error) {
+	switch f {
+	case PayloadV0, "":
+		return fmt.Sprintf("%d_%s_%s", p.Counter, p.Data, p.Prev), nil
+	case PayloadV1:
+		// json.Marshal would silently turn invalid UTF-8 into U+FFFD
+		if !utf8.ValidString(p.Data) || !utf8.ValidString(p.Prev) {
+			return "", fmt.Errorf("%w: v1 data must be valid UTF-8", ErrInvalidInput)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(payloadV1{V: 1, Counter: p.Counter, Data: p.Data, Prev: p.Prev}); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidPayloadFormat, f)
+}
+
+// Decode parses signed data produced by Encode. v1 input must be exactly the
+// canonical encoding.
+func (f PayloadFormat) Decode(s string) (Payload, error) {
+	switch f {
+	case PayloadV0, "":
+		head, rest, ok := strings.Cut(s, "_")
+		i := strings.LastIndex(rest, "_")
+		if !ok || i < 0 {
+			return Payload{}, fmt.Errorf("%w: not <counter>_<data>_<previous signature>", ErrInvalidInput)
+		}
+		counter, err := strconv.ParseUint(head, 10, 64)
+		if err != nil {
+			return Payload{}, fmt.Errorf("%w: no counter in %q", ErrInvalidInput, head)
+		}
+		return Payload{Counter: counter, Data: rest[:i], Prev: rest[i+1:]}, nil
+	case PayloadV1:
+		var v payloadV1
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&v); err != nil || v.V != 1 {
+			return Payload{}, fmt.Errorf("%w: not a v1 payload", ErrInvalidInput)
+		}
+		p := Payload{Counter: v.Counter, Data: v.Data, Prev: v.Prev}
+		if canon, _ := f.Encode(p); canon != s {
+			return Payload{}, fmt.Errorf("%w: v1 payload is not canonical", ErrInvalidInput)
+		}
+		return p, nil
+	}
+	return Payload{}, fmt.Errorf("%w: %q", ErrInvalidPayloadFormat, f)
+}
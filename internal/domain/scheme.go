@@ -0,0 +1,32 @@
+package domain
+
+// Scheme names the exact signature construction a device uses: the padding
+// (for RSA) and the digest. Verifiers need it to check a signature.
+type Scheme string
+
+const (
+	SchemeRSAPKCS1v15SHA256 Scheme = "RSA-PKCS1v15-SHA256"
+	SchemeRSAPKCS1v15SHA384 Scheme = "RSA-PKCS1v15-SHA384"
+	SchemeRSAPKCS1v15SHA512 Scheme = "RSA-PKCS1v15-SHA512"
+	SchemeRSAPSSSHA256      Scheme = "RSA-PSS-SHA256"
+	SchemeRSAPSSSHA384      Scheme = "RSA-PSS-SHA384"
+	SchemeRSAPSSSHA512      Scheme = "RSA-PSS-SHA512"
+	SchemeECDSASHA256       Scheme = "ECDSA-SHA256"
+	SchemeECDSASHA384       Scheme = "ECDSA-SHA384"
+	SchemeECDSASHA512       Scheme = "ECDSA-SHA512"
+	SchemeEd25519           Scheme = "Ed25519"
+)
+
+// LegacyScheme returns the scheme alg signed with before schemes were
+// selectable. Devices stored without a scheme use it.
+func LegacyScheme(alg Algorithm) Scheme {
+	switch alg {
+	case AlgRSA:
+		return SchemeRSAPKCS1v15SHA256
+	case AlgECC:
+		return SchemeECDSASHA256
+	case AlgEd25519:
+		return SchemeEd25519
+	}
+	return ""
+}
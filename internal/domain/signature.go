@@ -0,0 +1,17 @@
+package domain
+
+import "time"
+
+// SignatureRecord is one journal entry: everything needed to audit a signature.
+type SignatureRecord struct {
+	DeviceID   string    `json:"device_id"`
+	Counter    uint64    `json:"counter"`
+	Data       string    `json:"data"`
+	SignedData string    `json:"signed_data"`
+	Signature  string    `json:"signature"`
+	KeyID      string    `json:"key_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	// IdempotencyKey is the client's Idempotency-Key for the request that
+	// produced this signature, if it sent one.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
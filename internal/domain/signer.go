@@ -5,5 +5,5 @@ type Signer interface {
 	Sign(payload []byte) ([]byte, error)
 	Verify(payload, signature []byte) bool
 	PublicPEM() string
-	AlgorithmName() string // "RSA" or "ECC"
+	AlgorithmName() string // "RSA", "ECC" or "ED25519"
 }
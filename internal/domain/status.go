@@ -0,0 +1,36 @@
+package domain
+
+import "fmt"
+
+// DeviceStatus is a device's lifecycle state.
+type DeviceStatus string
+
+const (
+	// StatusActive devices sign. Devices stored before statuses existed are active.
+	StatusActive DeviceStatus = "active"
+	// StatusSuspended devices keep their key but refuse to sign until reactivated.
+	StatusSuspended DeviceStatus = "suspended"
+	// StatusDecommissioned devices have lost their private key for good; their
+	// public keys and journal remain for verification.
+	StatusDecommissioned DeviceStatus = "decommissioned"
+)
+
+// Active reports whether the device may sign.
+func (d *SignatureDevice) Active() bool {
+	return d.Status == StatusActive || d.Status == ""
+}
+
+// SetStatus moves the device to status. Active and suspended devices can
+// switch freely and be decommissioned; decommissioning is final.
+func (d *SignatureDevice) SetStatus(status DeviceStatus) error {
+	switch status {
+	case StatusActive, StatusSuspended, StatusDecommissioned:
+	default:
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidInput, status)
+	}
+	if d.Status == StatusDecommissioned && status != StatusDecommissioned {
+		return fmt.Errorf("%w: device is decommissioned", ErrInvalidTransition)
+	}
+	d.Status = status
+	return nil
+}
@@ -0,0 +1,59 @@
+package domain
+
+import "fmt"
+
+// Tag limits keep devices small and tag keys safe to use in lookups.
+const (
+	MaxTags        = 32
+	MaxTagKeyLen   = 64
+	MaxTagValueLen = 256
+)
+
+// ValidTagKey reports whether k is 1..MaxTagKeyLen of [A-Za-z0-9_.-].
+func ValidTagKey(k string) bool { return validName(k, MaxTagKeyLen) }
+
+// validName reports whether s is 1..max of [A-Za-z0-9_.-].
+func validName(s string, max int) bool {
+	if s == "" || len(s) > max {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// PatchTags applies patch to the device's tags: a value sets the tag, nil
+// removes it. The device gets a new map, so copies sharing the old one are
+// not affected.
+func (d *SignatureDevice) PatchTags(patch map[string]*string) error {
+	next := make(map[string]string, len(d.Tags)+len(patch))
+	for k, v := range d.Tags {
+		next[k] = v
+	}
+	for k, v := range patch {
+		if !ValidTagKey(k) {
+			return fmt.Errorf("%w: tag key %q", ErrInvalidInput, k)
+		}
+		if v == nil {
+			delete(next, k)
+			continue
+		}
+		if len(*v) > MaxTagValueLen {
+			return fmt.Errorf("%w: tag %q value longer than %d bytes", ErrInvalidInput, k, MaxTagValueLen)
+		}
+		next[k] = *v
+	}
+	if len(next) > MaxTags {
+		return fmt.Errorf("%w: more than %d tags", ErrInvalidInput, MaxTags)
+	}
+	if len(next) == 0 {
+		next = nil
+	}
+	d.Tags = next
+	return nil
+}
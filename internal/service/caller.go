@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+// Scope is a permission a caller holds. The service checks them on every
+// call, together with the ACLs of the devices involved.
+type Scope string
+
+const (
+	ScopeRead   Scope = "devices:read"
+	ScopeCreate Scope = "devices:create"
+	ScopeSign   Scope = "devices:sign"
+	ScopeManage Scope = "devices:manage"
+	ScopeAdmin  Scope = "admin" // implies every other scope
+)
+
+// ValidScope reports whether s is one of the scopes above.
+func ValidScope(s Scope) bool {
+	switch s {
+	case ScopeRead, ScopeCreate, ScopeSign, ScopeManage, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// Caller is who a service call is made for. Every call is confined to the
+// caller's tenant: devices of other tenants do not exist for it.
+type Caller struct {
+	Tenant string
+	// Principal identifies the credential behind the call, e.g. "key:<id>";
+	// empty when the transport does not authenticate.
+	Principal string
+	Scopes    []Scope
+}
+
+// Can reports whether c holds s, directly or through ScopeAdmin.
+func (c Caller) Can(s Scope) bool {
+	for _, have := range c.Scopes {
+		if have == s || have == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Caller) check() error {
+	if c.Tenant == "" {
+		return fmt.Errorf("%w: caller has no tenant", domain.ErrInvalidInput)
+	}
+	return nil
+}
+
+// require returns domain.ErrForbidden unless c holds s.
+func (c Caller) require(s Scope) error {
+	if !c.Can(s) {
+		return fmt.Errorf("%w: missing scope %s", domain.ErrForbidden, s)
+	}
+	return nil
+}
+
+// scopeFor is the scope a caller needs to use a device with right.
+func scopeFor(right domain.DeviceRight) Scope {
+	switch right {
+	case domain.RightRead:
+		return ScopeRead
+	case domain.RightSign:
+		return ScopeSign
+	}
+	return ScopeManage
+}
+
+// authorize checks that c may use dev with right. Admins may use every
+// device of their tenant. Everyone else needs the matching scope, and on a
+// device with an ACL also a principal it grants right to: scopes are the
+// upper limit, an ACL only narrows them to particular devices.
+func (c Caller) authorize(dev *domain.SignatureDevice, right domain.DeviceRight) error {
+	if c.Can(ScopeAdmin) {
+		return nil
+	}
+	if err := c.require(scopeFor(right)); err != nil {
+		return err
+	}
+	if len(dev.ACL) > 0 && (c.Principal == "" || !dev.Allows(c.Principal, right)) {
+		return fmt.Errorf("%w: device %q does not grant %s to %q", domain.ErrForbidden, dev.ID, right, c.Principal)
+	}
+	return nil
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context that carries c, for transports whose
+// middleware establishes who a request acts for.
+func WithCaller(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFrom returns the Caller stored by WithCaller.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
@@ -2,107 +2,630 @@ package service
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/storage"
 )
 
-// SignerFactory abstracts signer creation for algorithms.
-type SignerFactory interface {
-	NewRSA(bits int) (domain.Signer, error)
-	NewECDSA() (domain.Signer, error)
+// Algorithms resolves the signing algorithms devices can be created with.
+type Algorithms interface {
+	Lookup(alg domain.Algorithm) (domain.AlgorithmSpec, bool)
+	List() []domain.AlgorithmSpec
 }
 
 // IDGenerator abstracts ID creation.
 type IDGenerator interface{ New() string }
 
+// DefaultIdempotencyWindow is how long a sign request's Idempotency-Key is
+// remembered unless SetIdempotencyWindow says otherwise.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// MaxIdempotencyKeyLen bounds client-supplied idempotency keys.
+const MaxIdempotencyKeyLen = 255
+
 type DeviceService struct {
-	repo    storage.Repository
-	signers SignerFactory
-	ids     IDGenerator
+	repo       storage.Repository
+	algs       Algorithms
+	ids        IDGenerator
+	now        func() time.Time
+	idemWindow time.Duration
 }
 
-func New(repo storage.Repository, signers SignerFactory, ids IDGenerator) *DeviceService {
-	return &DeviceService{repo: repo, signers: signers, ids: ids}
+func New(repo storage.Repository, algs Algorithms, ids IDGenerator) *DeviceService {
+	return &DeviceService{repo: repo, algs: algs, ids: ids, now: time.Now, idemWindow: DefaultIdempotencyWindow}
 }
 
-// CreateDevice used to create a new device in the memory store.
-func (s *DeviceService) CreateDevice(id string, algo domain.Algorithm, label string) (*domain.SignatureDevice, error) {
-	if id == "" {
-		return nil, domain.ErrInvalidInput
+// SetIdempotencyWindow sets how long a repeated idempotency key returns the
+// original signature. After that the key signs again.
+func (s *DeviceService) SetIdempotencyWindow(d time.Duration) { s.idemWindow = d }
+
+// CreateDeviceRequest holds the inputs of CreateDevice. Zero optional fields
+// fall back to the algorithm's defaults.
+type CreateDeviceRequest struct {
+	// ID is optional; empty means the service's IDGenerator picks one.
+	ID        string
+	Algorithm domain.Algorithm
+	Label     string
+	KeyParams domain.KeyParams
+	Scheme    domain.Scheme
+	// PayloadFormat is how signed data is encoded; empty means domain.DefaultPayloadFormat.
+	PayloadFormat domain.PayloadFormat
+	Tags          map[string]string
+	// ACL, when set, limits the device to these principals from the start.
+	ACL map[string]domain.DeviceRight
+}
+
+// CreateDevice used to create a new device owned by the caller's tenant.
+func (s *DeviceService) CreateDevice(c Caller, req CreateDeviceRequest) (*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := c.require(ScopeCreate); err != nil {
+		return nil, err
+	}
+	if req.ID == "" {
+		if s.ids == nil {
+			return nil, fmt.Errorf("%w: id is required", domain.ErrInvalidInput)
+		}
+		req.ID = s.ids.New()
+	}
+	if !domain.ValidDeviceID(req.ID) {
+		return nil, fmt.Errorf("%w: invalid device id %q", domain.ErrInvalidInput, req.ID)
 	}
 
-	var signer domain.Signer
-	var err error
-	switch algo {
-	case domain.AlgRSA:
-		signer, err = s.signers.NewRSA(2048)
-	case domain.AlgECC:
-		signer, err = s.signers.NewECDSA()
-	default:
+	spec, ok := s.algs.Lookup(req.Algorithm)
+	if !ok {
 		return nil, domain.ErrInvalidAlgorithm
 	}
-
+	params, err := spec.ResolveKey(req.KeyParams)
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := spec.ResolveScheme(req.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	format, err := domain.ResolvePayloadFormat(req.PayloadFormat)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := spec.New(params, scheme)
 	if err != nil {
 		return nil, err
 	}
 
 	dev := &domain.SignatureDevice{
-		ID: id, Algorithm: algo, Label: label,
+		Tenant: c.Tenant, ID: req.ID, Algorithm: req.Algorithm, Label: req.Label,
+		Status:           domain.StatusActive,
+		KeyParams:        params,
+		Scheme:           scheme,
+		PayloadFormat:    format,
 		SignatureCounter: 0,
 		LastSignatureB64: "",
 		PublicKeyPEM:     signer.PublicPEM(),
 	}
+	if err := dev.PatchTags(setAll(req.Tags)); err != nil {
+		return nil, err
+	}
+	if err := dev.PatchACL(setAll(req.ACL)); err != nil {
+		return nil, err
+	}
+	dev.EnsureKeys()
+	if err := s.repo.Create(dev, signer); err != nil {
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+// ImportDeviceRequest holds the inputs of ImportDevice. A device migrated
+// from another system continues its chain at SignatureCounter, with
+// LastSignatureB64 as the previous signature.
+type ImportDeviceRequest struct {
+	ID               string
+	Algorithm        domain.Algorithm
+	Label            string
+	Scheme           domain.Scheme
+	PayloadFormat    domain.PayloadFormat
+	PrivateKeyPEM    string
+	SignatureCounter uint64
+	LastSignatureB64 string
+	ACL              map[string]domain.DeviceRight
+}
+
+// ImportDevice used to create a device around an existing private key and chain state.
+func (s *DeviceService) ImportDevice(c Caller, req ImportDeviceRequest) (*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := c.require(ScopeCreate); err != nil {
+		return nil, err
+	}
+	if req.ID == "" || req.PrivateKeyPEM == "" {
+		return nil, domain.ErrInvalidInput
+	}
+	if !domain.ValidDeviceID(req.ID) {
+		return nil, fmt.Errorf("%w: invalid device id %q", domain.ErrInvalidInput, req.ID)
+	}
+	// a chain that has started needs its head; a fresh one must not have one
+	if (req.SignatureCounter == 0) != (req.LastSignatureB64 == "") {
+		return nil, domain.ErrInvalidInput
+	}
+	if _, err := base64.StdEncoding.DecodeString(req.LastSignatureB64); err != nil {
+		return nil, domain.ErrInvalidInput
+	}
+
+	spec, ok := s.algs.Lookup(req.Algorithm)
+	if !ok || spec.Import == nil {
+		return nil, domain.ErrInvalidAlgorithm
+	}
+	scheme, err := spec.ResolveScheme(req.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	format, err := domain.ResolvePayloadFormat(req.PayloadFormat)
+	if err != nil {
+		return nil, err
+	}
+	signer, params, err := spec.Import(req.PrivateKeyPEM, scheme)
+	if err != nil {
+		return nil, err
+	}
+	if params, err = spec.ResolveKey(params); err != nil {
+		return nil, err
+	}
+
+	dev := &domain.SignatureDevice{
+		Tenant: c.Tenant, ID: req.ID, Algorithm: req.Algorithm, Label: req.Label,
+		Status:           domain.StatusActive,
+		KeyParams:        params,
+		Scheme:           scheme,
+		PayloadFormat:    format,
+		SignatureCounter: req.SignatureCounter,
+		LastSignatureB64: req.LastSignatureB64,
+		PublicKeyPEM:     signer.PublicPEM(),
+	}
+	if err := dev.PatchACL(setAll(req.ACL)); err != nil {
+		return nil, err
+	}
+	dev.EnsureKeys()
 	if err := s.repo.Create(dev, signer); err != nil {
 		return nil, err
 	}
+	return dev, nil
+}
+
+// ListAlgorithms used to list the algorithms devices can be created with.
+func (s *DeviceService) ListAlgorithms() []domain.AlgorithmSpec {
+	return s.algs.List()
+}
 
+// GetDevice used to get one of the caller's devices.
+func (s *DeviceService) GetDevice(c Caller, id string) (*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	dev, _, err := s.repo.Get(c.Tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authorize(dev, domain.RightRead); err != nil {
+		return nil, err
+	}
 	return dev, nil
 }
 
-// GetDevice used to get a device from the memory store.
-func (s *DeviceService) GetDevice(id string) (*domain.SignatureDevice, error) {
-	dev, _, err := s.repo.Get(id)
-	return dev, err
+// ListDevices used to list the caller's devices that match f, leaving out
+// those it may not read. Pages are still filled up to f.Limit.
+func (s *DeviceService) ListDevices(c Caller, f storage.DeviceFilter) ([]*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if err := c.require(ScopeRead); err != nil {
+		return nil, err
+	}
+	if c.Can(ScopeAdmin) {
+		return s.repo.List(c.Tenant, f)
+	}
+	out := []*domain.SignatureDevice{}
+	for {
+		page, err := s.repo.List(c.Tenant, f)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range page {
+			if c.authorize(d, domain.RightRead) != nil {
+				continue
+			}
+			out = append(out, d)
+			if len(out) == f.Limit {
+				return out, nil
+			}
+		}
+		if f.Limit == 0 || len(page) < f.Limit {
+			return out, nil
+		}
+		f.After = page[len(page)-1].ID
+	}
+}
+
+// DevicePatch holds the changes of UpdateDevice. A nil Label keeps the
+// label; a tag or ACL principal set to nil is removed, those not mentioned
+// are kept.
+type DevicePatch struct {
+	Label *string
+	Tags  map[string]*string
+	ACL   map[string]*domain.DeviceRight
+}
+
+// UpdateDevice used to change a device's label, tags and ACL.
+func (s *DeviceService) UpdateDevice(c Caller, id string, p DevicePatch) (*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	var out *domain.SignatureDevice
+	err := s.repo.Update(c.Tenant, id, func(tx storage.Tx) error {
+		d := tx.Device()
+		if err := c.authorize(d, domain.RightAdmin); err != nil {
+			return err
+		}
+		if err := d.PatchTags(p.Tags); err != nil {
+			return err
+		}
+		if err := d.PatchACL(p.ACL); err != nil {
+			return err
+		}
+		if p.Label != nil {
+			d.Label = *p.Label
+		}
+		cp := *d
+		out = &cp
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-// ListDevices used to list all devices in the memory store.
-func (s *DeviceService) ListDevices() ([]*domain.SignatureDevice, error) {
-	return s.repo.List()
+// setAll turns tags or an ACL into a patch that sets each entry.
+func setAll[V any](m map[string]V) map[string]*V {
+	patch := make(map[string]*V, len(m))
+	for k, v := range m {
+		v := v
+		patch[k] = &v
+	}
+	return patch
 }
 
 // Sign used to sign data for a device in the memory store.
-func (s *DeviceService) Sign(id string, data string) (*domain.SignatureResult, error) {
-	if data == "" {
+func (s *DeviceService) Sign(c Caller, id string, data string) (*domain.SignatureResult, error) {
+	return s.SignWith(c, id, SignRequest{Data: data})
+}
+
+// SignRequest holds the inputs of SignWith.
+type SignRequest struct {
+	Data string
+	// IdempotencyKey makes retries safe: repeating it within the idempotency
+	// window returns the original result instead of signing again.
+	IdempotencyKey string
+	// ExpectedCounter, when set, must equal the device's signature counter;
+	// otherwise nothing is signed and a *domain.CounterMismatchError is returned.
+	ExpectedCounter *uint64
+}
+
+// errReplayed aborts an Update that only replays an earlier result, so that
+// nothing is written.
+var errReplayed = errors.New("replayed")
+
+// SignWith used to sign data for a device. The idempotency key and the
+// expected counter are checked inside the device's critical section, so
+// concurrent retries sign at most once and a stale counter never signs.
+// Reusing a key for other data, or with an expected counter other than the
+// one the original was signed at, is ErrIdempotencyConflict.
+func (s *DeviceService) SignWith(c Caller, id string, req SignRequest) (*domain.SignatureResult, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if req.Data == "" || len(req.IdempotencyKey) > MaxIdempotencyKeyLen {
 		return nil, domain.ErrInvalidInput
 	}
 
 	var out *domain.SignatureResult
-	err := s.repo.Update(id, func(d *domain.SignatureDevice, signer domain.Signer) error {
-		var last string
-		if d.SignatureCounter == 0 {
-			last = base64.StdEncoding.EncodeToString([]byte(d.ID))
-		} else {
-			last = d.LastSignatureB64
+	err := s.repo.Update(c.Tenant, id, func(tx storage.Tx) error {
+		if err := c.authorize(tx.Device(), domain.RightSign); err != nil {
+			return err
+		}
+		if req.IdempotencyKey != "" {
+			prev, ok, err := tx.Idempotent(req.IdempotencyKey, s.now().Add(-s.idemWindow))
+			if err != nil {
+				return err
+			}
+			if ok {
+				// the original signed only if its expected counter held, so a
+				// retry of the same request expects the counter it signed at
+				if prev.Data != req.Data || (req.ExpectedCounter != nil && *req.ExpectedCounter != prev.Counter) {
+					return domain.ErrIdempotencyConflict
+				}
+				out = &domain.SignatureResult{SignatureB64: prev.Signature, SignedData: prev.SignedData, Scheme: tx.Device().Scheme, KeyID: prev.KeyID}
+				return errReplayed
+			}
 		}
+		if want := req.ExpectedCounter; want != nil && *want != tx.Device().SignatureCounter {
+			return &domain.CounterMismatchError{Expected: *want, Current: tx.Device().SignatureCounter}
+		}
+		var err error
+		out, err = s.signNext(tx, req.Data, req.IdempotencyKey)
+		return err
+	})
 
-		payload := fmt.Sprintf("%d_%s_%s", d.SignatureCounter, data, last)
-		raw, err := signer.Sign([]byte(payload))
-		if err != nil {
+	if err != nil && !errors.Is(err, errReplayed) {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SignBatch used to sign items in order within one critical section. Each
+// signature chains into the next under consecutive counters, and either all
+// of them are committed or none is.
+func (s *DeviceService) SignBatch(c Caller, id string, items []string) ([]domain.SignatureResult, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, domain.ErrInvalidInput
+	}
+	for _, data := range items {
+		if data == "" {
+			return nil, domain.ErrInvalidInput
+		}
+	}
+
+	var out []domain.SignatureResult
+	err := s.repo.Update(c.Tenant, id, func(tx storage.Tx) error {
+		if err := c.authorize(tx.Device(), domain.RightSign); err != nil {
+			return err
+		}
+		out = make([]domain.SignatureResult, 0, len(items))
+		for _, data := range items {
+			res, err := s.signNext(tx, data, "")
+			if err != nil {
+				return err
+			}
+			out = append(out, *res)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// signNext signs data as the device's next signature inside tx.
+func (s *DeviceService) signNext(tx storage.Tx, data, idemKey string) (*domain.SignatureResult, error) {
+	d := tx.Device()
+	if !d.Active() {
+		return nil, fmt.Errorf("%w: %s", domain.ErrDeviceInactive, d.Status)
+	}
+	var last string
+	if d.SignatureCounter == 0 {
+		last = base64.StdEncoding.EncodeToString([]byte(d.ID))
+	} else {
+		last = d.LastSignatureB64
+	}
+
+	payload, err := d.PayloadFormat.Encode(domain.Payload{Counter: d.SignatureCounter, Data: data, Prev: last})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := tx.Signer().Sign([]byte(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	sigB64 := base64.StdEncoding.EncodeToString(raw)
+	keyID := d.CurrentKey().ID
+	// commit: journal entry, chain head and counter move together
+	tx.Append(domain.SignatureRecord{
+		DeviceID: d.ID, Counter: d.SignatureCounter,
+		Data: data, SignedData: payload, Signature: sigB64, KeyID: keyID,
+		CreatedAt: s.now().UTC(), IdempotencyKey: idemKey,
+	})
+	d.LastSignatureB64 = sigB64
+	d.SignatureCounter++
+	return &domain.SignatureResult{SignatureB64: sigB64, SignedData: payload, Scheme: d.Scheme, KeyID: keyID}, nil
+}
+
+// RotateKey used to replace a device's key. The counter and the chain carry
+// on; the retired key stays in the device's key history for verification.
+func (s *DeviceService) RotateKey(c Caller, id string) (*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	cur, _, err := s.repo.Get(c.Tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authorize(cur, domain.RightAdmin); err != nil {
+		return nil, err
+	}
+	if cur.Status == domain.StatusDecommissioned {
+		return nil, fmt.Errorf("%w: %s", domain.ErrDeviceInactive, cur.Status)
+	}
+	spec, ok := s.algs.Lookup(cur.Algorithm)
+	if !ok {
+		return nil, domain.ErrInvalidAlgorithm
+	}
+	// generate outside the device's critical section: RSA keygen is slow
+	signer, err := spec.New(cur.KeyParams, cur.Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	var out *domain.SignatureDevice
+	err = s.repo.Update(c.Tenant, id, func(tx storage.Tx) error {
+		d := tx.Device()
+		// the ACL may have changed while the key was generated
+		if err := c.authorize(d, domain.RightAdmin); err != nil {
 			return err
 		}
+		if d.Status == domain.StatusDecommissioned {
+			return fmt.Errorf("%w: %s", domain.ErrDeviceInactive, d.Status)
+		}
+		d.RotateKey(signer.PublicPEM())
+		tx.SetSigner(signer)
+		cp := *d
+		out = &cp
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
-		sigB64 := base64.StdEncoding.EncodeToString(raw)
-		// commit
-		d.LastSignatureB64 = sigB64
-		d.SignatureCounter++
-		out = &domain.SignatureResult{SignatureB64: sigB64, SignedData: payload}
+// SetStatus used to move a device through its lifecycle. Suspended devices
+// refuse to sign until reactivated; decommissioning destroys the private key
+// and cannot be undone. Public keys and the journal are kept. When the key
+// could not yet be erased from disk, the committed device is returned along
+// with storage.ErrKeyRetained.
+func (s *DeviceService) SetStatus(c Caller, id string, status domain.DeviceStatus) (*domain.SignatureDevice, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	var out *domain.SignatureDevice
+	err := s.repo.Update(c.Tenant, id, func(tx storage.Tx) error {
+		d := tx.Device()
+		if err := c.authorize(d, domain.RightAdmin); err != nil {
+			return err
+		}
+		if err := d.SetStatus(status); err != nil {
+			return err
+		}
+		if status == domain.StatusDecommissioned {
+			// also when the key is already gone, so a repeated
+			// decommission retries erasing it from disk
+			tx.SetSigner(nil)
+		}
+		cp := *d
+		out = &cp
 		return nil
 	})
+	if err != nil && !errors.Is(err, storage.ErrKeyRetained) {
+		return nil, err
+	}
+	return out, err
+}
+
+// VerifyRequest is one signature to check against a device's keys.
+type VerifyRequest struct {
+	SignedData   string
+	SignatureB64 string
+	// KeyID selects the key. Empty picks the key that signed the counter
+	// SignedData encodes, falling back to the current key.
+	KeyID string
+}
+
+// Verify used to check one signature made by a device.
+func (s *DeviceService) Verify(c Caller, id string, req VerifyRequest) (*domain.VerificationResult, error) {
+	res, err := s.VerifyBatch(c, id, []VerifyRequest{req})
+	if err != nil {
+		return nil, err
+	}
+	if res[0].Err != nil {
+		return nil, res[0].Err
+	}
+	return &res[0], nil
+}
 
+// VerifyBatch used to check many signatures of one device. Problems with a
+// single item are reported in its result, not as the returned error.
+func (s *DeviceService) VerifyBatch(c Caller, id string, reqs []VerifyRequest) ([]domain.VerificationResult, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, domain.ErrInvalidInput
+	}
+	dev, signer, err := s.repo.Get(c.Tenant, id)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.authorize(dev, domain.RightRead); err != nil {
+		return nil, err
+	}
+	dev.EnsureKeys()
+	spec, _ := s.algs.Lookup(dev.Algorithm)
+	out := make([]domain.VerificationResult, len(reqs))
+	for i, req := range reqs {
+		out[i] = verifyOne(dev, signer, spec, req)
+	}
 	return out, nil
 }
+
+func verifyOne(dev *domain.SignatureDevice, signer domain.Signer, spec domain.AlgorithmSpec, req VerifyRequest) domain.VerificationResult {
+	res := domain.VerificationResult{Algorithm: dev.Algorithm, Scheme: dev.Scheme}
+	sig, err := base64.StdEncoding.DecodeString(req.SignatureB64)
+	if err != nil || req.SignedData == "" || len(sig) == 0 {
+		res.Err = domain.ErrInvalidInput
+		return res
+	}
+	key, ok := keyFor(dev, req)
+	if !ok {
+		res.Err = fmt.Errorf("%w: unknown key %q", domain.ErrInvalidInput, req.KeyID)
+		return res
+	}
+	res.KeyID = key.ID
+
+	if key.ID == dev.CurrentKey().ID && signer != nil {
+		res.Valid = signer.Verify([]byte(req.SignedData), sig)
+		return res
+	}
+	if spec.VerifyPublic == nil {
+		res.Err = fmt.Errorf("%w: %s cannot verify retired keys", domain.ErrInvalidAlgorithm, dev.Algorithm)
+		return res
+	}
+	res.Valid, res.Err = spec.VerifyPublic(key.PublicKeyPEM, dev.Scheme, []byte(req.SignedData), sig)
+	return res
+}
+
+// keyFor picks the key a verification request refers to.
+func keyFor(dev *domain.SignatureDevice, req VerifyRequest) (domain.DeviceKey, bool) {
+	if req.KeyID != "" {
+		for _, k := range dev.Keys {
+			if k.ID == req.KeyID {
+				return k, true
+			}
+		}
+		return domain.DeviceKey{}, false
+	}
+	if p, err := dev.PayloadFormat.Decode(req.SignedData); err == nil {
+		if k, ok := dev.KeyFor(p.Counter); ok {
+			return k, true
+		}
+	}
+	return dev.CurrentKey(), true
+}
+
+// ListSignatures used to read a device's signature journal, oldest first.
+func (s *DeviceService) ListSignatures(c Caller, id string, r storage.SignatureRange) ([]domain.SignatureRecord, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	// admins may read every journal; others need the device for its ACL
+	if !c.Can(ScopeAdmin) {
+		dev, _, err := s.repo.Get(c.Tenant, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.authorize(dev, domain.RightRead); err != nil {
+			return nil, err
+		}
+	}
+	return s.repo.Signatures(c.Tenant, id, r)
+}
@@ -1,19 +1,35 @@
 package service
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/oxygenesis/signature/internal/crypto"
 	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/storage"
 )
 
-type fakeFactory struct{}
+// algsReturning registers every built-in algorithm with a constructor returning (s, err).
+func algsReturning(s domain.Signer, err error) *crypto.Registry {
+	r := crypto.NewRegistry()
+	for _, alg := range []domain.Algorithm{domain.AlgRSA, domain.AlgECC, domain.AlgEd25519} {
+		_ = r.Register(domain.AlgorithmSpec{Name: alg, New: func(domain.KeyParams, domain.Scheme) (domain.Signer, error) { return s, err }})
+	}
+	return r
+}
 
-func (fakeFactory) NewRSA(bits int) (domain.Signer, error) { return fakeSigner{}, nil }
-func (fakeFactory) NewECDSA() (domain.Signer, error)       { return fakeSigner{}, nil }
+var fakeAlgs = algsReturning(fakeSigner{}, nil)
 
 type fakeSigner struct{}
 
@@ -22,38 +38,51 @@ func (fakeSigner) Verify(p, s []byte) bool       { return true }
 func (fakeSigner) PublicPEM() string             { return "PEM" }
 func (fakeSigner) AlgorithmName() string         { return "RSA" }
 
+// tc is the caller the tests act as, an admin of its tenant.
+var tc = Caller{Tenant: "acme", Scopes: []Scope{ScopeAdmin}}
+
 type fakeIDs struct{}
 
 func (fakeIDs) New() string { return "id" }
 
 func TestCreateGetListSign(t *testing.T) {
-	svc := New(storage.NewMemory(), fakeFactory{}, fakeIDs{})
-	// invalid
-	if _, err := svc.CreateDevice("", domain.AlgRSA, ""); err == nil {
-		t.Fatal("want invalid input")
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	// no id: generated
+	if d, err := svc.CreateDevice(tc, CreateDeviceRequest{Algorithm: domain.AlgRSA}); err != nil || d.ID != "id" {
+		t.Fatalf("generated id: %+v %v", d, err)
+	}
+	// no id and no generator
+	if _, err := New(storage.NewMemory(), fakeAlgs, nil).CreateDevice(tc, CreateDeviceRequest{Algorithm: domain.AlgRSA}); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("want invalid input, got %v", err)
+	}
+	// ids the device routes could not address
+	for _, id := range []string{"import", "a/b", "/", "..", "."} {
+		if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: id, Algorithm: domain.AlgRSA}); !errors.Is(err, domain.ErrInvalidInput) {
+			t.Fatalf("id %q: want invalid input, got %v", id, err)
+		}
 	}
 	// invalid algorithm
-	if _, err := svc.CreateDevice("x", "BAD", ""); err == nil {
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: "BAD"}); err == nil {
 		t.Fatal("want invalid algo")
 	}
 	// create OK
-	if _, err := svc.CreateDevice("x", domain.AlgRSA, "L"); err != nil {
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA, Label: "L"}); err != nil {
 		t.Fatal(err)
 	}
 	// duplicate
-	if _, err := svc.CreateDevice("x", domain.AlgRSA, "L"); err == nil {
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA, Label: "L"}); err == nil {
 		t.Fatal("want conflict")
 	}
 	// get
-	if _, err := svc.GetDevice("x"); err != nil {
+	if _, err := svc.GetDevice(tc, "x"); err != nil {
 		t.Fatal(err)
 	}
 	// list
-	if list, err := svc.ListDevices(); err != nil || len(list) != 1 {
+	if list, err := svc.ListDevices(tc, storage.DeviceFilter{}); err != nil || len(list) != 2 {
 		t.Fatal("list failed")
 	}
 	// sign
-	res, err := svc.Sign("x", "hello")
+	res, err := svc.Sign(tc, "x", "hello")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,31 +90,31 @@ func TestCreateGetListSign(t *testing.T) {
 		t.Fatalf("bad sign result: %+v", res)
 	}
 	// sign invalid data
-	if _, err := svc.Sign("x", ""); err == nil {
+	if _, err := svc.Sign(tc, "x", ""); err == nil {
 		t.Fatal("want invalid input")
 	}
 	// sign missing id
-	if _, err := svc.Sign("missing", "hi"); err == nil {
+	if _, err := svc.Sign(tc, "missing", "hi"); err == nil {
 		t.Fatal("want not found")
 	}
 }
 
 func TestConcurrentSign_NoGaps(t *testing.T) {
-	svc := New(storage.NewMemory(), fakeFactory{}, fakeIDs{})
-	_, _ = svc.CreateDevice("dev", domain.AlgRSA, "")
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "dev", Algorithm: domain.AlgRSA})
 	const N = 60
 	var wg sync.WaitGroup
 	wg.Add(N)
 	for i := 0; i < N; i++ {
 		go func() {
 			defer wg.Done()
-			if _, err := svc.Sign("dev", "x"); err != nil {
+			if _, err := svc.Sign(tc, "dev", "x"); err != nil {
 				t.Errorf("sign err: %v", err)
 			}
 		}()
 	}
 	wg.Wait()
-	d, _ := svc.GetDevice("dev")
+	d, _ := svc.GetDevice(tc, "dev")
 	if d.SignatureCounter != N {
 		t.Fatalf("counter=%d want=%d", d.SignatureCounter, N)
 	}
@@ -93,14 +122,9 @@ func TestConcurrentSign_NoGaps(t *testing.T) {
 
 // --- error branches ---
 
-type errFactory struct{}
-
-func (errFactory) NewRSA(int) (domain.Signer, error) { return nil, errors.New("factory") }
-func (errFactory) NewECDSA() (domain.Signer, error)  { return nil, errors.New("factory") }
-
 func TestCreateDevice_FactoryError(t *testing.T) {
-	svc := New(storage.NewMemory(), errFactory{}, fakeIDs{})
-	if _, err := svc.CreateDevice("x", domain.AlgRSA, ""); err == nil {
+	svc := New(storage.NewMemory(), algsReturning(nil, errors.New("factory")), fakeIDs{})
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA}); err == nil {
 		t.Fatal("want factory error")
 	}
 }
@@ -121,18 +145,18 @@ func (r *repoWithBadSigner) Create(d *domain.SignatureDevice, _ domain.Signer) e
 
 func TestSign_SignerError(t *testing.T) {
 	repo := &repoWithBadSigner{storage.NewMemory()}
-	svc := New(repo, fakeFactory{}, fakeIDs{})
-	if _, err := svc.CreateDevice("x", domain.AlgRSA, ""); err != nil {
+	svc := New(repo, fakeAlgs, fakeIDs{})
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA}); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := svc.Sign("x", "hi"); err == nil {
+	if _, err := svc.Sign(tc, "x", "hi"); err == nil {
 		t.Fatal("want signer error")
 	}
 }
 
 func TestCreateDevice_ECCPath(t *testing.T) {
-	svc := New(storage.NewMemory(), fakeFactory{}, fakeIDs{})
-	dev, err := svc.CreateDevice("ecc-1", domain.AlgECC, "L")
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	dev, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "ecc-1", Algorithm: domain.AlgECC, Label: "L"})
 	if err != nil {
 		t.Fatalf("CreateDevice ECC err: %v", err)
 	}
@@ -140,3 +164,672 @@ func TestCreateDevice_ECCPath(t *testing.T) {
 		t.Fatalf("unexpected device: %+v", dev)
 	}
 }
+
+func TestCreateDevice_KeyParams(t *testing.T) {
+	algs := crypto.NewRegistry(domain.AlgorithmSpec{
+		Name:        domain.AlgRSA,
+		DefaultKey:  domain.KeyParams{Bits: 2048},
+		AllowedKeys: []domain.KeyParams{{Bits: 2048}, {Bits: 3072}},
+		New: func(p domain.KeyParams, _ domain.Scheme) (domain.Signer, error) {
+			if p.Bits != 3072 {
+				t.Fatalf("constructor got %+v", p)
+			}
+			return fakeSigner{}, nil
+		},
+	})
+	svc := New(storage.NewMemory(), algs, fakeIDs{})
+	dev, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA, KeyParams: domain.KeyParams{Bits: 3072}})
+	if err != nil || dev.KeyParams.Bits != 3072 {
+		t.Fatalf("dev=%+v err=%v", dev, err)
+	}
+	if got, _ := svc.GetDevice(tc, "x"); got.KeyParams.Bits != 3072 {
+		t.Fatalf("key params not persisted: %+v", got)
+	}
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "y", Algorithm: domain.AlgRSA, KeyParams: domain.KeyParams{Bits: 1024}}); !errors.Is(err, domain.ErrInvalidKeyParams) {
+		t.Fatalf("want ErrInvalidKeyParams, got %v", err)
+	}
+}
+
+func TestCreateDevice_Scheme(t *testing.T) {
+	var got domain.Scheme
+	algs := crypto.NewRegistry(domain.AlgorithmSpec{
+		Name:    domain.AlgECC,
+		Schemes: []domain.Scheme{domain.SchemeECDSASHA256, domain.SchemeECDSASHA512},
+		New: func(_ domain.KeyParams, sc domain.Scheme) (domain.Signer, error) {
+			got = sc
+			return fakeSigner{}, nil
+		},
+	})
+	svc := New(storage.NewMemory(), algs, fakeIDs{})
+	dev, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "d", Algorithm: domain.AlgECC})
+	if err != nil || dev.Scheme != domain.SchemeECDSASHA256 || got != domain.SchemeECDSASHA256 {
+		t.Fatalf("default scheme not applied: %+v %q %v", dev, got, err)
+	}
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "e", Algorithm: domain.AlgECC, Scheme: domain.SchemeECDSASHA512}); err != nil || got != domain.SchemeECDSASHA512 {
+		t.Fatalf("scheme not passed to constructor: %q %v", got, err)
+	}
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "f", Algorithm: domain.AlgECC, Scheme: domain.SchemeRSAPSSSHA256}); !errors.Is(err, domain.ErrInvalidScheme) {
+		t.Fatalf("want ErrInvalidScheme, got %v", err)
+	}
+	res, err := svc.Sign(tc, "e", "hi")
+	if err != nil || res.Scheme != domain.SchemeECDSASHA512 {
+		t.Fatalf("sign result scheme: %+v %v", res, err)
+	}
+}
+
+func TestCreateDevice_Ed25519Path(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	dev, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "ed-1", Algorithm: domain.AlgEd25519})
+	if err != nil {
+		t.Fatalf("CreateDevice ED25519 err: %v", err)
+	}
+	if dev.Algorithm != domain.AlgEd25519 {
+		t.Fatalf("unexpected device: %+v", dev)
+	}
+}
+
+func TestSign_JournalsEverySignature(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	svc.now = func() time.Time { return at }
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA})
+	first, _ := svc.Sign(tc, "x", "a_b")
+	second, _ := svc.Sign(tc, "x", "c")
+
+	recs, err := svc.ListSignatures(tc, "x", storage.AllSignatures)
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("recs=%+v err=%v", recs, err)
+	}
+	want := domain.SignatureRecord{DeviceID: "x", Counter: 0, Data: "a_b", SignedData: first.SignedData, Signature: first.SignatureB64, KeyID: domain.FirstKeyID, CreatedAt: at}
+	if recs[0] != want {
+		t.Fatalf("got %+v want %+v", recs[0], want)
+	}
+	if recs[1].Counter != 1 || recs[1].SignedData != second.SignedData {
+		t.Fatalf("second record %+v", recs[1])
+	}
+	if _, err := svc.ListSignatures(tc, "missing", storage.AllSignatures); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want not found, got %v", err)
+	}
+}
+
+func TestListAlgorithms(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	if got := svc.ListAlgorithms(); len(got) != 3 || got[0].Name != domain.AlgRSA {
+		t.Fatalf("algorithms=%+v", got)
+	}
+}
+
+func ecKeyPEM(t *testing.T, curve elliptic.Curve) string {
+	t.Helper()
+	k, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func TestImportDevice_ContinuesChain(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	key := ecKeyPEM(t, elliptic.P256())
+	dev, err := svc.ImportDevice(tc, ImportDeviceRequest{
+		ID: "m", Algorithm: domain.AlgECC, PrivateKeyPEM: key,
+		SignatureCounter: 5, LastSignatureB64: "cHJldg==",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.KeyParams.Curve != "P-256" || dev.Scheme != domain.SchemeECDSASHA256 || dev.SignatureCounter != 5 {
+		t.Fatalf("imported device %+v", dev)
+	}
+	res, err := svc.Sign(tc, "m", "hello")
+	if err != nil || res.SignedData != "5_hello_cHJldg==" {
+		t.Fatalf("chain not continued: %+v %v", res, err)
+	}
+	if got, _ := svc.GetDevice(tc, "m"); got.SignatureCounter != 6 {
+		t.Fatalf("counter=%d", got.SignatureCounter)
+	}
+	// the same key cannot be imported twice under one id
+	if _, err := svc.ImportDevice(tc, ImportDeviceRequest{ID: "m", Algorithm: domain.AlgECC, PrivateKeyPEM: key}); !errors.Is(err, domain.ErrAlreadyExists) {
+		t.Fatalf("want ErrAlreadyExists, got %v", err)
+	}
+}
+
+func TestImportDevice_Validation(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	key := ecKeyPEM(t, elliptic.P256())
+	cases := []struct {
+		name string
+		req  ImportDeviceRequest
+		want error
+	}{
+		{"no id", ImportDeviceRequest{Algorithm: domain.AlgECC, PrivateKeyPEM: key}, domain.ErrInvalidInput},
+		{"reserved id", ImportDeviceRequest{ID: "import", Algorithm: domain.AlgECC, PrivateKeyPEM: key}, domain.ErrInvalidInput},
+		{"id with slash", ImportDeviceRequest{ID: "a/sign", Algorithm: domain.AlgECC, PrivateKeyPEM: key}, domain.ErrInvalidInput},
+		{"no key", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC}, domain.ErrInvalidInput},
+		{"counter without head", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC, PrivateKeyPEM: key, SignatureCounter: 3}, domain.ErrInvalidInput},
+		{"head without counter", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC, PrivateKeyPEM: key, LastSignatureB64: "eA=="}, domain.ErrInvalidInput},
+		{"bad head", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC, PrivateKeyPEM: key, SignatureCounter: 1, LastSignatureB64: "%%"}, domain.ErrInvalidInput},
+		{"unknown alg", ImportDeviceRequest{ID: "a", Algorithm: "BAD", PrivateKeyPEM: key}, domain.ErrInvalidAlgorithm},
+		{"key/alg mismatch", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgRSA, PrivateKeyPEM: key}, domain.ErrInvalidKey},
+		{"bad scheme", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC, PrivateKeyPEM: key, Scheme: domain.SchemeEd25519}, domain.ErrInvalidScheme},
+		{"curve not allowed", ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC, PrivateKeyPEM: ecKeyPEM(t, elliptic.P224())}, domain.ErrInvalidKeyParams},
+	}
+	for _, c := range cases {
+		if _, err := svc.ImportDevice(tc, c.req); !errors.Is(err, c.want) {
+			t.Fatalf("%s: want %v, got %v", c.name, c.want, err)
+		}
+	}
+	// algorithms without an importer cannot take external keys
+	if _, err := New(storage.NewMemory(), fakeAlgs, fakeIDs{}).ImportDevice(tc, ImportDeviceRequest{ID: "a", Algorithm: domain.AlgECC, PrivateKeyPEM: key}); !errors.Is(err, domain.ErrInvalidAlgorithm) {
+		t.Fatalf("want ErrInvalidAlgorithm, got %v", err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	dev, _ := svc.CreateDevice(tc, CreateDeviceRequest{ID: "r", Algorithm: domain.AlgECC, Scheme: domain.SchemeECDSASHA384})
+	first, _ := svc.Sign(tc, "r", "a")
+	_, _ = svc.Sign(tc, "r", "b")
+
+	rotated, err := svc.RotateKey(tc, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.PublicKeyPEM == dev.PublicKeyPEM || len(rotated.Keys) != 2 || rotated.SignatureCounter != 2 {
+		t.Fatalf("rotated device %+v", rotated)
+	}
+	third, err := svc.Sign(tc, "r", "c")
+	if err != nil || third.KeyID != "k2" || first.KeyID != domain.FirstKeyID || third.Scheme != domain.SchemeECDSASHA384 {
+		t.Fatalf("key ids %q/%q scheme %q err %v", first.KeyID, third.KeyID, third.Scheme, err)
+	}
+	if !strings.HasPrefix(third.SignedData, "2_c_") {
+		t.Fatalf("chain did not carry on: %q", third.SignedData)
+	}
+
+	// every journal entry verifies with the key its key_id names
+	got, _ := svc.GetDevice(tc, "r")
+	recs, _ := svc.ListSignatures(tc, "r", storage.AllSignatures)
+	for _, rec := range recs {
+		k, ok := got.KeyFor(rec.Counter)
+		if !ok || k.ID != rec.KeyID {
+			t.Fatalf("counter %d: key %+v, record says %q", rec.Counter, k, rec.KeyID)
+		}
+		verifyECDSA384(t, k.PublicKeyPEM, rec)
+	}
+
+	if _, err := svc.RotateKey(tc, "missing"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+	boom := errors.New("keygen")
+	failing := New(storage.NewMemory(), algsReturning(nil, boom), fakeIDs{})
+	_ = failing.repo.Create(&domain.SignatureDevice{Tenant: tc.Tenant, ID: "f", Algorithm: domain.AlgRSA}, fakeSigner{})
+	if _, err := failing.RotateKey(tc, "f"); !errors.Is(err, boom) {
+		t.Fatalf("want keygen error, got %v", err)
+	}
+}
+
+func verifyECDSA384(t *testing.T, pubPEM string, rec domain.SignatureRecord) {
+	t.Helper()
+	block, _ := pem.Decode([]byte(pubPEM))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(rec.Signature)
+	h := sha512.Sum384([]byte(rec.SignedData))
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], sig) {
+		t.Fatalf("counter %d does not verify with key %s", rec.Counter, rec.KeyID)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "v", Algorithm: domain.AlgEd25519})
+	old, _ := svc.Sign(tc, "v", "a")
+	if _, err := svc.RotateKey(tc, "v"); err != nil {
+		t.Fatal(err)
+	}
+	cur, _ := svc.Sign(tc, "v", "b")
+
+	// the counter prefix picks the key; retired keys still verify
+	for _, s := range []*domain.SignatureResult{old, cur} {
+		res, err := svc.Verify(tc, "v", VerifyRequest{SignedData: s.SignedData, SignatureB64: s.SignatureB64})
+		if err != nil || !res.Valid || res.KeyID != s.KeyID || res.Algorithm != domain.AlgEd25519 || res.Scheme != domain.SchemeEd25519 {
+			t.Fatalf("verify %+v: %+v %v", s, res, err)
+		}
+	}
+	// an explicit key id wins, and the wrong key does not verify
+	res, err := svc.Verify(tc, "v", VerifyRequest{SignedData: old.SignedData, SignatureB64: old.SignatureB64, KeyID: "k2"})
+	if err != nil || res.Valid || res.KeyID != "k2" {
+		t.Fatalf("wrong key: %+v %v", res, err)
+	}
+	// data without a counter prefix is checked against the current key
+	res, _ = svc.Verify(tc, "v", VerifyRequest{SignedData: "free-form", SignatureB64: cur.SignatureB64})
+	if res.Valid || res.KeyID != "k2" {
+		t.Fatalf("free-form: %+v", res)
+	}
+
+	for name, req := range map[string]VerifyRequest{
+		"not base64":  {SignedData: "x", SignatureB64: "%%"},
+		"no data":     {SignatureB64: cur.SignatureB64},
+		"unknown key": {SignedData: "x", SignatureB64: cur.SignatureB64, KeyID: "k9"},
+	} {
+		if _, err := svc.Verify(tc, "v", req); !errors.Is(err, domain.ErrInvalidInput) {
+			t.Fatalf("%s: want ErrInvalidInput, got %v", name, err)
+		}
+	}
+	if _, err := svc.Verify(tc, "missing", VerifyRequest{SignedData: "x", SignatureB64: "eA=="}); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+
+	results, err := svc.VerifyBatch(tc, "v", []VerifyRequest{
+		{SignedData: old.SignedData, SignatureB64: old.SignatureB64},
+		{SignedData: cur.SignedData, SignatureB64: old.SignatureB64},
+		{SignedData: "x", SignatureB64: "%%"},
+	})
+	if err != nil || !results[0].Valid || results[1].Valid || results[2].Err == nil {
+		t.Fatalf("batch: %+v %v", results, err)
+	}
+	if _, err := svc.VerifyBatch(tc, "v", nil); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("empty batch: %v", err)
+	}
+}
+
+func TestPayloadV1_SignAndVerify(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "j", Algorithm: domain.AlgEd25519, PayloadFormat: domain.PayloadV1})
+	first, _ := svc.Sign(tc, "j", "a_b")
+	want := `{"v":1,"counter":0,"data":"a_b","prev":"ag=="}`
+	if first.SignedData != want {
+		t.Fatalf("signed %q want %q", first.SignedData, want)
+	}
+	_, _ = svc.RotateKey(tc, "j")
+	second, _ := svc.Sign(tc, "j", "c")
+	if !strings.Contains(second.SignedData, `"prev":"`+first.SignatureB64+`"`) {
+		t.Fatalf("chain not linked: %q", second.SignedData)
+	}
+	// the counter inside the JSON picks the retired key
+	res, err := svc.Verify(tc, "j", VerifyRequest{SignedData: first.SignedData, SignatureB64: first.SignatureB64})
+	if err != nil || !res.Valid || res.KeyID != domain.FirstKeyID {
+		t.Fatalf("verify v1: %+v %v", res, err)
+	}
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "k", Algorithm: domain.AlgEd25519, PayloadFormat: "v9"}); !errors.Is(err, domain.ErrInvalidPayloadFormat) {
+		t.Fatalf("want ErrInvalidPayloadFormat, got %v", err)
+	}
+}
+
+func TestSignWith_IdempotencyKey(t *testing.T) {
+	svc := New(storage.NewMemory(), algsReturning(&flakySigner{}, nil), fakeIDs{})
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return at }
+	svc.SetIdempotencyWindow(time.Hour)
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "i", Algorithm: domain.AlgRSA})
+
+	first, err := svc.SignWith(tc, "i", SignRequest{Data: "a", IdempotencyKey: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := svc.SignWith(tc, "i", SignRequest{Data: "a", IdempotencyKey: "k"})
+	if err != nil || *again != *first {
+		t.Fatalf("retry signed again: %+v vs %+v (%v)", again, first, err)
+	}
+	if _, err := svc.SignWith(tc, "i", SignRequest{Data: "b", IdempotencyKey: "k"}); !errors.Is(err, domain.ErrIdempotencyConflict) {
+		t.Fatalf("want ErrIdempotencyConflict, got %v", err)
+	}
+	if d, _ := svc.GetDevice(tc, "i"); d.SignatureCounter != 1 {
+		t.Fatalf("counter=%d after retries", d.SignatureCounter)
+	}
+
+	// past the window the key signs again
+	at = at.Add(time.Hour)
+	later, _ := svc.SignWith(tc, "i", SignRequest{Data: "b", IdempotencyKey: "k"})
+	if later.SignedData == first.SignedData || !strings.HasPrefix(later.SignedData, "1_b_") {
+		t.Fatalf("expired key replayed: %+v", later)
+	}
+	if again, err := svc.SignWith(tc, "i", SignRequest{Data: "b", IdempotencyKey: "k"}); err != nil || *again != *later {
+		t.Fatalf("reused key not replayed: %+v vs %+v (%v)", again, later, err)
+	}
+	if _, err := svc.SignWith(tc, "i", SignRequest{Data: "a", IdempotencyKey: strings.Repeat("x", MaxIdempotencyKeyLen+1)}); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("want ErrInvalidInput for a long key, got %v", err)
+	}
+}
+
+func TestSignWith_ConcurrentRetriesSignOnce(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "c", Algorithm: domain.AlgRSA})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := svc.SignWith(tc, "c", SignRequest{Data: "x", IdempotencyKey: "same"}); err != nil {
+				t.Errorf("sign: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d, _ := svc.GetDevice(tc, "c"); d.SignatureCounter != 1 {
+		t.Fatalf("counter=%d", d.SignatureCounter)
+	}
+}
+
+func TestSignWith_ExpectedCounter(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "e", Algorithm: domain.AlgRSA})
+	at := func(c uint64) *uint64 { return &c }
+
+	if _, err := svc.SignWith(tc, "e", SignRequest{Data: "a", ExpectedCounter: at(0)}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := svc.SignWith(tc, "e", SignRequest{Data: "b", ExpectedCounter: at(0)})
+	var mismatch *domain.CounterMismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, domain.ErrCounterMismatch) || mismatch.Current != 1 || mismatch.Expected != 0 {
+		t.Fatalf("want counter mismatch at 1, got %v", err)
+	}
+	if d, _ := svc.GetDevice(tc, "e"); d.SignatureCounter != 1 {
+		t.Fatalf("stale request signed: counter=%d", d.SignatureCounter)
+	}
+	// an idempotent retry of the request that succeeded replays instead of failing the check
+	first, _ := svc.SignWith(tc, "e", SignRequest{Data: "c", IdempotencyKey: "k", ExpectedCounter: at(1)})
+	retry, err := svc.SignWith(tc, "e", SignRequest{Data: "c", IdempotencyKey: "k", ExpectedCounter: at(1)})
+	if err != nil || *retry != *first {
+		t.Fatalf("retry: %+v %v", retry, err)
+	}
+	// reusing the key with another expected counter is a different request
+	if _, err := svc.SignWith(tc, "e", SignRequest{Data: "c", IdempotencyKey: "k", ExpectedCounter: at(2)}); !errors.Is(err, domain.ErrIdempotencyConflict) {
+		t.Fatalf("want ErrIdempotencyConflict, got %v", err)
+	}
+	if retry, err := svc.SignWith(tc, "e", SignRequest{Data: "c", IdempotencyKey: "k"}); err != nil || *retry != *first {
+		t.Fatalf("retry without counter: %+v %v", retry, err)
+	}
+}
+
+func TestSetStatus_Lifecycle(t *testing.T) {
+	repo := storage.NewMemory()
+	svc := New(repo, crypto.Default(), fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "l", Algorithm: domain.AlgEd25519})
+	sig, _ := svc.Sign(tc, "l", "a")
+
+	if d, err := svc.SetStatus(tc, "l", domain.StatusSuspended); err != nil || d.Status != domain.StatusSuspended {
+		t.Fatalf("suspend: %+v %v", d, err)
+	}
+	if _, err := svc.Sign(tc, "l", "b"); !errors.Is(err, domain.ErrDeviceInactive) {
+		t.Fatalf("suspended device signed: %v", err)
+	}
+	if _, err := svc.SignBatch(tc, "l", []string{"b"}); !errors.Is(err, domain.ErrDeviceInactive) {
+		t.Fatalf("suspended device batch-signed: %v", err)
+	}
+	_, _ = svc.SetStatus(tc, "l", domain.StatusActive)
+	if _, err := svc.Sign(tc, "l", "b"); err != nil {
+		t.Fatalf("reactivated device: %v", err)
+	}
+
+	dev, err := svc.SetStatus(tc, "l", domain.StatusDecommissioned)
+	if err != nil || dev.Status != domain.StatusDecommissioned || dev.PublicKeyPEM == "" {
+		t.Fatalf("decommission: %+v %v", dev, err)
+	}
+	if _, signer, _ := repo.Get(tc.Tenant, "l"); signer != nil {
+		t.Fatal("private key survived decommissioning")
+	}
+	if res, err := svc.Verify(tc, "l", VerifyRequest{SignedData: sig.SignedData, SignatureB64: sig.SignatureB64}); err != nil || !res.Valid {
+		t.Fatalf("history no longer verifies: %+v %v", res, err)
+	}
+	if _, err := svc.Sign(tc, "l", "c"); !errors.Is(err, domain.ErrDeviceInactive) {
+		t.Fatalf("decommissioned device signed: %v", err)
+	}
+	if _, err := svc.RotateKey(tc, "l"); !errors.Is(err, domain.ErrDeviceInactive) {
+		t.Fatalf("decommissioned device rotated: %v", err)
+	}
+	if _, err := svc.SetStatus(tc, "l", domain.StatusActive); !errors.Is(err, domain.ErrInvalidTransition) {
+		t.Fatalf("want ErrInvalidTransition, got %v", err)
+	}
+	if _, err := svc.SetStatus(tc, "missing", domain.StatusSuspended); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestVerify_RetiredKeyWithoutPublicVerifier(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "f", Algorithm: domain.AlgRSA})
+	first, _ := svc.Sign(tc, "f", "a")
+	_, _ = svc.RotateKey(tc, "f")
+	if _, err := svc.Verify(tc, "f", VerifyRequest{SignedData: first.SignedData, SignatureB64: first.SignatureB64}); !errors.Is(err, domain.ErrInvalidAlgorithm) {
+		t.Fatalf("want ErrInvalidAlgorithm, got %v", err)
+	}
+}
+
+// flakySigner fails its n-th Sign call.
+type flakySigner struct {
+	fakeSigner
+	calls, failAt int
+}
+
+func (f *flakySigner) Sign(p []byte) ([]byte, error) {
+	f.calls++
+	if f.calls == f.failAt {
+		return nil, errors.New("hsm hiccup")
+	}
+	return []byte{byte(f.calls)}, nil
+}
+
+func TestSignBatch_ChainsConsecutiveCounters(t *testing.T) {
+	svc := New(storage.NewMemory(), algsReturning(&flakySigner{}, nil), fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "b", Algorithm: domain.AlgRSA})
+	_, _ = svc.Sign(tc, "b", "first")
+
+	res, err := svc.SignBatch(tc, "b", []string{"x", "y", "z"})
+	if err != nil || len(res) != 3 {
+		t.Fatalf("res=%+v err=%v", res, err)
+	}
+	prev, _ := svc.ListSignatures(tc, "b", storage.SignatureRange{To: 0})
+	last := prev[0].Signature
+	for i, r := range res {
+		want := fmt.Sprintf("%d_%s_%s", i+1, []string{"x", "y", "z"}[i], last)
+		if r.SignedData != want {
+			t.Fatalf("item %d: %q want %q", i, r.SignedData, want)
+		}
+		last = r.SignatureB64
+	}
+	if d, _ := svc.GetDevice(tc, "b"); d.SignatureCounter != 4 || d.LastSignatureB64 != last {
+		t.Fatalf("device after batch %+v", d)
+	}
+}
+
+func TestSignBatch_AllOrNothing(t *testing.T) {
+	signer := &flakySigner{failAt: 3}
+	svc := New(storage.NewMemory(), algsReturning(signer, nil), fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "b", Algorithm: domain.AlgRSA})
+
+	if _, err := svc.SignBatch(tc, "b", []string{"a", "b", "c", "d"}); err == nil {
+		t.Fatal("want signer error")
+	}
+	d, _ := svc.GetDevice(tc, "b")
+	recs, _ := svc.ListSignatures(tc, "b", storage.AllSignatures)
+	if d.SignatureCounter != 0 || d.LastSignatureB64 != "" || len(recs) != 0 {
+		t.Fatalf("partial batch committed: %+v, %d records", d, len(recs))
+	}
+
+	for name, items := range map[string][]string{"empty": nil, "blank item": {"a", ""}} {
+		if _, err := svc.SignBatch(tc, "b", items); !errors.Is(err, domain.ErrInvalidInput) {
+			t.Fatalf("%s: want ErrInvalidInput, got %v", name, err)
+		}
+	}
+	if _, err := svc.SignBatch(tc, "missing", []string{"a"}); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestUpdateDevice_LabelAndTags(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "t", Algorithm: domain.AlgEd25519, Label: "old", Tags: map[string]string{"store": "berlin"}})
+	_, _ = svc.CreateDevice(tc, CreateDeviceRequest{ID: "u", Algorithm: domain.AlgEd25519})
+	if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: "v", Algorithm: domain.AlgEd25519, Tags: map[string]string{"no spaces": "x"}}); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("want ErrInvalidInput, got %v", err)
+	}
+
+	label, till := "new", "3"
+	dev, err := svc.UpdateDevice(tc, "t", DevicePatch{Label: &label, Tags: map[string]*string{"till": &till}})
+	if err != nil || dev.Label != "new" || len(dev.Tags) != 2 || dev.Tags["till"] != "3" {
+		t.Fatalf("patched %+v %v", dev, err)
+	}
+	// tags only: the label stays
+	if dev, _ = svc.UpdateDevice(tc, "t", DevicePatch{Tags: map[string]*string{"store": nil}}); dev.Label != "new" || len(dev.Tags) != 1 {
+		t.Fatalf("patched %+v", dev)
+	}
+	if _, err := svc.UpdateDevice(tc, "t", DevicePatch{Tags: map[string]*string{"": &till}}); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("want ErrInvalidInput, got %v", err)
+	}
+	if _, err := svc.UpdateDevice(tc, "missing", DevicePatch{Label: &label}); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+
+	list, err := svc.ListDevices(tc, storage.DeviceFilter{Tags: map[string]string{"till": "3"}})
+	if err != nil || len(list) != 1 || list[0].ID != "t" {
+		t.Fatalf("filtered list %+v %v", list, err)
+	}
+}
+
+func TestTenants_AreIsolated(t *testing.T) {
+	svc := New(storage.NewMemory(), crypto.Default(), fakeIDs{})
+	acme, globex := Caller{Tenant: "acme", Scopes: tc.Scopes}, Caller{Tenant: "globex", Scopes: tc.Scopes}
+	for _, c := range []Caller{acme, globex} {
+		if d, err := svc.CreateDevice(c, CreateDeviceRequest{ID: "till", Algorithm: domain.AlgEd25519}); err != nil || d.Tenant != c.Tenant {
+			t.Fatalf("%s: %+v %v", c.Tenant, d, err)
+		}
+	}
+	sig, _ := svc.Sign(acme, "till", "a")
+	if d, _ := svc.GetDevice(globex, "till"); d.SignatureCounter != 0 {
+		t.Fatalf("acme's signature moved globex's counter: %+v", d)
+	}
+	// globex's device of the same name has another key
+	if res, err := svc.Verify(globex, "till", VerifyRequest{SignedData: sig.SignedData, SignatureB64: sig.SignatureB64}); err != nil || res.Valid {
+		t.Fatalf("acme's signature verified with globex's key: %+v %v", res, err)
+	}
+
+	other := Caller{Tenant: "initech", Scopes: tc.Scopes}
+	if _, err := svc.GetDevice(other, "till"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+	if _, err := svc.Sign(other, "till", "x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+	if list, _ := svc.ListDevices(other, storage.DeviceFilter{}); len(list) != 0 {
+		t.Fatalf("list=%+v", list)
+	}
+	if _, err := svc.GetDevice(Caller{}, "till"); !errors.Is(err, domain.ErrInvalidInput) {
+		t.Fatalf("no tenant: want ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestDeviceACL(t *testing.T) {
+	svc := New(storage.NewMemory(), fakeAlgs, fakeIDs{})
+	reg1 := Caller{Tenant: "acme", Principal: "key:reg1", Scopes: []Scope{ScopeSign}}
+	reg2 := Caller{Tenant: "acme", Principal: "key:reg2", Scopes: []Scope{ScopeSign, ScopeRead}}
+	dash := Caller{Tenant: "acme", Principal: "jwt:dash", Scopes: []Scope{ScopeRead}}
+	ops := Caller{Tenant: "acme", Principal: "cert:CN=ops", Scopes: []Scope{ScopeManage}}
+	denied := func(err error) bool { return errors.Is(err, domain.ErrForbidden) }
+
+	if _, err := svc.CreateDevice(reg1, CreateDeviceRequest{ID: "x", Algorithm: domain.AlgRSA}); !denied(err) {
+		t.Fatalf("create without scope: %v", err)
+	}
+	for id, acl := range map[string]map[string]domain.DeviceRight{
+		"till-1": {"key:reg1": domain.RightSign, "cert:CN=ops": domain.RightAdmin},
+		"till-2": {"key:reg2": domain.RightSign},
+		"open":   nil,
+	} {
+		if _, err := svc.CreateDevice(tc, CreateDeviceRequest{ID: id, Algorithm: domain.AlgRSA, ACL: acl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a register signs with its own device only; devices without an ACL go by scope
+	if _, err := svc.Sign(reg1, "till-1", "a"); err != nil {
+		t.Fatalf("own device: %v", err)
+	}
+	for name, err := range map[string]error{
+		"other register's device":  func() error { _, err := svc.Sign(reg1, "till-2", "a"); return err }(),
+		"batch on other device":    func() error { _, err := svc.SignBatch(reg2, "till-1", []string{"a"}); return err }(),
+		"reader signs":             func() error { _, err := svc.Sign(dash, "open", "a"); return err }(),
+		"reader gets listed dev":   func() error { _, err := svc.GetDevice(dash, "till-1"); return err }(),
+		"sign right cannot patch":  func() error { _, err := svc.UpdateDevice(reg1, "till-1", DevicePatch{}); return err }(),
+		"sign right cannot rotate": func() error { _, err := svc.RotateKey(reg1, "till-1"); return err }(),
+		"journal":                  func() error { _, err := svc.ListSignatures(reg2, "till-1", storage.SignatureRange{}); return err }(),
+		"verify": func() error {
+			_, err := svc.VerifyBatch(dash, "till-2", []VerifyRequest{{SignedData: "x", SignatureB64: "eA=="}})
+			return err
+		}(),
+	} {
+		if !denied(err) {
+			t.Fatalf("%s: want ErrForbidden, got %v", name, err)
+		}
+	}
+	if _, err := svc.Sign(reg1, "open", "a"); err != nil {
+		t.Fatalf("open device with sign scope: %v", err)
+	}
+	// sign includes read, for callers whose scopes allow reading
+	if _, err := svc.GetDevice(reg2, "till-2"); err != nil {
+		t.Fatalf("sign right reads: %v", err)
+	}
+
+	// scopes are the upper limit: an ACL never grants more than they do
+	right := domain.RightRead
+	sign := domain.RightSign
+	admin := domain.RightAdmin
+	if _, err := svc.UpdateDevice(tc, "till-2", DevicePatch{ACL: map[string]*domain.DeviceRight{"jwt:dash": &sign, "key:reg2": &admin}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"read without read scope": func() error { _, err := svc.GetDevice(reg1, "till-1"); return err }(),
+		"list without read scope": func() error { _, err := svc.ListDevices(reg1, storage.DeviceFilter{}); return err }(),
+		"sign with read scope":    func() error { _, err := svc.Sign(dash, "till-2", "a"); return err }(),
+		"ACL admin without scope": func() error { _, err := svc.SetStatus(reg2, "till-2", domain.StatusSuspended); return err }(),
+	} {
+		if !denied(err) {
+			t.Fatalf("%s: want ErrForbidden, got %v", name, err)
+		}
+	}
+	if _, err := svc.GetDevice(dash, "till-2"); err != nil {
+		t.Fatalf("listed reader: %v", err)
+	}
+
+	// lists leave out what the caller may not read, and still fill the page
+	list, err := svc.ListDevices(reg2, storage.DeviceFilter{Limit: 2})
+	if err != nil || len(list) != 2 || list[0].ID != "open" || list[1].ID != "till-2" {
+		t.Fatalf("list=%+v err=%v", list, err)
+	}
+
+	// tenant admins manage every ACL
+	dev, err := svc.UpdateDevice(tc, "till-1", DevicePatch{ACL: map[string]*domain.DeviceRight{"jwt:dash": &right, "key:reg1": nil}})
+	if err != nil || len(dev.ACL) != 2 || dev.ACL["jwt:dash"] != domain.RightRead {
+		t.Fatalf("acl patch: %+v %v", dev, err)
+	}
+	if _, err := svc.Sign(reg1, "till-1", "b"); !denied(err) {
+		t.Fatalf("revoked principal: %v", err)
+	}
+
+	// an ACL admin with the manage scope manages its own device, and no other
+	if _, err := svc.SetStatus(ops, "till-1", domain.StatusSuspended); err != nil {
+		t.Fatalf("ACL admin suspends: %v", err)
+	}
+	if _, err := svc.RotateKey(ops, "till-1"); err != nil {
+		t.Fatalf("ACL admin rotates: %v", err)
+	}
+	if _, err := svc.UpdateDevice(ops, "till-1", DevicePatch{ACL: map[string]*domain.DeviceRight{"jwt:dash": nil}}); err != nil {
+		t.Fatalf("ACL admin patches: %v", err)
+	}
+	if _, err := svc.SetStatus(ops, "till-2", domain.StatusSuspended); !denied(err) {
+		t.Fatalf("ACL admin of another device: %v", err)
+	}
+
+	bad := domain.DeviceRight("owner")
+	for name, acl := range map[string]map[string]*domain.DeviceRight{
+		"right":     {"key:x": &bad},
+		"principal": {"": &right},
+		"control":   {"key:\n": &right},
+	} {
+		if _, err := svc.UpdateDevice(tc, "till-2", DevicePatch{ACL: acl}); !errors.Is(err, domain.ErrInvalidInput) {
+			t.Fatalf("%s: want ErrInvalidInput, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,756 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+const (
+	walName      = "wal.log"
+	snapshotName = "snapshot.json"
+	journalName  = "journal.log"
+
+	opCreate = "create"
+	opUpdate = "update"
+)
+
+// walRecord is one line of the write-ahead log. Records carry the full device
+// state, so replaying them is idempotent.
+type walRecord struct {
+	Seq     uint64                   `json:"seq"`
+	Op      string                   `json:"op"`
+	Device  *domain.SignatureDevice  `json:"device"`
+	Key     string                   `json:"key,omitempty"`
+	DropKey bool                     `json:"drop_key,omitempty"`
+	Records []domain.SignatureRecord `json:"records,omitempty"`
+}
+
+type snapshotEntry struct {
+	Device *domain.SignatureDevice `json:"device"`
+	Key    string                  `json:"key"`
+	// Journal is only found in snapshots written before the journal moved
+	// to its own segment; it is copied there on load.
+	Journal []domain.SignatureRecord `json:"journal,omitempty"`
+}
+
+// snapshotFile holds every device as of log sequence Seq, and how much of
+// the journal segment belongs to that state.
+type snapshotFile struct {
+	Seq         uint64          `json:"seq"`
+	JournalSize int64           `json:"journal_size"`
+	Devices     []snapshotEntry `json:"devices"`
+}
+
+// journalEntry is one line of the journal segment.
+type journalEntry struct {
+	Tenant string                 `json:"tenant"`
+	Device string                 `json:"device"`
+	Record domain.SignatureRecord `json:"record"`
+}
+
+// journalRef locates one of a device's records in the journal segment.
+type journalRef struct {
+	counter uint64
+	off     int64
+	size    int64
+}
+
+type fileRec struct {
+	mu     sync.Mutex // serialises Update closures for the device
+	dev    atomic.Pointer[domain.SignatureDevice]
+	signer domain.Signer
+	key    string
+
+	jmu  sync.RWMutex // guards refs and signer for readers; writers also hold File.walMu
+	refs []journalRef
+	idem *idempotencyIndex // positions in refs; read and written under mu
+}
+
+func (r *fileRec) currentSigner() domain.Signer {
+	r.jmu.RLock()
+	defer r.jmu.RUnlock()
+	return r.signer
+}
+
+// appendJournal indexes recs, which were written to the journal at refs.
+func (r *fileRec) appendJournal(recs []domain.SignatureRecord, refs []journalRef) {
+	if len(recs) == 0 {
+		return
+	}
+	r.jmu.Lock()
+	for i, rec := range recs {
+		r.idem.add(rec, len(r.refs)+i)
+	}
+	r.refs = append(r.refs, refs...)
+	r.jmu.Unlock()
+}
+
+// File is a durable Repository: an append-only write-ahead log plus periodic
+// snapshots in a directory. A change becomes visible only after its log record
+// has been fsynced, so a restart restores the exact counter and chain state.
+//
+// Signature records go to a separate append-only journal segment and only an
+// index of their offsets is kept in memory, so snapshots hold device state
+// alone. The segment is fsynced by each snapshot, which records its size;
+// records past that size are covered by the log and rewritten from it on
+// restart.
+type File struct {
+	dir           string
+	codec         KeyCodec
+	snapshotEvery int
+
+	mu   sync.RWMutex // guards data; acquired before walMu
+	data map[deviceKey]*fileRec
+
+	walMu     sync.Mutex // serialises log appends, commits and snapshots
+	wal       *os.File
+	seq       uint64
+	sinceSnap int
+	broken    error
+	down      atomic.Pointer[error] // broken, or ErrClosed after Close, for readers that skip walMu
+	purge     bool                  // a destroyed key is still in the log or the last snapshot
+
+	journal *os.File // opened once; read without locks, appended under walMu
+	jsize   int64    // guarded by walMu
+}
+
+// OpenFile opens (or initialises) the store in dir, replaying the latest
+// snapshot and the log. A snapshot is written after every snapshotEvery log
+// records; 0 disables periodic snapshots.
+func OpenFile(dir string, codec KeyCodec, snapshotEvery int) (*File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(filepath.Join(dir, journalName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{dir: dir, codec: codec, snapshotEvery: snapshotEvery, data: make(map[deviceKey]*fileRec), journal: journal}
+	if err := f.load(); err != nil {
+		journal.Close()
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	f.wal = wal
+	return f, nil
+}
+
+func (f *File) load() error {
+	if err := f.loadSnapshot(); err != nil {
+		return err
+	}
+	return f.replay()
+}
+
+// Create used to create a new device in the file store.
+func (f *File) Create(dev *domain.SignatureDevice, signer domain.Signer) error {
+	key, err := f.codec.MarshalSigner(signer)
+	if err != nil {
+		return err
+	}
+	if err := f.create(dev, signer, key); err != nil {
+		return err
+	}
+	f.snapshotIfDue()
+	return nil
+}
+
+func (f *File) create(dev *domain.SignatureDevice, signer domain.Signer, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[keyOf(dev)]; ok {
+		return domain.ErrAlreadyExists
+	}
+	cp := *dev
+	return f.commit(walRecord{Op: opCreate, Device: &cp, Key: key}, func([]journalRef) {
+		r := &fileRec{signer: signer, key: key, idem: newIdempotencyIndex()}
+		r.dev.Store(&cp)
+		f.data[keyOf(&cp)] = r
+	})
+}
+
+// Get used to get a device from the file store.
+func (f *File) Get(tenant, id string) (*domain.SignatureDevice, domain.Signer, error) {
+	f.mu.RLock()
+	r, ok := f.data[deviceKey{tenant, id}]
+	f.mu.RUnlock()
+	if !ok {
+		return nil, nil, domain.ErrNotFound
+	}
+	cp := *r.dev.Load()
+	return &cp, r.currentSigner(), nil
+}
+
+// List used to lists the tenant's devices in the file store that match flt.
+func (f *File) List(tenant string, flt DeviceFilter) ([]*domain.SignatureDevice, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	page := newDevicePage(flt.Limit)
+	for k, r := range f.data {
+		if k.tenant != tenant {
+			continue
+		}
+		if d := r.dev.Load(); flt.Match(d) {
+			page.offer(d)
+		}
+	}
+	return page.devices(), nil
+}
+
+// Update runs fn on a copy of the device and commits the result only once it
+// has been fsynced to the log. If fn or the log write fails nothing changes.
+func (f *File) Update(tenant, id string, fn func(tx Tx) error) error {
+	dropped, err := f.update(deviceKey{tenant, id}, fn)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		f.snapshotIfDue()
+		return nil
+	}
+	// the log and the previous snapshot still hold the destroyed key; a
+	// snapshot replaces both. Until one succeeds, every write retries it.
+	if err := f.Snapshot(); err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyRetained, err)
+	}
+	return nil
+}
+
+// update reports whether the device's private key was destroyed.
+func (f *File) update(k deviceKey, fn func(tx Tx) error) (bool, error) {
+	f.mu.RLock()
+	r, ok := f.data[k]
+	f.mu.RUnlock()
+	if !ok {
+		return false, domain.ErrNotFound
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := *r.dev.Load()
+	tx := &deviceTx{dev: &next, signer: r.signer, lookup: f.findIdempotent(r)}
+	if err := fn(tx); err != nil {
+		return false, err
+	}
+	key := r.key
+	rec := walRecord{Op: opUpdate, Device: &next, Records: tx.records}
+	switch {
+	case tx.rotated && tx.signer == nil:
+		key, rec.DropKey = "", true
+	case tx.rotated:
+		var err error
+		if key, err = f.codec.MarshalSigner(tx.signer); err != nil {
+			return false, err
+		}
+		rec.Key = key
+	}
+	return rec.DropKey, f.commit(rec, func(refs []journalRef) {
+		r.jmu.Lock()
+		r.signer, r.key = tx.signer, key
+		r.jmu.Unlock()
+		r.dev.Store(&next)
+		r.appendJournal(tx.records, refs)
+	})
+}
+
+// findIdempotent returns the deviceTx lookup for r; the caller holds r.mu.
+func (f *File) findIdempotent(r *fileRec) func(string, time.Time) (domain.SignatureRecord, bool, error) {
+	return func(key string, since time.Time) (domain.SignatureRecord, bool, error) {
+		i, ok := r.idem.find(key, since)
+		if !ok {
+			return domain.SignatureRecord{}, false, nil
+		}
+		r.jmu.RLock()
+		ref := r.refs[i]
+		r.jmu.RUnlock()
+		rec, err := f.readJournal(ref)
+		return rec, err == nil && rec.CreatedAt.After(since), err
+	}
+}
+
+// Signatures used to read a device's signature journal from the file store.
+// Once the store is broken or closed it fails like a write would.
+func (f *File) Signatures(tenant, id string, sr SignatureRange) ([]domain.SignatureRecord, error) {
+	if err := f.usable(); err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	r, ok := f.data[deviceKey{tenant, id}]
+	f.mu.RUnlock()
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	r.jmu.RLock()
+	refs := r.refs
+	r.jmu.RUnlock()
+	// refs is append-only, so the slice taken above stays valid unlocked
+	i := sort.Search(len(refs), func(i int) bool { return refs[i].counter >= sr.From })
+	out := []domain.SignatureRecord{}
+	for ; i < len(refs) && refs[i].counter <= sr.To; i++ {
+		if sr.Limit > 0 && len(out) == sr.Limit {
+			break
+		}
+		rec, err := f.readJournal(refs[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// readJournal reads the record at ref back from the journal segment.
+func (f *File) readJournal(ref journalRef) (domain.SignatureRecord, error) {
+	line := make([]byte, ref.size)
+	if _, err := f.journal.ReadAt(line, ref.off); err != nil {
+		if errors.Is(err, os.ErrClosed) { // Close raced the read
+			return domain.SignatureRecord{}, ErrClosed
+		}
+		return domain.SignatureRecord{}, fmt.Errorf("journal: %w", err)
+	}
+	var e journalEntry
+	if err := decodeLine(line, &e); err != nil {
+		return domain.SignatureRecord{}, fmt.Errorf("journal at offset %d: %w", ref.off, err)
+	}
+	return e.Record, nil
+}
+
+// writeJournal appends recs of device k to the journal segment, without
+// fsyncing it, and returns where they landed. It requires f.walMu, or
+// exclusive access while the store is being opened.
+func (f *File) writeJournal(k deviceKey, recs []domain.SignatureRecord) ([]journalRef, error) {
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	var buf []byte
+	refs := make([]journalRef, len(recs))
+	for i, rec := range recs {
+		line, err := encodeLine(journalEntry{Tenant: k.tenant, Device: k.id, Record: rec})
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = journalRef{counter: rec.Counter, off: f.jsize + int64(len(buf)), size: int64(len(line))}
+		buf = append(buf, line...)
+	}
+	if _, err := f.journal.Write(buf); err != nil {
+		return nil, err
+	}
+	f.jsize += int64(len(buf))
+	return refs, nil
+}
+
+// Snapshot writes a snapshot of every device and truncates the log. Like a
+// write, it fails with ErrClosed after Close and once a write has failed, so
+// state that never reached the log is not made durable.
+func (f *File) Snapshot() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if f.wal == nil {
+		return ErrClosed
+	}
+	if f.broken != nil {
+		return f.broken
+	}
+	return f.snapshotLocked()
+}
+
+// Close writes a final snapshot and releases the log. Later writes fail with ErrClosed.
+func (f *File) Close() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if f.wal == nil {
+		return nil
+	}
+	var err error
+	if f.sinceSnap > 0 && f.broken == nil {
+		err = f.snapshotLocked()
+	}
+	if cerr := f.wal.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.journal.Close(); err == nil {
+		err = cerr
+	}
+	f.wal = nil
+	closed := ErrClosed
+	f.down.Store(&closed)
+	return err
+}
+
+// commit appends rec to the log, fsyncs it and only then runs apply to publish
+// the new in-memory state. A failed write leaves the log in an unknown state,
+// so the store refuses further writes until it is reopened (and recovered).
+//
+// The records rec carries are appended to the journal segment first; apply
+// gets their offsets.
+func (f *File) commit(rec walRecord, apply func(refs []journalRef)) error {
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if f.wal == nil {
+		return ErrClosed
+	}
+	if f.broken != nil {
+		return f.broken
+	}
+	rec.Seq = f.seq + 1
+	line, err := encodeLine(rec)
+	if err != nil {
+		return err
+	}
+	refs, err := f.writeJournal(keyOf(rec.Device), rec.Records)
+	if err != nil {
+		return f.fail(fmt.Errorf("journal write: %w", err))
+	}
+	if _, err := f.wal.Write(line); err != nil {
+		return f.fail(fmt.Errorf("wal write: %w", err))
+	}
+	if err := f.wal.Sync(); err != nil {
+		return f.fail(fmt.Errorf("wal sync: %w", err))
+	}
+	f.seq = rec.Seq
+	f.sinceSnap++
+	f.purge = f.purge || rec.DropKey
+	apply(refs)
+	return nil
+}
+
+// fail marks the store broken by err; it requires f.walMu.
+func (f *File) fail(err error) error {
+	f.broken = err
+	f.down.Store(&err)
+	return err
+}
+
+// usable returns why the store refuses reads, if it does.
+func (f *File) usable() error {
+	if err := f.down.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (f *File) snapshotIfDue() {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.walMu.Lock()
+	defer f.walMu.Unlock()
+	if f.wal == nil || f.broken != nil {
+		return
+	}
+	if !f.purge && (f.snapshotEvery <= 0 || f.sinceSnap < f.snapshotEvery) {
+		return
+	}
+	if err := f.snapshotLocked(); err != nil {
+		log.Printf("storage: snapshot failed (log kept): %v", err)
+	}
+}
+
+// snapshotLocked requires f.mu (read) and f.walMu to be held.
+func (f *File) snapshotLocked() error {
+	// the snapshot vouches for the journal up to jsize, so that part must be on disk first
+	if err := f.journal.Sync(); err != nil {
+		return err
+	}
+	snap := snapshotFile{Seq: f.seq, JournalSize: f.jsize, Devices: make([]snapshotEntry, 0, len(f.data))}
+	for _, r := range f.data {
+		snap.Devices = append(snap.Devices, snapshotEntry{Device: r.dev.Load(), Key: r.key})
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(f.dir, snapshotName, b); err != nil {
+		return err
+	}
+	// Records up to snap.Seq are now covered by the snapshot; replay skips
+	// them even if the truncate below does not happen.
+	if err := f.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := f.wal.Sync(); err != nil {
+		return err
+	}
+	f.sinceSnap, f.purge = 0, false
+	return nil
+}
+
+// loadSnapshot restores the devices of the latest snapshot and indexes the
+// journal segment it covers. Anything the segment holds past that was
+// written after the snapshot and is dropped; replay writes it again.
+func (f *File) loadSnapshot() error {
+	var snap snapshotFile
+	b, err := os.ReadFile(filepath.Join(f.dir, snapshotName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &snap); err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+	}
+	for _, e := range snap.Devices {
+		if err := f.restore(e.Device, e.Key); err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+	}
+	if err := f.journal.Truncate(snap.JournalSize); err != nil {
+		return err
+	}
+	f.jsize = snap.JournalSize
+	if err := f.indexJournal(); err != nil {
+		return err
+	}
+	for _, e := range snap.Devices {
+		if err := f.rejournal(keyOf(e.Device), e.Journal); err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+	}
+	f.seq = snap.Seq
+	return nil
+}
+
+// indexJournal reads the first f.jsize bytes of the journal segment and
+// indexes every record for its device.
+func (f *File) indexJournal() error {
+	rd := bufio.NewReader(io.NewSectionReader(f.journal, 0, f.jsize))
+	var off int64
+	for off < f.jsize {
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("journal at offset %d: %w", off, err)
+		}
+		var e journalEntry
+		if err := decodeLine(line, &e); err != nil {
+			return fmt.Errorf("journal at offset %d: %w", off, err)
+		}
+		r, ok := f.data[deviceKey{e.Tenant, e.Device}]
+		if !ok {
+			return fmt.Errorf("journal at offset %d: unknown device %q of tenant %q", off, e.Device, e.Tenant)
+		}
+		ref := journalRef{counter: e.Record.Counter, off: off, size: int64(len(line))}
+		r.appendJournal([]domain.SignatureRecord{e.Record}, []journalRef{ref})
+		off += ref.size
+	}
+	return nil
+}
+
+// rejournal writes records recovered from the log (or an old snapshot) to
+// the journal segment and indexes them.
+func (f *File) rejournal(k deviceKey, recs []domain.SignatureRecord) error {
+	r, ok := f.data[k]
+	if !ok {
+		return fmt.Errorf("journal for unknown device %q of tenant %q", k.id, k.tenant)
+	}
+	upgrade(r.dev.Load(), recs)
+	refs, err := f.writeJournal(k, recs)
+	if err != nil {
+		return err
+	}
+	r.appendJournal(recs, refs)
+	return nil
+}
+
+// replay applies log records newer than the snapshot. A torn or corrupt tail
+// (a write that never returned to its caller) is cut off.
+func (f *File) replay() error {
+	path := filepath.Join(f.dir, walName)
+	wal, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+
+	rd := bufio.NewReader(wal)
+	var good int64
+	for {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("storage: dropping torn wal tail at offset %d", good)
+				return os.Truncate(path, good)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec, derr := decodeRecord(line)
+		if derr != nil {
+			log.Printf("storage: dropping corrupt wal tail at offset %d: %v", good, derr)
+			return os.Truncate(path, good)
+		}
+		good += int64(len(line))
+		if rec.Seq <= f.seq {
+			continue
+		}
+		if err := f.apply(rec); err != nil {
+			return fmt.Errorf("wal seq %d: %w", rec.Seq, err)
+		}
+		f.seq = rec.Seq
+	}
+}
+
+func (f *File) apply(rec walRecord) error {
+	switch rec.Op {
+	case opCreate:
+		if err := f.restore(rec.Device, rec.Key); err != nil {
+			return err
+		}
+		return f.rejournal(keyOf(rec.Device), rec.Records)
+	case opUpdate:
+		upgrade(rec.Device, rec.Records)
+		r, ok := f.data[keyOf(rec.Device)]
+		if !ok {
+			return fmt.Errorf("update for unknown device %q of tenant %q", rec.Device.ID, rec.Device.Tenant)
+		}
+		if rec.DropKey {
+			r.signer, r.key = nil, ""
+		}
+		if rec.Key != "" {
+			signer, err := f.codec.UnmarshalSigner(rec.Device.Algorithm, rec.Device.Scheme, rec.Key)
+			if err != nil {
+				return fmt.Errorf("device %q: %w", rec.Device.ID, err)
+			}
+			r.signer, r.key = signer, rec.Key
+		}
+		r.dev.Store(rec.Device)
+		return f.rejournal(keyOf(rec.Device), rec.Records)
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+}
+
+func (f *File) restore(dev *domain.SignatureDevice, key string) error {
+	upgrade(dev, nil)
+	var signer domain.Signer
+	if key != "" { // empty once the key has been destroyed
+		var err error
+		if signer, err = f.codec.UnmarshalSigner(dev.Algorithm, dev.Scheme, key); err != nil {
+			return fmt.Errorf("device %q: %w", dev.ID, err)
+		}
+	}
+	r := &fileRec{signer: signer, key: key, idem: newIdempotencyIndex()}
+	r.dev.Store(dev)
+	f.data[keyOf(dev)] = r
+	return nil
+}
+
+// upgrade fills in fields that records written by older versions lack.
+func upgrade(dev *domain.SignatureDevice, journal []domain.SignatureRecord) {
+	if dev.Scheme == "" {
+		dev.Scheme = domain.LegacyScheme(dev.Algorithm)
+	}
+	if dev.PayloadFormat == "" {
+		dev.PayloadFormat = domain.PayloadV0
+	}
+	if dev.Status == "" {
+		dev.Status = domain.StatusActive
+	}
+	if dev.Tenant == "" {
+		dev.Tenant = domain.DefaultTenant
+	}
+	dev.EnsureKeys()
+	for i := range journal {
+		if journal[i].KeyID == "" {
+			// signed before rotation existed, so with the first key
+			journal[i].KeyID = domain.FirstKeyID
+		}
+	}
+}
+
+// encodeLine renders "<crc32 hex> <json>\n", the framing of log and journal lines.
+func encodeLine(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(b)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(b))...)
+	line = append(line, b...)
+	return append(line, '\n'), nil
+}
+
+func decodeLine(line []byte, v any) error {
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	if len(line) < 10 || line[8] != ' ' {
+		return errors.New("malformed record")
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return err
+	}
+	body := line[9:]
+	if crc32.ChecksumIEEE(body) != uint32(sum) {
+		return errors.New("checksum mismatch")
+	}
+	return json.Unmarshal(body, v)
+}
+
+func decodeRecord(line []byte) (walRecord, error) {
+	var rec walRecord
+	if err := decodeLine(line, &rec); err != nil {
+		return rec, err
+	}
+	if rec.Device == nil {
+		return rec, errors.New("record without device")
+	}
+	return rec, nil
+}
+
+// writeFileSync atomically replaces dir/name with b: write to a temp file,
+// fsync it, rename it into place and fsync the directory.
+func writeFileSync(dir, name string, b []byte) error {
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var _ Repository = (*File)(nil)
@@ -0,0 +1,485 @@
+package storage
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxygenesis/signature/internal/crypto"
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+func openTestFile(t *testing.T, dir string, every int) *File {
+	t.Helper()
+	f, err := OpenFile(dir, crypto.PEMCodec{}, every)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func createECC(t *testing.T, f *File, id string) {
+	t.Helper()
+	s, err := crypto.NewECDSASigner(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &domain.SignatureDevice{Tenant: tn, ID: id, Algorithm: domain.AlgECC, PublicKeyPEM: s.PublicPEM()}
+	if err := f.Create(d, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bump(f *File, id, sig string) error {
+	return f.Update(tn, id, func(tx Tx) error {
+		d := tx.Device()
+		d.SignatureCounter++
+		d.LastSignatureB64 = sig
+		return nil
+	})
+}
+
+func TestFile_RestoresStateAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	createECC(t, f, "a")
+	dup, _ := crypto.NewECDSASigner(elliptic.P256())
+	if err := f.Create(&domain.SignatureDevice{Tenant: tn, ID: "a", Algorithm: domain.AlgECC}, dup); !errors.Is(err, domain.ErrAlreadyExists) {
+		t.Fatalf("want conflict, got %v", err)
+	}
+	for _, sig := range []string{"s1", "s2", "s3"} {
+		if err := bump(f, "a", sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, before, _ := f.Get(tn, "a")
+	// simulate a crash: no Close, so no final snapshot
+	f.wal.Close()
+
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	got, signer, err := f.Get(tn, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SignatureCounter != 3 || got.LastSignatureB64 != "s3" {
+		t.Fatalf("restored %+v", got)
+	}
+	if signer.PublicPEM() != before.PublicPEM() {
+		t.Fatal("private key not restored")
+	}
+	sig, _ := signer.Sign([]byte("x"))
+	if !before.Verify([]byte("x"), sig) {
+		t.Fatal("restored key does not match")
+	}
+}
+
+func TestFile_SnapshotTruncatesLog(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 2)
+	createECC(t, f, "a")
+	if err := bump(f, "a", "s1"); err != nil { // second record → snapshot
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(filepath.Join(dir, walName)); fi.Size() != 0 {
+		t.Fatalf("wal size=%d after snapshot", fi.Size())
+	}
+	if err := bump(f, "a", "s2"); err != nil {
+		t.Fatal(err)
+	}
+	f.wal.Close()
+
+	f = openTestFile(t, dir, 2)
+	got, _, _ := f.Get(tn, "a")
+	if got.SignatureCounter != 2 || got.LastSignatureB64 != "s2" {
+		t.Fatalf("restored %+v", got)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bump(f, "a", "s3"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want ErrClosed, got %v", err)
+	}
+	if err := f.Snapshot(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want ErrClosed, got %v", err)
+	}
+	if _, err := f.Signatures(tn, "a", AllSignatures); !errors.Is(err, ErrClosed) {
+		t.Fatalf("signatures: want ErrClosed, got %v", err)
+	}
+}
+
+func TestFile_BrokenStoreRefusesSnapshotsAndReads(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	createECC(t, f, "a")
+	if err := bump(f, "a", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	f.wal.Close() // the next log write fails
+	err := bump(f, "a", "s2")
+	if err == nil {
+		t.Fatal("write to a closed log succeeded")
+	}
+	if serr := f.Snapshot(); serr == nil || serr.Error() != err.Error() {
+		t.Fatalf("snapshot: want %v, got %v", err, serr)
+	}
+	if _, rerr := f.Signatures(tn, "a", AllSignatures); rerr == nil || rerr.Error() != err.Error() {
+		t.Fatalf("signatures: want %v, got %v", err, rerr)
+	}
+	if snap, _ := os.ReadFile(filepath.Join(dir, snapshotName)); len(snap) != 0 {
+		t.Fatal("snapshot written after a failed write")
+	}
+}
+
+func TestFile_SkipsRecordsCoveredBySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	createECC(t, f, "a")
+	_ = bump(f, "a", "s1")
+	wal, _ := os.ReadFile(filepath.Join(dir, walName))
+	if err := f.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// crash between snapshot rename and log truncate
+	if err := os.WriteFile(filepath.Join(dir, walName), wal, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	got, _, _ := f.Get(tn, "a")
+	if got.SignatureCounter != 1 {
+		t.Fatalf("counter=%d", got.SignatureCounter)
+	}
+}
+
+func TestFile_DropsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	createECC(t, f, "a")
+	_ = bump(f, "a", "s1")
+	f.wal.Close()
+
+	path := filepath.Join(dir, walName)
+	good, _ := os.ReadFile(path)
+	torn := append(append([]byte{}, good...), []byte(`0000abcd {"seq":3,"op":"upd`)...)
+	if err := os.WriteFile(path, torn, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f = openTestFile(t, dir, 0)
+	got, _, _ := f.Get(tn, "a")
+	if got.SignatureCounter != 1 {
+		t.Fatalf("counter=%d", got.SignatureCounter)
+	}
+	if b, _ := os.ReadFile(path); len(b) != len(good) {
+		t.Fatalf("torn tail not truncated: %d != %d", len(b), len(good))
+	}
+	// the next commit must be readable after the truncated tail
+	if err := bump(f, "a", "s2"); err != nil {
+		t.Fatal(err)
+	}
+	f.wal.Close()
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	if got, _, _ := f.Get(tn, "a"); got.SignatureCounter != 2 {
+		t.Fatalf("counter=%d", got.SignatureCounter)
+	}
+}
+
+func TestFile_FailedUpdateIsNotCommitted(t *testing.T) {
+	f := openTestFile(t, t.TempDir(), 0)
+	defer f.Close()
+	createECC(t, f, "a")
+	want := errors.New("fn error")
+	err := f.Update(tn, "a", func(tx Tx) error {
+		tx.Device().SignatureCounter = 99
+		return want
+	})
+	if !errors.Is(err, want) {
+		t.Fatalf("got %v want %v", err, want)
+	}
+	if got, _, _ := f.Get(tn, "a"); got.SignatureCounter != 0 {
+		t.Fatalf("counter=%d", got.SignatureCounter)
+	}
+	if err := bump(f, "missing", ""); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want not found, got %v", err)
+	}
+	if _, _, err := f.Get(tn, "missing"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want not found, got %v", err)
+	}
+	if list, _ := f.List(tn, DeviceFilter{}); len(list) != 1 {
+		t.Fatalf("list=%d", len(list))
+	}
+}
+
+func TestFile_CorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, snapshotName), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(dir, crypto.PEMCodec{}, 0); err == nil {
+		t.Fatal("want snapshot error")
+	}
+}
+
+func TestFile_CreateRejectsUnpersistableSigner(t *testing.T) {
+	f := openTestFile(t, t.TempDir(), 0)
+	defer f.Close()
+	if err := f.Create(&domain.SignatureDevice{Tenant: tn, ID: "x"}, fakeSigner{}); err == nil {
+		t.Fatal("want codec error")
+	}
+}
+
+func TestFile_Journal(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 3)
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	testJournal(t, f, signer)
+	f.wal.Close()
+
+	// journal survives a crash (snapshot + log replay)
+	f = openTestFile(t, dir, 3)
+	defer f.Close()
+	recs, _ := f.Signatures(tn, "j", AllSignatures)
+	if len(recs) != 8 || recs[4].Counter != 4 {
+		t.Fatalf("restored journal=%+v", recs)
+	}
+	// and so does the idempotency index
+	_ = f.Update(tn, "j", func(tx Tx) error {
+		if got, ok, _ := tx.Idempotent("a", time.Time{}); !ok || got.Counter != 7 {
+			t.Fatalf("restored idempotency key: %+v %v", got, ok)
+		}
+		return nil
+	})
+}
+
+func TestFile_SnapshotKeepsJournalOutOfLine(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 1) // snapshot after every record
+	createECC(t, f, "a")
+	for i := 0; i < 20; i++ {
+		if err := f.Update(tn, "a", func(tx Tx) error {
+			d := tx.Device()
+			tx.Append(domain.SignatureRecord{DeviceID: "a", Counter: d.SignatureCounter, Signature: "sig-" + strconv.Itoa(i)})
+			d.SignatureCounter++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, _ := os.ReadFile(filepath.Join(dir, snapshotName))
+	if strings.Contains(string(snap), "sig-") {
+		t.Fatal("snapshot carries journal records")
+	}
+	// records written after the last snapshot are dropped from the segment on
+	// reopen and rewritten from the log
+	if err := f.Update(tn, "a", func(tx Tx) error {
+		tx.Append(domain.SignatureRecord{DeviceID: "a", Counter: 20, Signature: "sig-20"})
+		tx.Device().SignatureCounter++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.snapshotEvery = 0
+	if err := f.Update(tn, "a", func(tx Tx) error {
+		tx.Append(domain.SignatureRecord{DeviceID: "a", Counter: 21, Signature: "sig-21", IdempotencyKey: "k", CreatedAt: time.Unix(21, 0)})
+		tx.Device().SignatureCounter++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.wal.Close() // crash
+
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	recs, err := f.Signatures(tn, "a", SignatureRange{From: 19, To: 100})
+	if err != nil || len(recs) != 3 || recs[0].Signature != "sig-19" || recs[2].Signature != "sig-21" {
+		t.Fatalf("journal after reopen: %+v %v", recs, err)
+	}
+	_ = f.Update(tn, "a", func(tx Tx) error {
+		if got, ok, err := tx.Idempotent("k", time.Time{}); !ok || err != nil || got.Counter != 21 {
+			t.Fatalf("idempotency key after reopen: %+v %v %v", got, ok, err)
+		}
+		return nil
+	})
+}
+
+func TestFile_MovesInlineJournalOfOldSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := crypto.NewECDSASigner(elliptic.P256())
+	key, _ := crypto.PEMCodec{}.MarshalSigner(s)
+	old := `{"seq":2,"devices":[{"device":{"tenant":"` + tn + `","id":"a","algorithm":"ECC","signature_counter":2},"key":` +
+		strconv.Quote(key) + `,"journal":[{"device_id":"a","counter":0},{"device_id":"a","counter":1,"idempotency_key":"k"}]}]}`
+	if err := os.WriteFile(filepath.Join(dir, snapshotName), []byte(old), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := openTestFile(t, dir, 0)
+	if err := f.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	recs, err := f.Signatures(tn, "a", AllSignatures)
+	if err != nil || len(recs) != 2 || recs[1].Counter != 1 || recs[1].KeyID != domain.FirstKeyID {
+		t.Fatalf("journal=%+v %v", recs, err)
+	}
+}
+
+func TestFile_BackfillsLegacyScheme(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	// no scheme and no tenant, as written by older versions
+	s, _ := crypto.NewECDSASigner(elliptic.P256())
+	if err := f.Create(&domain.SignatureDevice{ID: "a", Algorithm: domain.AlgECC, PublicKeyPEM: s.PublicPEM()}, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	d, _, err := f.Get(domain.DefaultTenant, "a")
+	if err != nil || d.Scheme != domain.SchemeECDSASHA256 || d.PayloadFormat != domain.PayloadV0 || d.Tenant != domain.DefaultTenant {
+		t.Fatalf("scheme/payload format not backfilled: %+v %v", d, err)
+	}
+}
+
+func rotateECC(t *testing.T, repo Repository, id string) domain.Signer {
+	t.Helper()
+	s, _ := crypto.NewECDSASigner(elliptic.P256())
+	if err := repo.Update(tn, id, func(tx Tx) error {
+		tx.Device().RotateKey(s.PublicPEM())
+		tx.SetSigner(s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFile_RotationSurvivesReopen(t *testing.T) {
+	for _, every := range []int{0, 1} { // replayed from the log / restored from a snapshot
+		dir := t.TempDir()
+		f := openTestFile(t, dir, every)
+		createECC(t, f, "a")
+		_ = bump(f, "a", "s1")
+		want := rotateECC(t, f, "a")
+		if _, s, _ := f.Get(tn, "a"); s != want {
+			t.Fatal("new signer not visible")
+		}
+		// simulate a crash: no Close, so no final snapshot
+		f.wal.Close()
+		f = openTestFile(t, dir, every)
+		d, s, err := f.Get(tn, "a")
+		if err != nil || s.PublicPEM() != want.PublicPEM() || d.PublicKeyPEM != want.PublicPEM() {
+			t.Fatalf("every=%d: rotated key not restored: %v", every, err)
+		}
+		if len(d.Keys) != 2 || *d.Keys[0].UntilCounter != 1 || d.Keys[1].FirstCounter != 1 {
+			t.Fatalf("every=%d: key history %+v", every, d.Keys)
+		}
+		f.wal.Close()
+	}
+}
+
+func decommission(t *testing.T, repo Repository, id string) {
+	t.Helper()
+	if err := repo.Update(tn, id, func(tx Tx) error {
+		if err := tx.Device().SetStatus(domain.StatusDecommissioned); err != nil {
+			return err
+		}
+		tx.SetSigner(nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFile_DecommissionDestroysKey(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0) // no periodic snapshots: the log alone holds the key
+	createECC(t, f, "a")
+	createECC(t, f, "b")
+	decommission(t, f, "a")
+	f.wal.Close() // crash
+
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	d, signer, err := f.Get(tn, "a")
+	if err != nil || signer != nil || d.Status != domain.StatusDecommissioned || d.PublicKeyPEM == "" {
+		t.Fatalf("after reopen: %+v signer=%v err=%v", d, signer, err)
+	}
+	if _, signer, _ := f.Get(tn, "b"); signer == nil {
+		t.Fatal("other device lost its key")
+	}
+	// only b's key is left on disk
+	entries, _ := os.ReadDir(dir)
+	keys := 0
+	for _, e := range entries {
+		b, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+		keys += strings.Count(string(b), "PRIVATE KEY-----") / 2 // BEGIN and END
+	}
+	if keys != 1 {
+		t.Fatalf("%d private keys on disk, want 1", keys)
+	}
+}
+
+func TestFile_DecommissionReportsKeyLeftOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	defer f.Close()
+	createECC(t, f, "a")
+	createECC(t, f, "b")
+	// a directory in the way makes the snapshot rename fail
+	if err := os.MkdirAll(filepath.Join(dir, snapshotName, "x"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	err := f.Update(tn, "a", func(tx Tx) error {
+		tx.SetSigner(nil)
+		return tx.Device().SetStatus(domain.StatusDecommissioned)
+	})
+	if !errors.Is(err, ErrKeyRetained) {
+		t.Fatalf("want ErrKeyRetained, got %v", err)
+	}
+	if d, signer, _ := f.Get(tn, "a"); signer != nil || d.Status != domain.StatusDecommissioned {
+		t.Fatalf("decommission not committed: %+v", d)
+	}
+
+	// the next write retries the snapshot
+	_ = os.RemoveAll(filepath.Join(dir, snapshotName))
+	if err := bump(f, "b", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if wal, _ := os.ReadFile(filepath.Join(dir, walName)); len(wal) != 0 {
+		t.Fatalf("log not truncated: %d bytes", len(wal))
+	}
+}
+
+func TestFile_ListFilter(t *testing.T) {
+	f := openTestFile(t, t.TempDir(), 0)
+	defer f.Close()
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	testListFilter(t, f, signer)
+}
+
+func TestFile_TenantIsolation(t *testing.T) {
+	dir := t.TempDir()
+	f := openTestFile(t, dir, 0)
+	a, _ := crypto.NewECDSASigner(elliptic.P256())
+	b, _ := crypto.NewECDSASigner(elliptic.P256())
+	testTenantIsolation(t, f, a, b)
+	f.wal.Close() // crash: the log alone must keep the tenants apart
+
+	f = openTestFile(t, dir, 0)
+	defer f.Close()
+	if d, s, err := f.Get("b", "x"); err != nil || d.SignatureCounter != 0 || s.PublicPEM() != b.PublicPEM() {
+		t.Fatalf("after reopen: %+v %v", d, err)
+	}
+}
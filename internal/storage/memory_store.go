@@ -2,71 +2,122 @@ package storage
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oxygenesis/signature/internal/domain"
 )
 
 type rec struct {
-	mu     sync.Mutex
-	dev    *domain.SignatureDevice
-	signer domain.Signer
+	mu  sync.Mutex // serialises Update closures for the device
+	dev atomic.Pointer[domain.SignatureDevice]
+
+	jmu     sync.RWMutex // guards signer and journal; held only to publish or read them
+	signer  domain.Signer
+	journal []domain.SignatureRecord
+	idem    *idempotencyIndex // read and written under mu
 }
 
 type Memory struct {
 	mu   sync.RWMutex
-	data map[string]*rec
+	data map[deviceKey]*rec
 }
 
-func NewMemory() *Memory { return &Memory{data: make(map[string]*rec)} }
+func NewMemory() *Memory { return &Memory{data: make(map[deviceKey]*rec)} }
 
 // Create used to create a new device in the memory store.
 func (m *Memory) Create(dev *domain.SignatureDevice, signer domain.Signer) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.data[dev.ID]; ok {
+	if _, ok := m.data[keyOf(dev)]; ok {
 		return domain.ErrAlreadyExists
 	}
 	cp := *dev
-	m.data[dev.ID] = &rec{dev: &cp, signer: signer}
+	r := &rec{signer: signer, idem: newIdempotencyIndex()}
+	r.dev.Store(&cp)
+	m.data[keyOf(dev)] = r
 	return nil
 }
 
 // Get used to get a device from the memory store.
-func (m *Memory) Get(id string) (*domain.SignatureDevice, domain.Signer, error) {
+func (m *Memory) Get(tenant, id string) (*domain.SignatureDevice, domain.Signer, error) {
 	m.mu.RLock()
-	r, ok := m.data[id]
+	r, ok := m.data[deviceKey{tenant, id}]
 	m.mu.RUnlock()
 	if !ok {
 		return nil, nil, domain.ErrNotFound
 	}
-	cp := *(r.dev)
+	cp := *r.dev.Load()
+	r.jmu.RLock()
+	defer r.jmu.RUnlock()
 	return &cp, r.signer, nil
 }
 
-// List used to lists all devices in the memory store.
-func (m *Memory) List() ([]*domain.SignatureDevice, error) {
+// List used to lists the tenant's devices in the memory store that match f.
+func (m *Memory) List(tenant string, f DeviceFilter) ([]*domain.SignatureDevice, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	out := make([]*domain.SignatureDevice, 0, len(m.data))
-	for _, r := range m.data {
-		cp := *(r.dev)
-		out = append(out, &cp)
+	page := newDevicePage(f.Limit)
+	for k, r := range m.data {
+		if k.tenant != tenant {
+			continue
+		}
+		// Update publishes a new device rather than changing this one
+		if d := r.dev.Load(); f.Match(d) {
+			page.offer(d)
+		}
 	}
-	return out, nil
+	return page.devices(), nil
 }
 
-// Update used to update a device in the memory store.
-func (m *Memory) Update(id string, fn func(d *domain.SignatureDevice, signer domain.Signer) error) error {
+// Update runs fn on a copy of the device and publishes it only if fn
+// succeeds, so a failing fn leaves no partial changes behind.
+func (m *Memory) Update(tenant, id string, fn func(tx Tx) error) error {
 	m.mu.RLock()
-	r, ok := m.data[id]
+	r, ok := m.data[deviceKey{tenant, id}]
 	m.mu.RUnlock()
 	if !ok {
 		return domain.ErrNotFound
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if err := fn(r.dev, r.signer); err != nil {
+	next := *r.dev.Load()
+	r.jmu.RLock()
+	signer := r.signer
+	r.jmu.RUnlock()
+	tx := &deviceTx{dev: &next, signer: signer, lookup: r.findIdempotent}
+	if err := fn(tx); err != nil {
 		return err
 	}
+	r.jmu.Lock()
+	r.signer = tx.signer
+	for _, rec := range tx.records {
+		r.idem.add(rec, len(r.journal))
+		r.journal = append(r.journal, rec)
+	}
+	r.jmu.Unlock()
+	r.dev.Store(&next)
 	return nil
 }
+
+// findIdempotent is the deviceTx lookup for r; the caller holds r.mu, so
+// the journal only changes under it and needs no r.jmu.
+func (r *rec) findIdempotent(key string, since time.Time) (domain.SignatureRecord, bool, error) {
+	if i, ok := r.idem.find(key, since); ok && r.journal[i].CreatedAt.After(since) {
+		return r.journal[i], true, nil
+	}
+	return domain.SignatureRecord{}, false, nil
+}
+
+// Signatures used to read a device's signature journal from the memory store.
+func (m *Memory) Signatures(tenant, id string, sr SignatureRange) ([]domain.SignatureRecord, error) {
+	m.mu.RLock()
+	r, ok := m.data[deviceKey{tenant, id}]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	r.jmu.RLock()
+	defer r.jmu.RUnlock()
+	return selectRange(r.journal, sr), nil
+}
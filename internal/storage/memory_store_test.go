@@ -2,11 +2,17 @@ package storage
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/oxygenesis/signature/internal/domain"
 )
 
+// tn is the tenant the tests store their devices under.
+const tn = "acme"
+
 type fakeSigner struct{}
 
 func (fakeSigner) Sign(p []byte) ([]byte, error) { return []byte("sig"), nil }
@@ -16,35 +22,35 @@ func (fakeSigner) AlgorithmName() string         { return "RSA" }
 
 func TestMemoryCRUD(t *testing.T) {
 	m := NewMemory()
-	d := &domain.SignatureDevice{ID: "x", Algorithm: domain.AlgRSA}
+	d := &domain.SignatureDevice{Tenant: tn, ID: "x", Algorithm: domain.AlgRSA}
 	if err := m.Create(d, fakeSigner{}); err != nil {
 		t.Fatal(err)
 	}
 	if err := m.Create(d, fakeSigner{}); err == nil {
 		t.Fatal("expected conflict")
 	}
-	got, s, err := m.Get("x")
+	got, s, err := m.Get(tn, "x")
 	if err != nil || got.ID != "x" || s == nil {
 		t.Fatal("get failed")
 	}
-	list, _ := m.List()
+	list, _ := m.List(tn, DeviceFilter{})
 	if len(list) != 1 {
 		t.Fatal("list failed")
 	}
-	if err := m.Update("x", func(dev *domain.SignatureDevice, signer domain.Signer) error {
-		dev.Label = "L"
+	if err := m.Update(tn, "x", func(tx Tx) error {
+		tx.Device().Label = "L"
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
-	got, _, _ = m.Get("x")
+	got, _, _ = m.Get(tn, "x")
 	if got.Label != "L" {
 		t.Fatal("update didn't persist")
 	}
-	if _, _, err := m.Get("missing"); err == nil {
+	if _, _, err := m.Get(tn, "missing"); err == nil {
 		t.Fatal("expected not found")
 	}
-	if err := m.Update("missing", func(*domain.SignatureDevice, domain.Signer) error { return nil }); err == nil {
+	if err := m.Update(tn, "missing", func(Tx) error { return nil }); err == nil {
 		t.Fatal("expected not found on update")
 	}
 }
@@ -58,12 +64,315 @@ func (fakeSigner2) AlgorithmName() string         { return "RSA" }
 
 func TestUpdate_FnError(t *testing.T) {
 	m := NewMemory()
-	d := &domain.SignatureDevice{ID: "x", Algorithm: domain.AlgRSA}
+	d := &domain.SignatureDevice{Tenant: tn, ID: "x", Algorithm: domain.AlgRSA}
 	if err := m.Create(d, fakeSigner2{}); err != nil {
 		t.Fatal(err)
 	}
 	want := errors.New("fn error")
-	if err := m.Update("x", func(*domain.SignatureDevice, domain.Signer) error { return want }); !errors.Is(err, want) {
+	if err := m.Update(tn, "x", func(Tx) error { return want }); !errors.Is(err, want) {
 		t.Fatalf("got %v want %v", err, want)
 	}
 }
+
+// testJournal checks the journal contract shared by every Repository:
+// records commit with the device, failed closures leave no trace, ranges page by counter.
+func testJournal(t *testing.T, repo Repository, signer domain.Signer) {
+	t.Helper()
+	if err := repo.Create(&domain.SignatureDevice{Tenant: tn, ID: "j", Algorithm: domain.Algorithm(signer.AlgorithmName())}, signer); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := repo.Update(tn, "j", func(tx Tx) error {
+			d := tx.Device()
+			tx.Append(domain.SignatureRecord{DeviceID: d.ID, Counter: d.SignatureCounter, Data: "d", Signature: "s", CreatedAt: time.Unix(int64(i), 0).UTC()})
+			d.SignatureCounter++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = repo.Update(tn, "j", func(tx Tx) error {
+		tx.Append(domain.SignatureRecord{DeviceID: "j", Counter: 5})
+		tx.Device().SignatureCounter = 6
+		tx.Device().LastSignatureB64 = "partial"
+		return errors.New("abort")
+	})
+	if d, _, _ := repo.Get(tn, "j"); d.SignatureCounter != 5 || d.LastSignatureB64 != "" {
+		t.Fatalf("failed closure leaked changes: %+v", d)
+	}
+
+	all, err := repo.Signatures(tn, "j", AllSignatures)
+	if err != nil || len(all) != 5 {
+		t.Fatalf("all=%d err=%v", len(all), err)
+	}
+	if all[4].Counter != 4 || !all[4].CreatedAt.Equal(time.Unix(4, 0)) {
+		t.Fatalf("last record %+v", all[4])
+	}
+	page, _ := repo.Signatures(tn, "j", SignatureRange{From: 1, To: 3, Limit: 2})
+	if len(page) != 2 || page[0].Counter != 1 || page[1].Counter != 2 {
+		t.Fatalf("page=%+v", page)
+	}
+	if _, err := repo.Signatures(tn, "missing", AllSignatures); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want not found, got %v", err)
+	}
+
+	// idempotency keys: visible within the Tx, after commit, latest wins; aborted ones vanish
+	appendKeyed := func(counter uint64, key string, fail error) error {
+		return repo.Update(tn, "j", func(tx Tx) error {
+			tx.Append(domain.SignatureRecord{DeviceID: "j", Counter: counter, Data: key, IdempotencyKey: key, CreatedAt: time.Unix(0, 0)})
+			if _, ok, _ := tx.Idempotent(key, time.Time{}); !ok {
+				t.Fatalf("%s not visible inside its Tx", key)
+			}
+			return fail
+		})
+	}
+	_ = appendKeyed(5, "lost", errors.New("abort"))
+	_ = appendKeyed(5, "a", nil)
+	_ = appendKeyed(6, "b", nil)
+	_ = appendKeyed(7, "a", nil)
+	_ = repo.Update(tn, "j", func(tx Tx) error {
+		if got, ok, err := tx.Idempotent("a", time.Time{}); !ok || err != nil || got.Counter != 7 {
+			t.Fatalf("key a: %+v %v %v", got, ok, err)
+		}
+		if _, ok, err := tx.Idempotent("lost", time.Time{}); ok || err != nil {
+			t.Fatalf("aborted key found: %v %v", ok, err)
+		}
+		// keys used at or before the cutoff have expired
+		if _, ok, err := tx.Idempotent("a", time.Unix(0, 0)); ok || err != nil {
+			t.Fatalf("expired key found: %v %v", ok, err)
+		}
+		return nil
+	})
+}
+
+func TestMemory_Journal(t *testing.T) {
+	testJournal(t, NewMemory(), fakeSigner{})
+}
+
+func TestMemory_IdempotencyIndexDropsExpiredKeys(t *testing.T) {
+	m := NewMemory()
+	_ = m.Create(&domain.SignatureDevice{Tenant: tn, ID: "e", Algorithm: domain.AlgRSA}, fakeSigner{})
+	for i := 0; i < 10; i++ {
+		_ = m.Update(tn, "e", func(tx Tx) error {
+			key := "k" + strconv.Itoa(i)
+			tx.Append(domain.SignatureRecord{DeviceID: "e", Counter: uint64(i), IdempotencyKey: key, CreatedAt: time.Unix(int64(i), 0)})
+			return nil
+		})
+	}
+	_ = m.Update(tn, "e", func(tx Tx) error {
+		if _, ok, _ := tx.Idempotent("k3", time.Unix(5, 0)); ok {
+			t.Fatal("expired key found")
+		}
+		if got, ok, _ := tx.Idempotent("k7", time.Unix(5, 0)); !ok || got.Counter != 7 {
+			t.Fatalf("live key: %+v %v", got, ok)
+		}
+		return nil
+	})
+	if ix := m.data[deviceKey{tn, "e"}].idem; len(ix.latest) != 4 || len(ix.queue) != 4 {
+		t.Fatalf("index holds %d keys, %d queued; want 4", len(ix.latest), len(ix.queue))
+	}
+}
+
+type otherSigner struct{ fakeSigner }
+
+func (otherSigner) PublicPEM() string { return "PEM2" }
+
+func TestMemory_ReadsDoNotWaitForUpdates(t *testing.T) {
+	m := NewMemory()
+	for _, id := range []string{"busy", "other"} {
+		_ = m.Create(&domain.SignatureDevice{Tenant: tn, ID: id, Algorithm: domain.AlgRSA}, fakeSigner{})
+	}
+	entered, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = m.Update(tn, "busy", func(tx Tx) error {
+			close(entered)
+			<-release // a long batch
+			return nil
+		})
+	}()
+	<-entered
+	defer close(release)
+
+	done := make(chan error)
+	go func() {
+		if _, err := m.List(tn, DeviceFilter{}); err != nil {
+			done <- err
+			return
+		}
+		if err := m.Create(&domain.SignatureDevice{Tenant: tn, ID: "new", Algorithm: domain.AlgRSA}, fakeSigner{}); err != nil {
+			done <- err
+			return
+		}
+		if _, _, err := m.Get(tn, "busy"); err != nil {
+			done <- err
+			return
+		}
+		_, _, err := m.Get(tn, "other")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reads blocked behind an update")
+	}
+}
+
+func TestMemory_SetSigner(t *testing.T) {
+	m := NewMemory()
+	_ = m.Create(&domain.SignatureDevice{Tenant: tn, ID: "a"}, fakeSigner{})
+	if err := m.Update(tn, "a", func(tx Tx) error {
+		tx.Device().RotateKey("PEM2")
+		tx.SetSigner(otherSigner{})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	d, s, _ := m.Get(tn, "a")
+	if s.PublicPEM() != "PEM2" || d.CurrentKey().ID != "k2" {
+		t.Fatalf("rotation not committed: %+v %s", d, s.PublicPEM())
+	}
+}
+
+// testListFilter creates tagged devices in repo and checks that List filters
+// and pages them in ID order, including after a tag change committed through
+// Update. ACLs committed the same way are stored as well.
+func testListFilter(t *testing.T, repo Repository, signer domain.Signer) {
+	t.Helper()
+	for _, d := range []*domain.SignatureDevice{ // created out of order
+		{Tenant: tn, ID: "c", Algorithm: domain.AlgRSA, Label: "kiosk", ACL: map[string]domain.DeviceRight{"key:k": domain.RightRead}},
+		{Tenant: tn, ID: "a", Algorithm: domain.AlgECC, Label: "till-1", Tags: map[string]string{"store": "berlin", "floor": "1"}},
+		{Tenant: tn, ID: "b", Algorithm: domain.AlgECC, Label: "till-2", Tags: map[string]string{"store": "hamburg"}},
+	} {
+		if err := repo.Create(d, signer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	moved, sign := "hamburg", domain.RightSign
+	if err := repo.Update(tn, "a", func(tx Tx) error {
+		if err := tx.Device().PatchACL(map[string]*domain.DeviceRight{"cert:CN=till-1,O=acme": &sign}); err != nil {
+			return err
+		}
+		return tx.Device().PatchTags(map[string]*string{"store": &moved, "floor": nil})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		f    DeviceFilter
+		want string
+	}{
+		"all":       {DeviceFilter{}, "abc"},
+		"algorithm": {DeviceFilter{Algorithm: domain.AlgECC}, "ab"},
+		"prefix":    {DeviceFilter{LabelPrefix: "till-"}, "ab"},
+		"tag":       {DeviceFilter{Tags: map[string]string{"store": "hamburg"}}, "ab"},
+		"removed":   {DeviceFilter{Tags: map[string]string{"floor": "1"}}, ""},
+		"combined":  {DeviceFilter{LabelPrefix: "till-2", Tags: map[string]string{"store": "hamburg"}}, "b"},
+		"bad key":   {DeviceFilter{Tags: map[string]string{`x"y`: "1"}}, ""},
+		"page 1":    {DeviceFilter{Limit: 2}, "ab"},
+		"page 2":    {DeviceFilter{After: "b", Limit: 2}, "c"},
+		"past end":  {DeviceFilter{After: "c"}, ""},
+		"paged tag": {DeviceFilter{After: "a", Tags: map[string]string{"store": "hamburg"}}, "b"},
+	} {
+		list, err := repo.List(tn, tc.f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ids := make([]string, len(list))
+		for i, d := range list {
+			ids[i] = d.ID
+		}
+		if got := strings.Join(ids, ""); got != tc.want {
+			t.Fatalf("%s: got %q want %q", name, got, tc.want)
+		}
+	}
+	d, _, _ := repo.Get(tn, "a")
+	if len(d.Tags) != 1 || d.Tags["store"] != "hamburg" {
+		t.Fatalf("tags=%v", d.Tags)
+	}
+	if len(d.ACL) != 1 || d.ACL["cert:CN=till-1,O=acme"] != domain.RightSign {
+		t.Fatalf("acl=%v", d.ACL)
+	}
+	if d, _, _ := repo.Get(tn, "c"); d.ACL["key:k"] != domain.RightRead {
+		t.Fatalf("acl=%v", d.ACL)
+	}
+}
+
+func TestMemory_ListFilter(t *testing.T) {
+	testListFilter(t, NewMemory(), fakeSigner{})
+}
+
+func TestDevicePage_KeepsSmallestIDs(t *testing.T) {
+	ids := []string{"m", "c", "x", "a", "k", "b", "z", "d"}
+	for limit, want := range map[int]string{0: "abcdkmxz", 3: "abc", 8: "abcdkmxz", 20: "abcdkmxz"} {
+		p := newDevicePage(limit)
+		in := map[string]*domain.SignatureDevice{}
+		for _, id := range ids {
+			in[id] = &domain.SignatureDevice{ID: id}
+			p.offer(in[id])
+		}
+		got := ""
+		for _, d := range p.devices() {
+			if d == in[d.ID] {
+				t.Fatalf("limit %d: %s returned without copying", limit, d.ID)
+			}
+			got += d.ID
+		}
+		if got != want {
+			t.Fatalf("limit %d: got %q want %q", limit, got, want)
+		}
+	}
+}
+
+// testTenantIsolation stores the same device ID under two tenants and checks
+// that neither can see or change the other's device, key or journal.
+func testTenantIsolation(t *testing.T, repo Repository, signerA, signerB domain.Signer) {
+	t.Helper()
+	for tenant, s := range map[string]domain.Signer{"a": signerA, "b": signerB} {
+		d := &domain.SignatureDevice{Tenant: tenant, ID: "x", Algorithm: domain.Algorithm(s.AlgorithmName()), PublicKeyPEM: s.PublicPEM()}
+		if err := repo.Create(d, s); err != nil {
+			t.Fatalf("create in %s: %v", tenant, err)
+		}
+	}
+	if err := repo.Update("a", "x", func(tx Tx) error {
+		tx.Device().SignatureCounter++
+		tx.Append(domain.SignatureRecord{DeviceID: "x", Counter: 0, KeyID: "k1", CreatedAt: time.Now()})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for tenant, want := range map[string]struct {
+		counter uint64
+		journal int
+		signer  domain.Signer
+	}{"a": {1, 1, signerA}, "b": {0, 0, signerB}} {
+		d, s, err := repo.Get(tenant, "x")
+		if err != nil || d.Tenant != tenant || d.SignatureCounter != want.counter || s.PublicPEM() != want.signer.PublicPEM() {
+			t.Fatalf("%s: %+v %v", tenant, d, err)
+		}
+		if recs, _ := repo.Signatures(tenant, "x", AllSignatures); len(recs) != want.journal {
+			t.Fatalf("%s: journal %+v", tenant, recs)
+		}
+		if list, _ := repo.List(tenant, DeviceFilter{}); len(list) != 1 || list[0].Tenant != tenant {
+			t.Fatalf("%s: list %+v", tenant, list)
+		}
+	}
+	if _, _, err := repo.Get("c", "x"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("other tenant: want not found, got %v", err)
+	}
+	if err := repo.Update("c", "x", func(Tx) error { return nil }); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("other tenant: want not found, got %v", err)
+	}
+	if _, err := repo.Signatures("c", "x", AllSignatures); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("other tenant: want not found, got %v", err)
+	}
+	if list, _ := repo.List("c", DeviceFilter{}); len(list) != 0 {
+		t.Fatalf("other tenant: list %+v", list)
+	}
+}
+
+func TestMemory_TenantIsolation(t *testing.T) {
+	testTenantIsolation(t, NewMemory(), fakeSigner{}, otherSigner{})
+}
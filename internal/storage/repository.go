@@ -1,12 +1,232 @@
 package storage
 
-import "github.com/oxygenesis/signature/internal/domain"
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
 
-// Repository persists SignatureDevice aggregates.
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+// ErrClosed is returned by persistent repositories after Close.
+var ErrClosed = errors.New("repository closed")
+
+// ErrKeyRetained is returned by Update when it destroyed a private key but
+// could not yet remove it from the store's files. The update itself is
+// committed; repeating the destruction retries the removal. Removal is
+// best-effort even when it succeeds: truncated logs, replaced snapshots and
+// freed pages may leave the bytes in free filesystem blocks, and copy-on-write
+// filesystems, SSD wear levelling and backups keep copies the store cannot reach.
+var ErrKeyRetained = errors.New("destroyed key may still be on disk")
+
+// Repository persists SignatureDevice aggregates and their signature journal.
 // Update provides a per-device critical section to support atomic updates.
+// Devices are keyed by tenant and ID: every call names the tenant (Create
+// takes it from dev.Tenant) and never sees another tenant's devices.
 type Repository interface {
 	Create(dev *domain.SignatureDevice, signer domain.Signer) error
-	Get(id string) (*domain.SignatureDevice, domain.Signer, error)
-	List() ([]*domain.SignatureDevice, error)
-	Update(id string, fn func(d *domain.SignatureDevice, signer domain.Signer) error) error
+	Get(tenant, id string) (*domain.SignatureDevice, domain.Signer, error)
+	List(tenant string, f DeviceFilter) ([]*domain.SignatureDevice, error)
+	Update(tenant, id string, fn func(tx Tx) error) error
+	Signatures(tenant, id string, r SignatureRange) ([]domain.SignatureRecord, error)
+}
+
+// deviceKey identifies a device in the in-process repositories.
+type deviceKey struct{ tenant, id string }
+
+func keyOf(dev *domain.SignatureDevice) deviceKey { return deviceKey{dev.Tenant, dev.ID} }
+
+// Tx is the view of one device inside its Update critical section. The
+// device, and every record appended, commit together when fn returns nil.
+type Tx interface {
+	Device() *domain.SignatureDevice
+	Signer() domain.Signer
+	Append(rec domain.SignatureRecord)
+	// SetSigner replaces the device's key; it is persisted with the device.
+	// nil destroys the private key: the stores forget it for good.
+	SetSigner(s domain.Signer)
+	// Idempotent returns the latest record appended with the given
+	// IdempotencyKey after since, including records appended earlier in this
+	// Tx. Keys last used at or before since have expired: the stores may
+	// forget them for good.
+	Idempotent(key string, since time.Time) (domain.SignatureRecord, bool, error)
+}
+
+// DeviceFilter selects devices for List, which returns them ordered by ID.
+// Zero fields match everything; all set fields must match.
+type DeviceFilter struct {
+	Algorithm   domain.Algorithm
+	LabelPrefix string
+	// Tags must all be present with exactly these values.
+	Tags map[string]string
+	// After is the paging cursor: only devices with a greater ID match.
+	After string
+	// Limit caps the number of devices returned; 0 means no limit.
+	Limit int
+}
+
+// Match reports whether d passes the filter. Limit is applied by List.
+func (f DeviceFilter) Match(d *domain.SignatureDevice) bool {
+	if f.After != "" && d.ID <= f.After {
+		return false
+	}
+	if f.Algorithm != "" && d.Algorithm != f.Algorithm {
+		return false
+	}
+	if !strings.HasPrefix(d.Label, f.LabelPrefix) {
+		return false
+	}
+	for k, v := range f.Tags {
+		if got, ok := d.Tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// devicePage collects one List page: the limit devices with the smallest IDs
+// among those offered (all of them if limit is 0). It keeps them in a
+// max-heap on ID, so a page costs O(n log limit) rather than a sort of every
+// matching device. The offered devices must not be modified afterwards.
+type devicePage struct {
+	limit int
+	devs  []*domain.SignatureDevice
+}
+
+func newDevicePage(limit int) *devicePage { return &devicePage{limit: limit} }
+
+func (p *devicePage) Len() int           { return len(p.devs) }
+func (p *devicePage) Less(i, j int) bool { return p.devs[i].ID > p.devs[j].ID }
+func (p *devicePage) Swap(i, j int)      { p.devs[i], p.devs[j] = p.devs[j], p.devs[i] }
+func (p *devicePage) Push(x any)         { p.devs = append(p.devs, x.(*domain.SignatureDevice)) }
+
+func (p *devicePage) Pop() any {
+	d := p.devs[len(p.devs)-1]
+	p.devs = p.devs[:len(p.devs)-1]
+	return d
+}
+
+// offer adds d, a device that passed the filter, if it belongs on the page.
+func (p *devicePage) offer(d *domain.SignatureDevice) {
+	switch {
+	case p.limit <= 0:
+		p.devs = append(p.devs, d)
+	case len(p.devs) < p.limit:
+		heap.Push(p, d)
+	case d.ID < p.devs[0].ID:
+		p.devs[0] = d
+		heap.Fix(p, 0)
+	}
+}
+
+// devices returns copies of the page's devices ordered by ID.
+func (p *devicePage) devices() []*domain.SignatureDevice {
+	out := make([]*domain.SignatureDevice, len(p.devs))
+	for i, d := range p.devs {
+		cp := *d
+		out[i] = &cp
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// SignatureRange selects journal records with From <= Counter <= To, oldest first.
+type SignatureRange struct {
+	From  uint64
+	To    uint64
+	Limit int
+}
+
+// AllSignatures matches the whole journal.
+var AllSignatures = SignatureRange{To: math.MaxUint64}
+
+// KeyCodec converts signers to and from the private key encoding kept by
+// persistent repositories.
+type KeyCodec interface {
+	MarshalSigner(s domain.Signer) (string, error)
+	UnmarshalSigner(alg domain.Algorithm, scheme domain.Scheme, key string) (domain.Signer, error)
+}
+
+// deviceTx is the Tx used by the in-process repositories.
+type deviceTx struct {
+	dev     *domain.SignatureDevice
+	signer  domain.Signer
+	rotated bool
+	records []domain.SignatureRecord
+	// lookup finds committed records by idempotency key.
+	lookup func(key string, since time.Time) (domain.SignatureRecord, bool, error)
+}
+
+func (t *deviceTx) Device() *domain.SignatureDevice   { return t.dev }
+func (t *deviceTx) Signer() domain.Signer             { return t.signer }
+func (t *deviceTx) Append(rec domain.SignatureRecord) { t.records = append(t.records, rec) }
+func (t *deviceTx) SetSigner(s domain.Signer)         { t.signer, t.rotated = s, true }
+
+func (t *deviceTx) Idempotent(key string, since time.Time) (domain.SignatureRecord, bool, error) {
+	for i := len(t.records) - 1; i >= 0; i-- {
+		if t.records[i].IdempotencyKey == key {
+			return t.records[i], t.records[i].CreatedAt.After(since), nil
+		}
+	}
+	return t.lookup(key, since)
+}
+
+// idempotencyIndex maps idempotency keys to the position of the latest
+// record carrying them, in a journal or an index of it. Entries are queued
+// in append order as well, so expired ones are dropped from the front as
+// lookups move the cutoff on, and the index holds only live keys.
+type idempotencyIndex struct {
+	latest map[string]int
+	queue  []idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	key string
+	pos int
+	at  time.Time
+}
+
+func newIdempotencyIndex() *idempotencyIndex {
+	return &idempotencyIndex{latest: map[string]int{}}
+}
+
+// add indexes the record at pos if it carries a key.
+func (ix *idempotencyIndex) add(rec domain.SignatureRecord, pos int) {
+	if rec.IdempotencyKey == "" {
+		return
+	}
+	ix.latest[rec.IdempotencyKey] = pos
+	ix.queue = append(ix.queue, idempotencyEntry{rec.IdempotencyKey, pos, rec.CreatedAt})
+}
+
+// find drops the entries created at or before since and returns the
+// position of key's latest record, if it is still live.
+func (ix *idempotencyIndex) find(key string, since time.Time) (int, bool) {
+	n := 0
+	// records are appended in time order, bar clock steps, which at worst
+	// keep an expired entry a little longer
+	for ; n < len(ix.queue) && !ix.queue[n].at.After(since); n++ {
+		if e := ix.queue[n]; ix.latest[e.key] == e.pos {
+			delete(ix.latest, e.key)
+		}
+	}
+	ix.queue = ix.queue[n:]
+	pos, ok := ix.latest[key]
+	return pos, ok
+}
+
+// selectRange returns the records of an ascending journal that fall in r.
+func selectRange(journal []domain.SignatureRecord, r SignatureRange) []domain.SignatureRecord {
+	i := sort.Search(len(journal), func(i int) bool { return journal[i].Counter >= r.From })
+	out := []domain.SignatureRecord{}
+	for ; i < len(journal) && journal[i].Counter <= r.To; i++ {
+		if r.Limit > 0 && len(out) == r.Limit {
+			break
+		}
+		out = append(out, journal[i])
+	}
+	return out
 }
@@ -0,0 +1,591 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+// Dialect captures the differences between the SQL engines SQL runs on.
+type Dialect struct {
+	// numbered placeholders ($1, $2, ...) instead of "?"
+	numbered bool
+	// forUpdate is appended to the SELECT in Update to row-lock the device.
+	forUpdate string
+	// touchToLock takes the write lock with a no-op UPDATE for engines that
+	// have no SELECT ... FOR UPDATE (SQLite locks the database, not the row).
+	touchToLock bool
+	// tagEquals matches one tag in the JSON tags column; it takes the key
+	// (a domain.ValidTagKey) and the value as arguments.
+	tagEquals string
+	// secureDelete zeroes the old row when a private key is destroyed and
+	// checkpoints the write-ahead log afterwards, so the key leaves the
+	// database files (SQLite's secure_delete).
+	secureDelete bool
+}
+
+// Supported dialects. Open SQLite databases with a busy timeout
+// (e.g. "_pragma=busy_timeout(5000)") so concurrent writers queue instead of failing.
+var (
+	SQLite   = Dialect{touchToLock: true, secureDelete: true, tagEquals: `json_extract(tags, '$."' || ? || '"') = ?`}
+	Postgres = Dialect{numbered: true, forUpdate: " FOR UPDATE", tagEquals: `(tags::jsonb ->> ?) = ?`}
+)
+
+// bind rewrites "?" placeholders into the dialect's style.
+func (d Dialect) bind(q string) string {
+	if !d.numbered {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+type migration struct {
+	version int
+	stmts   []string
+}
+
+// sqlMigrations are applied in order; never edit a released entry, append a new one.
+var sqlMigrations = []migration{
+	{version: 1, stmts: []string{
+		`CREATE TABLE devices (
+			id                TEXT PRIMARY KEY,
+			algorithm         TEXT NOT NULL,
+			label             TEXT NOT NULL DEFAULT '',
+			signature_counter BIGINT NOT NULL DEFAULT 0,
+			last_signature    TEXT NOT NULL DEFAULT '',
+			public_key_pem    TEXT NOT NULL,
+			private_key_pem   TEXT NOT NULL
+		)`,
+	}},
+	{version: 2, stmts: []string{
+		`CREATE TABLE signatures (
+			device_id   TEXT NOT NULL REFERENCES devices (id),
+			counter     BIGINT NOT NULL,
+			data        TEXT NOT NULL,
+			signed_data TEXT NOT NULL,
+			signature   TEXT NOT NULL,
+			created_at  TEXT NOT NULL,
+			PRIMARY KEY (device_id, counter)
+		)`,
+	}},
+	{version: 3, stmts: []string{
+		`ALTER TABLE devices ADD COLUMN key_bits INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE devices ADD COLUMN key_curve TEXT NOT NULL DEFAULT ''`,
+	}},
+	{version: 4, stmts: []string{
+		`ALTER TABLE devices ADD COLUMN scheme TEXT NOT NULL DEFAULT ''`,
+		// existing devices keep signing the way they always did
+		`UPDATE devices SET scheme = 'RSA-PKCS1v15-SHA256' WHERE algorithm = 'RSA'`,
+		`UPDATE devices SET scheme = 'ECDSA-SHA256' WHERE algorithm = 'ECC'`,
+		`UPDATE devices SET scheme = 'Ed25519' WHERE algorithm = 'ED25519'`,
+	}},
+	{version: 5, stmts: []string{
+		// JSON array of domain.DeviceKey; empty for devices that never rotated
+		`ALTER TABLE devices ADD COLUMN key_history TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE signatures ADD COLUMN key_id TEXT NOT NULL DEFAULT 'k1'`,
+	}},
+	{version: 6, stmts: []string{
+		// existing chains were signed in the original format
+		`ALTER TABLE devices ADD COLUMN payload_format TEXT NOT NULL DEFAULT 'v0'`,
+	}},
+	{version: 7, stmts: []string{
+		`ALTER TABLE signatures ADD COLUMN idempotency_key TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX signatures_idempotency ON signatures (device_id, idempotency_key)`,
+	}},
+	{version: 8, stmts: []string{
+		`ALTER TABLE devices ADD COLUMN status TEXT NOT NULL DEFAULT 'active'`,
+	}},
+	{version: 9, stmts: []string{
+		// JSON object of tag key to value
+		`ALTER TABLE devices ADD COLUMN tags TEXT NOT NULL DEFAULT '{}'`,
+	}},
+	{version: 10, stmts: []string{
+		// Devices are keyed by (tenant, id). Primary keys cannot be altered
+		// in place, so both tables are rebuilt; existing rows go to the
+		// default tenant.
+		`CREATE TABLE devices_v10 (
+			tenant            TEXT NOT NULL,
+			id                TEXT NOT NULL,
+			algorithm         TEXT NOT NULL,
+			label             TEXT NOT NULL DEFAULT '',
+			signature_counter BIGINT NOT NULL DEFAULT 0,
+			last_signature    TEXT NOT NULL DEFAULT '',
+			public_key_pem    TEXT NOT NULL,
+			private_key_pem   TEXT NOT NULL,
+			key_bits          INTEGER NOT NULL DEFAULT 0,
+			key_curve         TEXT NOT NULL DEFAULT '',
+			scheme            TEXT NOT NULL DEFAULT '',
+			key_history       TEXT NOT NULL DEFAULT '',
+			payload_format    TEXT NOT NULL DEFAULT 'v0',
+			status            TEXT NOT NULL DEFAULT 'active',
+			tags              TEXT NOT NULL DEFAULT '{}',
+			PRIMARY KEY (tenant, id)
+		)`,
+		`INSERT INTO devices_v10 SELECT 'default', id, algorithm, label, signature_counter, last_signature, public_key_pem,
+			private_key_pem, key_bits, key_curve, scheme, key_history, payload_format, status, tags FROM devices`,
+		`CREATE TABLE signatures_v10 (
+			tenant          TEXT NOT NULL,
+			device_id       TEXT NOT NULL,
+			counter         BIGINT NOT NULL,
+			data            TEXT NOT NULL,
+			signed_data     TEXT NOT NULL,
+			signature       TEXT NOT NULL,
+			created_at      TEXT NOT NULL,
+			key_id          TEXT NOT NULL DEFAULT 'k1',
+			idempotency_key TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (tenant, device_id, counter),
+			FOREIGN KEY (tenant, device_id) REFERENCES devices_v10 (tenant, id)
+		)`,
+		`INSERT INTO signatures_v10 SELECT 'default', device_id, counter, data, signed_data, signature, created_at,
+			key_id, idempotency_key FROM signatures`,
+		`DROP TABLE signatures`,
+		`DROP TABLE devices`,
+		`ALTER TABLE devices_v10 RENAME TO devices`,
+		`ALTER TABLE signatures_v10 RENAME TO signatures`,
+		`CREATE INDEX signatures_idempotency ON signatures (tenant, device_id, idempotency_key)`,
+	}},
+	{version: 11, stmts: []string{
+		// JSON object of principal to device right
+		`ALTER TABLE devices ADD COLUMN acl TEXT NOT NULL DEFAULT '{}'`,
+	}},
+}
+
+const deviceColumns = `tenant, id, algorithm, label, signature_counter, last_signature, public_key_pem, private_key_pem, key_bits, key_curve, scheme, key_history, payload_format, status, tags, acl`
+
+const signatureColumns = `device_id, counter, data, signed_data, signature, key_id, created_at, idempotency_key`
+
+type cachedSigner struct {
+	key    string
+	signer domain.Signer
+}
+
+// SQL is a database/sql Repository. Update runs in a transaction that
+// row-locks the device, so sign + increment stay atomic across processes.
+type SQL struct {
+	db    *sql.DB
+	d     Dialect
+	codec KeyCodec
+
+	mu      sync.Mutex
+	signers map[deviceKey]cachedSigner // parsed keys, reused while the stored key is unchanged
+}
+
+// NewSQL migrates the schema and returns a repository on db. SQL takes
+// ownership of db and closes it in Close.
+func NewSQL(db *sql.DB, d Dialect, codec KeyCodec) (*SQL, error) {
+	s := &SQL{db: db, d: d, codec: codec, signers: make(map[deviceKey]cachedSigner)}
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies every migration newer than the recorded schema version.
+func (s *SQL) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for _, m := range sqlMigrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.apply(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQL) apply(ctx context.Context, m migration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range m.stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, s.d.bind(`INSERT INTO schema_migrations (version) VALUES (?)`), m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Create used to create a new device in the database.
+func (s *SQL) Create(dev *domain.SignatureDevice, signer domain.Signer) error {
+	key, err := s.codec.MarshalSigner(signer)
+	if err != nil {
+		return err
+	}
+	history, err := json.Marshal(dev.Keys)
+	if err != nil {
+		return err
+	}
+	tags, err := marshalMap(dev.Tags)
+	if err != nil {
+		return err
+	}
+	acl, err := marshalMap(dev.ACL)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.d.bind(`INSERT INTO devices (`+deviceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (tenant, id) DO NOTHING`),
+		dev.Tenant, dev.ID, string(dev.Algorithm), dev.Label, int64(dev.SignatureCounter), dev.LastSignatureB64, dev.PublicKeyPEM, key,
+		dev.KeyParams.Bits, dev.KeyParams.Curve, string(dev.Scheme), string(history), string(dev.PayloadFormat), string(dev.Status), tags, acl)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return domain.ErrAlreadyExists
+	}
+	s.cache(keyOf(dev), key, signer)
+	return nil
+}
+
+// Get used to get a device from the database.
+func (s *SQL) Get(tenant, id string) (*domain.SignatureDevice, domain.Signer, error) {
+	row := s.db.QueryRow(s.d.bind(`SELECT `+deviceColumns+` FROM devices WHERE tenant = ? AND id = ?`), tenant, id)
+	dev, key, err := scanDevice(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := s.signer(dev, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dev, signer, nil
+}
+
+// List used to lists the tenant's devices in the database that match f.
+func (s *SQL) List(tenant string, f DeviceFilter) ([]*domain.SignatureDevice, error) {
+	where := []string{`tenant = ?`}
+	args := []any{tenant}
+	if f.Algorithm != "" {
+		where = append(where, `algorithm = ?`)
+		args = append(args, string(f.Algorithm))
+	}
+	if f.LabelPrefix != "" {
+		where = append(where, `substr(label, 1, ?) = ?`)
+		args = append(args, utf8.RuneCountInString(f.LabelPrefix), f.LabelPrefix)
+	}
+	if f.After != "" {
+		where = append(where, `id > ?`)
+		args = append(args, f.After)
+	}
+	for k, v := range f.Tags {
+		if !domain.ValidTagKey(k) {
+			return []*domain.SignatureDevice{}, nil // no device can carry it
+		}
+		where = append(where, s.d.tagEquals)
+		args = append(args, k, v)
+	}
+	q := `SELECT ` + deviceColumns + ` FROM devices WHERE ` + strings.Join(where, ` AND `) + ` ORDER BY id`
+	if f.Limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.Query(s.d.bind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*domain.SignatureDevice{}
+	for rows.Next() {
+		dev, _, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, dev)
+	}
+	return out, rows.Err()
+}
+
+// Update locks the device row, runs fn and commits its changes in one
+// transaction. If fn fails the transaction is rolled back.
+func (s *SQL) Update(tenant, id string, fn func(tx Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.d.touchToLock {
+		if _, err := tx.Exec(s.d.bind(`UPDATE devices SET id = id WHERE tenant = ? AND id = ?`), tenant, id); err != nil {
+			return err
+		}
+	}
+	row := tx.QueryRow(s.d.bind(`SELECT `+deviceColumns+` FROM devices WHERE tenant = ? AND id = ?`+s.d.forUpdate), tenant, id)
+	dev, key, err := scanDevice(row)
+	if err != nil {
+		return err
+	}
+	signer, err := s.signer(dev, key)
+	if err != nil {
+		return err
+	}
+	dtx := &deviceTx{dev: dev, signer: signer, lookup: func(k string, since time.Time) (domain.SignatureRecord, bool, error) {
+		row := tx.QueryRow(s.d.bind(`SELECT `+signatureColumns+` FROM signatures
+			WHERE tenant = ? AND device_id = ? AND idempotency_key = ? ORDER BY counter DESC LIMIT 1`), tenant, id, k)
+		rec, err := scanSignature(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return rec, false, nil
+		}
+		return rec, err == nil && rec.CreatedAt.After(since), err
+	}}
+	if err := fn(dtx); err != nil {
+		return err
+	}
+	purge := dtx.rotated && dtx.signer == nil && s.d.secureDelete
+	// restore puts back the connection's secure_delete setting
+	var restore func() error
+	if purge {
+		// before any write of this transaction frees the cell holding the key.
+		// The pragma belongs to the pooled connection, not the transaction,
+		// so it is put back before the connection is released.
+		var prev int
+		if err := tx.QueryRow(`PRAGMA secure_delete`).Scan(&prev); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`PRAGMA secure_delete = ON`); err != nil {
+			return err
+		}
+		restore = func() error {
+			_, err := tx.Exec(`PRAGMA secure_delete = ` + strconv.Itoa(prev))
+			return err
+		}
+		defer func() {
+			if restore != nil { // a write failed; runs before the deferred Rollback
+				_ = restore()
+			}
+		}()
+	}
+	history, err := json.Marshal(dev.Keys)
+	if err != nil {
+		return err
+	}
+	tags, err := marshalMap(dev.Tags)
+	if err != nil {
+		return err
+	}
+	acl, err := marshalMap(dev.ACL)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.d.bind(`UPDATE devices SET label = ?, signature_counter = ?, last_signature = ?, public_key_pem = ?, key_history = ?, status = ?, tags = ?, acl = ? WHERE tenant = ? AND id = ?`),
+		dev.Label, int64(dev.SignatureCounter), dev.LastSignatureB64, dev.PublicKeyPEM, string(history), string(dev.Status), tags, acl, tenant, id); err != nil {
+		return err
+	}
+	if dtx.rotated {
+		key = "" // a nil signer destroys the key
+		if dtx.signer != nil {
+			if key, err = s.codec.MarshalSigner(dtx.signer); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(s.d.bind(`UPDATE devices SET private_key_pem = ? WHERE tenant = ? AND id = ?`), key, tenant, id); err != nil {
+			return err
+		}
+	}
+	for _, rec := range dtx.records {
+		if _, err := tx.Exec(s.d.bind(`INSERT INTO signatures (tenant, `+signatureColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			tenant, rec.DeviceID, int64(rec.Counter), rec.Data, rec.SignedData, rec.Signature, rec.KeyID, rec.CreatedAt.UTC().Format(time.RFC3339Nano),
+			rec.IdempotencyKey); err != nil {
+			return err
+		}
+	}
+	if restore != nil {
+		err, restore = restore(), nil
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if dtx.rotated {
+		s.cache(deviceKey{tenant, id}, key, dtx.signer)
+	}
+	if purge {
+		// older page versions in the -wal file still hold the key
+		var busy, frames, done int
+		if err := s.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &frames, &done); err != nil {
+			return fmt.Errorf("%w: checkpoint: %v", ErrKeyRetained, err)
+		}
+		if busy != 0 {
+			return fmt.Errorf("%w: checkpoint blocked by readers", ErrKeyRetained)
+		}
+	}
+	return nil
+}
+
+// Signatures used to read a device's signature journal from the database.
+func (s *SQL) Signatures(tenant, id string, sr SignatureRange) ([]domain.SignatureRecord, error) {
+	var exists int
+	if err := s.db.QueryRow(s.d.bind(`SELECT 1 FROM devices WHERE tenant = ? AND id = ?`), tenant, id).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, err
+	}
+	q := `SELECT ` + signatureColumns + ` FROM signatures
+		WHERE tenant = ? AND device_id = ? AND counter >= ? AND counter <= ? ORDER BY counter`
+	args := []any{tenant, id, clampCounter(sr.From), clampCounter(sr.To)}
+	if sr.Limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, sr.Limit)
+	}
+	rows, err := s.db.Query(s.d.bind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []domain.SignatureRecord{}
+	for rows.Next() {
+		rec, err := scanSignature(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+func scanSignature(sc scanner) (domain.SignatureRecord, error) {
+	var (
+		rec     domain.SignatureRecord
+		counter int64
+		created string
+	)
+	if err := sc.Scan(&rec.DeviceID, &counter, &rec.Data, &rec.SignedData, &rec.Signature, &rec.KeyID, &created, &rec.IdempotencyKey); err != nil {
+		return rec, err
+	}
+	rec.Counter = uint64(counter)
+	var err error
+	rec.CreatedAt, err = time.Parse(time.RFC3339Nano, created)
+	return rec, err
+}
+
+// marshalMap encodes tags or an ACL for their JSON column; an empty map is
+// "{}", never "null".
+func marshalMap[V any](m map[string]V) (string, error) {
+	if len(m) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+// clampCounter maps a uint64 counter onto the signed BIGINT column.
+func clampCounter(c uint64) int64 {
+	if c > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(c)
+}
+
+// Close closes the underlying database.
+func (s *SQL) Close() error { return s.db.Close() }
+
+func (s *SQL) signer(dev *domain.SignatureDevice, key string) (domain.Signer, error) {
+	if key == "" { // destroyed
+		return nil, nil
+	}
+	s.mu.Lock()
+	c, ok := s.signers[keyOf(dev)]
+	s.mu.Unlock()
+	if ok && c.key == key {
+		return c.signer, nil
+	}
+	signer, err := s.codec.UnmarshalSigner(dev.Algorithm, dev.Scheme, key)
+	if err != nil {
+		return nil, err
+	}
+	s.cache(keyOf(dev), key, signer)
+	return signer, nil
+}
+
+func (s *SQL) cache(k deviceKey, key string, signer domain.Signer) {
+	s.mu.Lock()
+	s.signers[k] = cachedSigner{key: key, signer: signer}
+	s.mu.Unlock()
+}
+
+type scanner interface{ Scan(dest ...any) error }
+
+func scanDevice(sc scanner) (*domain.SignatureDevice, string, error) {
+	var (
+		dev     domain.SignatureDevice
+		alg     string
+		counter int64
+		key     string
+		scheme  string
+		history string
+		format  string
+		status  string
+		tags    string
+		acl     string
+	)
+	err := sc.Scan(&dev.Tenant, &dev.ID, &alg, &dev.Label, &counter, &dev.LastSignatureB64, &dev.PublicKeyPEM, &key,
+		&dev.KeyParams.Bits, &dev.KeyParams.Curve, &scheme, &history, &format, &status, &tags, &acl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", domain.ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	dev.Algorithm = domain.Algorithm(alg)
+	dev.Scheme = domain.Scheme(scheme)
+	dev.PayloadFormat = domain.PayloadFormat(format)
+	dev.Status = domain.DeviceStatus(status)
+	if history != "" && history != "null" {
+		if err := json.Unmarshal([]byte(history), &dev.Keys); err != nil {
+			return nil, "", fmt.Errorf("device %q key history: %w", dev.ID, err)
+		}
+	}
+	if tags != "" && tags != "{}" {
+		if err := json.Unmarshal([]byte(tags), &dev.Tags); err != nil {
+			return nil, "", fmt.Errorf("device %q tags: %w", dev.ID, err)
+		}
+	}
+	if acl != "" && acl != "{}" {
+		if err := json.Unmarshal([]byte(acl), &dev.ACL); err != nil {
+			return nil, "", fmt.Errorf("device %q acl: %w", dev.ID, err)
+		}
+	}
+	dev.EnsureKeys()
+	dev.SignatureCounter = uint64(counter)
+	return &dev, key, nil
+}
+
+var _ Repository = (*SQL)(nil)
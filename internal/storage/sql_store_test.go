@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"crypto/elliptic"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/oxygenesis/signature/internal/crypto"
+	"github.com/oxygenesis/signature/internal/domain"
+)
+
+func openTestSQL(t *testing.T, path string) *SQL {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQL(db, SQLite, crypto.PEMCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSQL_CRUD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dev.db")
+	s := openTestSQL(t, path)
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	d := &domain.SignatureDevice{Tenant: tn, ID: "x", Algorithm: domain.AlgECC, Label: "L", KeyParams: domain.KeyParams{Curve: "P-256"}, PublicKeyPEM: signer.PublicPEM()}
+	if err := s.Create(d, signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(d, signer); !errors.Is(err, domain.ErrAlreadyExists) {
+		t.Fatalf("want conflict, got %v", err)
+	}
+	if err := s.Create(&domain.SignatureDevice{Tenant: tn, ID: "y"}, fakeSigner{}); err == nil {
+		t.Fatal("want codec error")
+	}
+	if err := s.Update(tn, "x", func(tx Tx) error {
+		dev := tx.Device()
+		dev.SignatureCounter++
+		dev.LastSignatureB64 = "s1"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := errors.New("fn error")
+	if err := s.Update(tn, "x", func(tx Tx) error {
+		tx.Device().SignatureCounter = 99
+		return want
+	}); !errors.Is(err, want) {
+		t.Fatalf("got %v want %v", err, want)
+	}
+	if err := s.Update(tn, "missing", func(Tx) error { return nil }); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want not found, got %v", err)
+	}
+	if _, _, err := s.Get(tn, "missing"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("want not found, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen: migrations are idempotent, state and key survive
+	s = openTestSQL(t, path)
+	defer s.Close()
+	got, restored, err := s.Get(tn, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SignatureCounter != 1 || got.LastSignatureB64 != "s1" || got.Label != "L" || got.KeyParams.Curve != "P-256" {
+		t.Fatalf("restored %+v", got)
+	}
+	sig, _ := restored.Sign([]byte("p"))
+	if !signer.Verify([]byte("p"), sig) {
+		t.Fatal("restored key does not match")
+	}
+	list, err := s.List(tn, DeviceFilter{})
+	if err != nil || len(list) != 1 {
+		t.Fatalf("list=%v err=%v", list, err)
+	}
+}
+
+func TestSQL_ConcurrentUpdate_NoGaps(t *testing.T) {
+	s := openTestSQL(t, filepath.Join(t.TempDir(), "dev.db"))
+	defer s.Close()
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	if err := s.Create(&domain.SignatureDevice{Tenant: tn, ID: "x", Algorithm: domain.AlgECC}, signer); err != nil {
+		t.Fatal(err)
+	}
+	const N = 40
+	var wg sync.WaitGroup
+	wg.Add(N)
+	for i := 0; i < N; i++ {
+		go func() {
+			defer wg.Done()
+			if err := s.Update(tn, "x", func(tx Tx) error {
+				tx.Device().SignatureCounter++
+				return nil
+			}); err != nil {
+				t.Errorf("update: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	got, _, _ := s.Get(tn, "x")
+	if got.SignatureCounter != N {
+		t.Fatalf("counter=%d want=%d", got.SignatureCounter, N)
+	}
+}
+
+func TestDialect_Bind(t *testing.T) {
+	q := `UPDATE t SET a = ? WHERE b = ?`
+	if got := SQLite.bind(q); got != q {
+		t.Fatalf("sqlite bind=%q", got)
+	}
+	if got := Postgres.bind(q); got != `UPDATE t SET a = $1 WHERE b = $2` {
+		t.Fatalf("postgres bind=%q", got)
+	}
+}
+
+func TestSQL_Journal(t *testing.T) {
+	s := openTestSQL(t, filepath.Join(t.TempDir(), "dev.db"))
+	defer s.Close()
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	testJournal(t, s, signer)
+}
+
+func TestSQL_MigrationBackfillsScheme(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	all := sqlMigrations
+	sqlMigrations = all[:3] // schema before schemes existed
+	old := openTestSQL(t, path)
+	sqlMigrations = all
+	signer, _ := crypto.NewRSASigner(1024)
+	key, _ := crypto.PEMCodec{}.MarshalSigner(signer)
+	if _, err := old.db.Exec(`INSERT INTO devices (id, algorithm, public_key_pem, private_key_pem) VALUES ('r', 'RSA', ?, ?)`,
+		signer.PublicPEM(), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.db.Exec(`INSERT INTO signatures (device_id, counter, data, signed_data, signature, created_at) VALUES ('r', 0, 'd', 'sd', 'sig', ?)`,
+		time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		t.Fatal(err)
+	}
+	_ = old.Close()
+
+	s := openTestSQL(t, path)
+	defer s.Close()
+	d, restored, err := s.Get(domain.DefaultTenant, "r")
+	if err != nil || d.Scheme != domain.SchemeRSAPKCS1v15SHA256 || d.PayloadFormat != domain.PayloadV0 || d.Status != domain.StatusActive {
+		t.Fatalf("scheme/payload format not backfilled: %+v %v", d, err)
+	}
+	if recs, err := s.Signatures(domain.DefaultTenant, "r", AllSignatures); err != nil || len(recs) != 1 || recs[0].KeyID != domain.FirstKeyID {
+		t.Fatalf("journal not carried over: %+v %v", recs, err)
+	}
+	sig, _ := signer.Sign([]byte("p"))
+	if !restored.Verify([]byte("p"), sig) {
+		t.Fatal("restored signer changed scheme")
+	}
+}
+
+func TestSQL_RotationAndKeyIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rot.db")
+	s := openTestSQL(t, path)
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	d := &domain.SignatureDevice{Tenant: tn, ID: "a", Algorithm: domain.AlgECC, PublicKeyPEM: signer.PublicPEM(), PayloadFormat: domain.PayloadV1}
+	d.EnsureKeys()
+	if err := s.Create(d, signer); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := crypto.NewECDSASigner(elliptic.P256())
+	if err := s.Update(tn, "a", func(tx Tx) error {
+		dev := tx.Device()
+		dev.RotateKey(next.PublicPEM())
+		tx.SetSigner(next)
+		tx.Append(domain.SignatureRecord{DeviceID: "a", Counter: 0, KeyID: dev.CurrentKey().ID, CreatedAt: time.Now()})
+		dev.SignatureCounter++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	s = openTestSQL(t, path)
+	defer s.Close()
+	got, restored, err := s.Get(tn, "a")
+	if err != nil || restored.PublicPEM() != next.PublicPEM() || len(got.Keys) != 2 || got.Keys[1].ID != "k2" || got.PayloadFormat != domain.PayloadV1 {
+		t.Fatalf("rotation not persisted: %+v %v", got, err)
+	}
+	recs, _ := s.Signatures(tn, "a", AllSignatures)
+	if len(recs) != 1 || recs[0].KeyID != "k2" {
+		t.Fatalf("records %+v", recs)
+	}
+}
+
+func TestSQL_DecommissionDestroysKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dec.db")
+	s := openTestSQL(t, path)
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	_ = s.Create(&domain.SignatureDevice{Tenant: tn, ID: "a", Algorithm: domain.AlgECC, PublicKeyPEM: signer.PublicPEM()}, signer)
+	pem, _ := crypto.PEMCodec{}.MarshalSigner(signer)
+	body := strings.Split(pem, "\n")[1] // a line of the key's base64
+	decommission(t, s, "a")
+	if _, cached, _ := s.Get(tn, "a"); cached != nil {
+		t.Fatal("signer still cached")
+	}
+	// neither freed pages nor the -wal file keep the key, even before Close
+	for _, p := range []string{path, path + "-wal"} {
+		if b, _ := os.ReadFile(p); strings.Contains(string(b), body) {
+			t.Fatalf("private key bytes left in %s", filepath.Base(p))
+		}
+	}
+	_ = s.Close()
+
+	s = openTestSQL(t, path)
+	defer s.Close()
+	d, restored, err := s.Get(tn, "a")
+	if err != nil || restored != nil || d.Status != domain.StatusDecommissioned || d.PublicKeyPEM != signer.PublicPEM() {
+		t.Fatalf("after reopen: %+v signer=%v err=%v", d, restored, err)
+	}
+	var key string
+	_ = s.db.QueryRow(`SELECT private_key_pem FROM devices WHERE id = 'a'`).Scan(&key)
+	if key != "" {
+		t.Fatal("private key left in the database")
+	}
+}
+
+func TestSQL_DecommissionRestoresSecureDelete(t *testing.T) {
+	s := openTestSQL(t, filepath.Join(t.TempDir(), "pragma.db"))
+	defer s.Close()
+	s.db.SetMaxOpenConns(1) // so the check below sees the connection the purge used
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	_ = s.Create(&domain.SignatureDevice{Tenant: tn, ID: "a", Algorithm: domain.AlgECC, PublicKeyPEM: signer.PublicPEM()}, signer)
+	decommission(t, s, "a")
+	var on int
+	if err := s.db.QueryRow(`PRAGMA secure_delete`).Scan(&on); err != nil || on != 0 {
+		t.Fatalf("secure_delete=%d after decommission (%v)", on, err)
+	}
+}
+
+func TestSQL_ListFilter(t *testing.T) {
+	s := openTestSQL(t, filepath.Join(t.TempDir(), "dev.db"))
+	defer s.Close()
+	signer, _ := crypto.NewECDSASigner(elliptic.P256())
+	testListFilter(t, s, signer)
+}
+
+func TestSQL_TenantIsolation(t *testing.T) {
+	s := openTestSQL(t, filepath.Join(t.TempDir(), "dev.db"))
+	defer s.Close()
+	a, _ := crypto.NewECDSASigner(elliptic.P256())
+	b, _ := crypto.NewECDSASigner(elliptic.P256())
+	testTenantIsolation(t, s, a, b)
+}
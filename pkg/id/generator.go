@@ -2,14 +2,36 @@ package id
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
 )
 
-// Generator creates unique IDs (UUIDv4-like).
+// Generator creates unique IDs.
 type Generator interface {
 	New() string
 }
 
+// now is stubbed in tests.
+var now = time.Now
+
+// ByName returns the generator selected by configuration: "uuidv4",
+// "uuidv7" or "ulid".
+func ByName(name string) (Generator, error) {
+	switch name {
+	case "uuidv4":
+		return UUIDv4{}, nil
+	case "uuidv7":
+		return UUIDv7{}, nil
+	case "ulid":
+		return ULID{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id generator %q (want uuidv4, uuidv7 or ulid)", name)
+	}
+}
+
 type UUIDv4 struct{}
 
 func (UUIDv4) New() string {
@@ -18,7 +40,108 @@ func (UUIDv4) New() string {
 	// Set version (4) and variant (10)
 	b[6] = (b[6] & 0x0f) | 0x40
 	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b)
+}
+
+// UUIDv7 creates RFC 9562 version 7 UUIDs: a Unix millisecond timestamp
+// followed by random bits, so they sort by creation time. Within one
+// millisecond the 12-bit rand_a field counts up, so IDs from one process are
+// strictly increasing even when the clock stalls or steps back.
+type UUIDv7 struct{}
+
+var v7 struct {
+	sync.Mutex
+	ms  int64
+	seq uint16
+}
+
+func (UUIDv7) New() string {
+	v7.Lock()
+	if ms := now().UnixMilli(); ms > v7.ms {
+		var r [2]byte
+		_, _ = rand.Read(r[:])
+		// start in the lower half so the counter has room to grow
+		v7.ms, v7.seq = ms, binary.BigEndian.Uint16(r[:])&0x7ff
+	} else if v7.seq++; v7.seq > 0xfff {
+		v7.ms, v7.seq = v7.ms+1, 0
+	}
+	ms, seq := v7.ms, v7.seq
+	v7.Unlock()
+
+	var b [16]byte
+	putMillis(b[:6], ms)
+	_, _ = rand.Read(b[8:])
+	// version (7) with the counter as rand_a, variant (10)
+	b[6] = 0x70 | byte(seq>>8)
+	b[7] = byte(seq)
+	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b)
+}
+
+// ULID creates 26-character ULIDs (https://github.com/ulid/spec): a Unix
+// millisecond timestamp and 80 random bits in Crockford base32. They are
+// monotonic like the spec describes: within one millisecond the random part
+// of the previous ID is incremented.
+type ULID struct{}
+
+var ulid struct {
+	sync.Mutex
+	ms      int64
+	entropy [10]byte
+}
+
+func (ULID) New() string {
+	ulid.Lock()
+	if ms := now().UnixMilli(); ms > ulid.ms {
+		ulid.ms = ms
+		_, _ = rand.Read(ulid.entropy[:])
+	} else if !increment(ulid.entropy[:]) {
+		// 2^80 IDs in one millisecond: borrow the next one
+		ulid.ms++
+		_, _ = rand.Read(ulid.entropy[:])
+	}
+	var b [16]byte
+	putMillis(b[:6], ulid.ms)
+	copy(b[6:], ulid.entropy[:])
+	ulid.Unlock()
+	return crockford(b)
+}
+
+// putMillis writes the low 48 bits of ms big-endian into b[:6].
+func putMillis(b []byte, ms int64) {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(ms))
+	copy(b, t[2:])
+}
+
+// increment adds one to the big-endian number in b and reports false on overflow.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func formatUUID(b [16]byte) string {
 	hexstr := hex.EncodeToString(b[:])
 	// 8-4-4-4-12
 	return hexstr[0:8] + "-" + hexstr[8:12] + "-" + hexstr[12:16] + "-" + hexstr[16:20] + "-" + hexstr[20:32]
 }
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// crockford encodes 128 bits as 26 base32 digits, most significant first
+// (the leading digit carries only 3 bits).
+func crockford(b [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -1,6 +1,10 @@
 package id
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestUUIDv4_New(t *testing.T) {
 	g := UUIDv4{}
@@ -12,3 +16,62 @@ func TestUUIDv4_New(t *testing.T) {
 		m[id] = struct{}{}
 	}
 }
+
+// stubClock makes now return *clock and forgets the last IDs handed out.
+func stubClock(t *testing.T, clock *time.Time) {
+	orig := now
+	t.Cleanup(func() { now = orig })
+	now = func() time.Time { return *clock }
+	v7.ms, ulid.ms = 0, 0
+}
+
+func TestSortableIDs_IncreaseWithinAndAcrossMilliseconds(t *testing.T) {
+	clock := time.UnixMilli(1700000000000)
+	stubClock(t, &clock)
+
+	for name, g := range map[string]Generator{"uuidv7": UUIDv7{}, "ulid": ULID{}} {
+		prev := ""
+		for i := 0; i < 5000; i++ {
+			switch i {
+			case 2000:
+				clock = clock.Add(time.Millisecond)
+			case 4000:
+				clock = clock.Add(-time.Second) // clock steps back
+			}
+			id := g.New()
+			if id <= prev {
+				t.Fatalf("%s: %q after %q", name, id, prev)
+			}
+			prev = id
+		}
+	}
+}
+
+func TestUUIDv7_Layout(t *testing.T) {
+	clock := time.UnixMilli(0x0123456789ab)
+	stubClock(t, &clock)
+	id := UUIDv7{}.New()
+	if len(id) != 36 || id[:13] != "01234567-89ab" || id[14] != '7' || !strings.ContainsRune("89ab", rune(id[19])) {
+		t.Fatalf("id=%s", id)
+	}
+}
+
+func TestULID_Layout(t *testing.T) {
+	clock := time.UnixMilli(1469918176385) // spec example: 01ARYZ6S41
+	stubClock(t, &clock)
+	id := ULID{}.New()
+	if len(id) != 26 || id[:10] != "01ARYZ6S41" || strings.ContainsAny(id, "ILOU") {
+		t.Fatalf("id=%s", id)
+	}
+}
+
+func TestByName(t *testing.T) {
+	for _, name := range []string{"uuidv4", "uuidv7", "ulid"} {
+		if g, err := ByName(name); err != nil || g.New() == "" {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if _, err := ByName("snowflake"); err == nil {
+		t.Fatal("want error")
+	}
+}
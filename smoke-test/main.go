@@ -6,8 +6,12 @@ import (
 	"bytes"
 	goCrypto "crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -22,7 +26,6 @@ import (
 	"github.com/oxygenesis/signature/internal/app/http/handler"
 	"github.com/oxygenesis/signature/internal/app/http/middleware"
 	"github.com/oxygenesis/signature/internal/crypto"
-	"github.com/oxygenesis/signature/internal/domain"
 	"github.com/oxygenesis/signature/internal/service"
 	"github.com/oxygenesis/signature/internal/storage"
 	"github.com/oxygenesis/signature/pkg/id"
@@ -30,11 +33,6 @@ import (
 
 const apiPrefix = "/v1" // adjust to "" if your routes don’t use /v1
 
-type factory struct{}
-
-func (factory) NewRSA(bits int) (domain.Signer, error) { return crypto.NewRSASigner(bits) }
-func (factory) NewECDSA() (domain.Signer, error)       { return crypto.NewECDSASigner() }
-
 // must fails the smoke test immediately with a helpful message.
 func must(ok bool, msg string, args ...any) {
 	if !ok {
@@ -45,17 +43,19 @@ func must(ok bool, msg string, args ...any) {
 func main() {
 	// Wire the app with an in-process server (no real port binding).
 	repo := storage.NewMemory()
-	svc := service.New(repo, factory{}, id.UUIDv4{})
+	svc := service.New(repo, crypto.Default(), id.UUIDv4{})
 
 	dev := handler.NewDevice(svc)
 	mux := http.NewServeMux()
 	mux.HandleFunc(apiPrefix+"/health", dev.Health)
+	mux.HandleFunc(apiPrefix+"/algorithms", dev.Algorithms)
 	mux.HandleFunc(apiPrefix+"/devices", dev.Devices)
 	mux.HandleFunc(apiPrefix+"/devices/", dev.DeviceOps)
 
-	ts := httptest.NewServer(middleware.Recovery(mux))
+	ts := httptest.NewServer(middleware.Recovery(middleware.Tenant(mux)))
 	defer ts.Close()
 
+	tenant := "" // X-Tenant-ID for the requests below; empty is the default tenant
 	do := func(method, path string, body any) (int, []byte) {
 		var rdr io.Reader
 		if body != nil {
@@ -64,6 +64,9 @@ func main() {
 		}
 		req, _ := http.NewRequest(method, ts.URL+path, rdr)
 		req.Header.Set("content-type", "application/json")
+		if tenant != "" {
+			req.Header.Set(middleware.TenantHeader, tenant)
+		}
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			log.Fatal(err)
@@ -83,6 +86,15 @@ func main() {
 	_ = json.Unmarshal(body, &health)
 	must(health.Status == "ok", "health body=%s", string(body))
 
+	// 1b) Algorithms: every built-in algorithm is advertised
+	code, body = do("GET", apiPrefix+"/algorithms", nil)
+	must(code == 200, "algorithms status=%d", code)
+	var algs []struct {
+		Name string `json:"name"`
+	}
+	_ = json.Unmarshal(body, &algs)
+	must(len(algs) == 3, "algorithms=%s", string(body))
+
 	// 2) Create device (RSA)
 	deviceID := "dev-1"
 	code, body = do("POST", apiPrefix+"/devices", map[string]any{
@@ -117,12 +129,15 @@ func main() {
 	type signResp struct {
 		Signature  string `json:"signature"`
 		SignedData string `json:"signed_data"`
+		Scheme     string `json:"scheme"`
+		KeyID      string `json:"key_id"`
 	}
 	var sr signResp
 	if err := json.Unmarshal(body, &sr); err != nil {
 		log.Fatalf("SMOKE FAIL: sign unmarshal: %v", err)
 	}
 	must(sr.Signature != "", "signature empty")
+	must(sr.Scheme == "RSA-PKCS1v15-SHA256", "default scheme=%q", sr.Scheme)
 	must(strings.HasPrefix(sr.SignedData, "0_hello_"), "signed_data=%q", sr.SignedData)
 	parts := strings.Split(sr.SignedData, "_")
 	must(len(parts) == 3, "signed_data parts=%d (%q)", len(parts), sr.SignedData)
@@ -130,7 +145,7 @@ func main() {
 		"base case last should be base64(id): got %q", parts[2])
 
 	// Verify signature with returned public key (works for RSA/PKIX or RSA/PKCS#1)
-	verify(sr.Signature, sr.SignedData, devOut.PublicKeyPEM)
+	verify(sr.Signature, sr.SignedData, devOut.PublicKeyPEM, sr.Scheme)
 
 	// 4) Get device; counter advanced and last_signature matches
 	code, body = do("GET", apiPrefix+"/devices/"+deviceID, nil)
@@ -142,11 +157,188 @@ func main() {
 	}
 	must(dev2.SignatureCounter == 1, "counter=%d", dev2.SignatureCounter)
 	must(dev2.LastSignatureB64 == sr.Signature, "last_signature mismatch")
+
+	// 5) Ed25519 device: create, sign, verify with the SPKI public key
+	code, body = do("POST", apiPrefix+"/devices", map[string]any{"id": "dev-ed", "algorithm": "ED25519"})
+	must(code == 201, "create ed25519 status=%d body=%s", code, string(body))
+	var edDev deviceResp
+	_ = json.Unmarshal(body, &edDev)
+	code, body = do("POST", apiPrefix+"/devices/dev-ed/sign", map[string]any{"data": "hello"})
+	must(code == 200, "sign ed25519 status=%d body=%s", code, string(body))
+	var edSig signResp
+	_ = json.Unmarshal(body, &edSig)
+	verify(edSig.Signature, edSig.SignedData, edDev.PublicKeyPEM, edSig.Scheme)
+
+	// 6) ECC device on a non-default curve: key_params echoed, signature verifies
+	code, body = do("POST", apiPrefix+"/devices", map[string]any{"id": "dev-p384", "algorithm": "ECC", "key_params": map[string]any{"curve": "P-384"}})
+	must(code == 201, "create P-384 status=%d body=%s", code, string(body))
+	var p384 struct {
+		deviceResp
+		KeyParams struct {
+			Curve string `json:"curve"`
+		} `json:"key_params"`
+	}
+	_ = json.Unmarshal(body, &p384)
+	must(p384.KeyParams.Curve == "P-384", "key_params=%s", string(body))
+	code, body = do("POST", apiPrefix+"/devices/dev-p384/sign", map[string]any{"data": "hello"})
+	must(code == 200, "sign P-384 status=%d body=%s", code, string(body))
+	var pSig signResp
+	_ = json.Unmarshal(body, &pSig)
+	verify(pSig.Signature, pSig.SignedData, p384.PublicKeyPEM, pSig.Scheme)
+
+	// 7) RSA-PSS with SHA-384: the sign response names the scheme to verify with
+	code, body = do("POST", apiPrefix+"/devices", map[string]any{"id": "dev-pss", "algorithm": "RSA", "scheme": "RSA-PSS-SHA384"})
+	must(code == 201, "create pss status=%d body=%s", code, string(body))
+	var pssDev deviceResp
+	_ = json.Unmarshal(body, &pssDev)
+	code, body = do("POST", apiPrefix+"/devices/dev-pss/sign", map[string]any{"data": "hello"})
+	must(code == 200, "sign pss status=%d body=%s", code, string(body))
+	var pssSig signResp
+	_ = json.Unmarshal(body, &pssSig)
+	must(pssSig.Scheme == "RSA-PSS-SHA384", "scheme=%q", pssSig.Scheme)
+	verify(pssSig.Signature, pssSig.SignedData, pssDev.PublicKeyPEM, pssSig.Scheme)
+
+	// 8) Import an existing SEC1 key and continue its chain
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	sec1, _ := x509.MarshalECPrivateKey(ek)
+	code, body = do("POST", apiPrefix+"/devices/import", map[string]any{
+		"id": "dev-imported", "algorithm": "ECC",
+		"private_key_pem":       string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})),
+		"signature_counter":     42,
+		"last_signature_base64": "cHJldmlvdXM=",
+	})
+	must(code == 201, "import status=%d body=%s", code, string(body))
+	var imported deviceResp
+	_ = json.Unmarshal(body, &imported)
+	code, body = do("POST", apiPrefix+"/devices/dev-imported/sign", map[string]any{"data": "hello"})
+	must(code == 200, "sign imported status=%d body=%s", code, string(body))
+	var impSig signResp
+	_ = json.Unmarshal(body, &impSig)
+	must(impSig.SignedData == "42_hello_cHJldmlvdXM=", "imported chain signed_data=%q", impSig.SignedData)
+	verify(impSig.Signature, impSig.SignedData, imported.PublicKeyPEM, impSig.Scheme)
+
+	// 9) Rotate the ECC device: the chain carries on under a new key ID and
+	// the first signature still verifies with the retired key from the history
+	code, body = do("POST", apiPrefix+"/devices/dev-p384/rotate", nil)
+	must(code == 200, "rotate status=%d body=%s", code, string(body))
+	var rotated struct {
+		Keys []struct {
+			KeyID        string `json:"key_id"`
+			PublicKeyPEM string `json:"public_key_pem"`
+		} `json:"keys"`
+	}
+	_ = json.Unmarshal(body, &rotated)
+	must(len(rotated.Keys) == 2, "keys=%s", string(body))
+	code, body = do("POST", apiPrefix+"/devices/dev-p384/sign", map[string]any{"data": "after"})
+	must(code == 200, "sign after rotate status=%d body=%s", code, string(body))
+	var rSig signResp
+	_ = json.Unmarshal(body, &rSig)
+	must(rSig.KeyID == rotated.Keys[1].KeyID, "key_id=%q", rSig.KeyID)
+	must(strings.HasPrefix(rSig.SignedData, "1_after_"+pSig.Signature), "signed_data=%q", rSig.SignedData)
+	verify(rSig.Signature, rSig.SignedData, rotated.Keys[1].PublicKeyPEM, rSig.Scheme)
+	verify(pSig.Signature, pSig.SignedData, rotated.Keys[0].PublicKeyPEM, pSig.Scheme)
+
+	// 10) Server-side verification: the retired key's signature and a batch
+	code, body = do("POST", apiPrefix+"/devices/dev-p384/verify", map[string]any{"signed_data": pSig.SignedData, "signature": pSig.Signature})
+	must(code == 200 && strings.Contains(string(body), `"valid":true`), "verify status=%d body=%s", code, string(body))
+	code, body = do("POST", apiPrefix+"/devices/dev-p384/verify/batch", map[string]any{"items": []map[string]any{
+		{"signed_data": pSig.SignedData, "signature": pSig.Signature},
+		{"signed_data": rSig.SignedData, "signature": rSig.Signature},
+		{"signed_data": rSig.SignedData, "signature": pSig.Signature},
+	}})
+	var vb struct {
+		Results []struct {
+			Valid bool   `json:"valid"`
+			KeyID string `json:"key_id"`
+		} `json:"results"`
+	}
+	_ = json.Unmarshal(body, &vb)
+	must(code == 200 && len(vb.Results) == 3, "verify batch status=%d body=%s", code, string(body))
+	must(vb.Results[0].Valid && vb.Results[1].Valid && !vb.Results[2].Valid, "verify batch=%s", string(body))
+	must(vb.Results[0].KeyID != vb.Results[1].KeyID, "verify batch key ids=%s", string(body))
+
+	// 11) Batch signing: consecutive counters, each item chained into the next
+	code, body = do("POST", apiPrefix+"/devices/dev-ed/sign/batch", map[string]any{"items": []string{"l1", "l2", "l3"}})
+	must(code == 200, "sign batch status=%d body=%s", code, string(body))
+	var batch struct {
+		Signatures []signResp `json:"signatures"`
+	}
+	_ = json.Unmarshal(body, &batch)
+	must(len(batch.Signatures) == 3, "sign batch=%s", string(body))
+	prev := edSig.Signature
+	for i, bs := range batch.Signatures {
+		must(bs.SignedData == fmt.Sprintf("%d_l%d_%s", i+1, i+1, prev), "batch item %d signed_data=%q", i, bs.SignedData)
+		verify(bs.Signature, bs.SignedData, edDev.PublicKeyPEM, bs.Scheme)
+		prev = bs.Signature
+	}
+	code, _ = do("POST", apiPrefix+"/devices/dev-ed/sign/batch", map[string]any{"items": []string{"ok", ""}})
+	must(code == 400, "sign batch with blank item status=%d", code)
+
+	// 11b) A retried sign with the same Idempotency-Key returns the original signature
+	signOnce := func(key string) []byte {
+		req, _ := http.NewRequest("POST", ts.URL+apiPrefix+"/devices/dev-ed/sign", strings.NewReader(`{"data":"retry"}`))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		must(resp.StatusCode == 200, "idempotent sign status=%d body=%s", resp.StatusCode, string(b))
+		return b
+	}
+	first, retried := signOnce("smoke-1"), signOnce("smoke-1")
+	must(bytes.Equal(first, retried), "retry signed again: %s vs %s", first, retried)
+
+	// 12) Canonical JSON payloads (v1): data with underscores stays unambiguous
+	code, body = do("POST", apiPrefix+"/devices", map[string]any{"id": "dev-v1", "algorithm": "ED25519", "payload_format": "v1"})
+	must(code == 201 && strings.Contains(string(body), `"payload_format":"v1"`), "create v1 status=%d body=%s", code, string(body))
+	var v1Dev deviceResp
+	_ = json.Unmarshal(body, &v1Dev)
+	code, body = do("POST", apiPrefix+"/devices/dev-v1/sign", map[string]any{"data": "a_b"})
+	must(code == 200, "sign v1 status=%d body=%s", code, string(body))
+	var v1Sig signResp
+	_ = json.Unmarshal(body, &v1Sig)
+	var v1Payload struct {
+		V       int    `json:"v"`
+		Counter uint64 `json:"counter"`
+		Data    string `json:"data"`
+		Prev    string `json:"prev"`
+	}
+	must(json.Unmarshal([]byte(v1Sig.SignedData), &v1Payload) == nil, "v1 signed_data=%q", v1Sig.SignedData)
+	must(v1Payload.V == 1 && v1Payload.Counter == 0 && v1Payload.Data == "a_b" &&
+		v1Payload.Prev == base64.StdEncoding.EncodeToString([]byte("dev-v1")), "v1 payload=%+v", v1Payload)
+	verify(v1Sig.Signature, v1Sig.SignedData, v1Dev.PublicKeyPEM, v1Sig.Scheme)
+
+	// 12b) Decommissioning: signing stops for good, verification still works
+	code, body = do("POST", apiPrefix+"/devices/dev-imported/decommission", nil)
+	must(code == 200 && strings.Contains(string(body), `"status":"decommissioned"`), "decommission status=%d body=%s", code, string(body))
+	code, _ = do("POST", apiPrefix+"/devices/dev-imported/sign", map[string]any{"data": "late"})
+	must(code == 409, "sign after decommission status=%d", code)
+	code, body = do("POST", apiPrefix+"/devices/dev-imported/verify", map[string]any{"signed_data": impSig.SignedData, "signature": impSig.Signature})
+	must(code == 200 && strings.Contains(string(body), `"valid":true`), "verify after decommission status=%d body=%s", code, string(body))
+	code, _ = do("POST", apiPrefix+"/devices/dev-imported/activate", nil)
+	must(code == 409, "reactivate decommissioned status=%d", code)
+
+	// 13) Key parameters outside the allow-list are rejected
+	code, _ = do("POST", apiPrefix+"/devices", map[string]any{"id": "dev-weak", "algorithm": "RSA", "key_params": map[string]any{"bits": 1024}})
+	must(code == 400, "weak RSA key status=%d", code)
+
+	// 14) Tenants: another tenant neither sees dev-1 nor collides with its ID
+	tenant = "other"
+	code, _ = do("GET", apiPrefix+"/devices/"+deviceID, nil)
+	must(code == 404, "get from other tenant status=%d", code)
+	code, body = do("POST", apiPrefix+"/devices", map[string]any{"id": deviceID, "algorithm": "ED25519"})
+	must(code == 201 && strings.Contains(string(body), `"tenant":"other"`), "create in other tenant status=%d body=%s", code, string(body))
+	tenant = ""
+	code, body = do("GET", apiPrefix+"/devices/"+deviceID, nil)
+	must(code == 200 && strings.Contains(string(body), `"algorithm":"RSA"`), "default tenant dev-1 status=%d body=%s", code, string(body))
 }
 
-// verify checks the signature against signedData using the PEM public key.
-// Supports RSA (PKCS#1 "RSA PUBLIC KEY" or PKIX "PUBLIC KEY") and ECDSA (PKIX).
-func verify(sigB64, signedData, pubPEM string) {
+// verify checks the signature against signedData using the PEM public key and
+// the scheme from the sign response.
+// Supports RSA (PKCS#1 "RSA PUBLIC KEY" or PKIX "PUBLIC KEY"), ECDSA and Ed25519 (PKIX).
+func verify(sigB64, signedData, pubPEM, scheme string) {
 	sig, err := base64.StdEncoding.DecodeString(sigB64)
 	must(err == nil, "decode signature: %v", err)
 
@@ -165,16 +357,32 @@ func verify(sigB64, signedData, pubPEM string) {
 		must(false, "unknown PEM type %q", block.Type)
 	}
 
-	digest := sha256.Sum256([]byte(signedData))
+	hash := goCrypto.SHA256
+	switch {
+	case strings.HasSuffix(scheme, "SHA384"):
+		hash = goCrypto.SHA384
+	case strings.HasSuffix(scheme, "SHA512"):
+		hash = goCrypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(signedData))
+	digest := h.Sum(nil)
 
 	switch k := pub.(type) {
 	case *rsa.PublicKey:
-		// IMPORTANT: pass crypto.SHA256 (constant), not bytes.
-		err = rsa.VerifyPKCS1v15(k, goCrypto.SHA256, digest[:], sig)
+		// IMPORTANT: pass the crypto.Hash constant, not bytes.
+		if strings.HasPrefix(scheme, "RSA-PSS") {
+			err = rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		} else {
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		}
 		must(err == nil, "rsa verify failed: %v", err)
 	case *ecdsa.PublicKey:
-		ok := ecdsa.VerifyASN1(k, digest[:], sig)
+		ok := ecdsa.VerifyASN1(k, digest, sig)
 		must(ok, "ecdsa verify failed")
+	case ed25519.PublicKey:
+		// Ed25519 signs the message itself, not a digest.
+		must(ed25519.Verify(k, []byte(signedData), sig), "ed25519 verify failed")
 	default:
 		must(false, "unexpected public key type %T", pub)
 	}